@@ -0,0 +1,133 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxWait limits how long a long-polling request may wait for a change.
+const maxWait = 5 * time.Minute
+
+// apiStatus is the JSON form of a Server's status.
+type apiStatus struct {
+	// Seq counts the changes to the status. Passing it back as the seq
+	// parameter of a long-polling request waits for the next change.
+	Seq      int64        `json:"seq"`
+	Versions []apiVersion `json:"versions"`
+}
+
+// apiVersion is the JSON form of a version's status.
+type apiVersion struct {
+	Version   string     `json:"version"`
+	Tag       string     `json:"tag"`
+	Tagged    bool       `json:"tagged"`
+	URL       string     `json:"url,omitempty"`
+	FirstSeen *time.Time `json:"firstSeen,omitempty"`
+	LastPoll  *time.Time `json:"lastPoll,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// serveJSON serves the status as JSON: of every version for / and
+// /api/status, of one for /<tag> and /api/status?version=<version>.
+//
+// With a wait parameter, such as ?wait=30s, it waits up to that long for the
+// status to change before responding. By default it waits for the next
+// change; with a seq parameter it responds at once if the status has changed
+// since the response with that Seq.
+func (s *Server) serveJSON(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var wait time.Duration
+	if v := q.Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "bad wait duration", http.StatusBadRequest)
+			return
+		}
+		if d > maxWait {
+			d = maxWait
+		}
+		wait = d
+	}
+
+	s.mu.RLock()
+	seq, changed := s.seq, s.changed
+	s.mu.RUnlock()
+	if v := q.Get("seq"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "bad seq", http.StatusBadRequest)
+			return
+		}
+		if n != seq {
+			wait = 0
+		}
+	}
+	if wait > 0 {
+		select {
+		case <-changed:
+		case <-s.clock.After(wait):
+		case <-r.Context().Done():
+		case <-s.ctx.Done():
+		}
+	}
+
+	match := func(vs *versionStatus) bool {
+		switch {
+		case r.URL.Path == "/api/status":
+			v := q.Get("version")
+			return v == "" || v == vs.Name
+		case r.URL.Path == "/":
+			return true
+		}
+		return r.URL.Path == "/"+vs.Tag
+	}
+	s.mu.RLock()
+	resp := s.apiStatus(match)
+	s.mu.RUnlock()
+	if len(resp.Versions) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Print(err)
+	}
+}
+
+// apiStatus returns the JSON form of the status of the versions for which
+// match returns true. s.mu must be held.
+func (s *Server) apiStatus(match func(*versionStatus) bool) apiStatus {
+	resp := apiStatus{Seq: s.seq}
+	for _, vs := range s.versions {
+		if match(vs) {
+			resp.Versions = append(resp.Versions, s.status(vs).api())
+		}
+	}
+	return resp
+}
+
+// api returns the JSON form of st.
+func (st status) api() apiVersion {
+	v := apiVersion{
+		Version:   st.Version,
+		Tag:       st.Tag,
+		Tagged:    st.Yes,
+		URL:       st.URL,
+		LastError: st.LastError,
+	}
+	if !st.FirstSeen.IsZero() {
+		v.FirstSeen = &st.FirstSeen
+	}
+	if !st.LastPoll.IsZero() {
+		v.LastPoll = &st.LastPoll
+	}
+	return v
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusAPI(t *testing.T) {
+	// The tags file doesn't exist yet, so the first poll fails.
+	tags := filepath.Join(t.TempDir(), "tags")
+
+	clock := newFakeClock()
+	s := NewServer(context.Background(), []Version{{Name: "1.x", Tag: "go1.x"}}, WithChecker(fileChecker{name: tags}), WithClock(clock))
+	defer s.Close()
+
+	get := func(path, accept string) (int, apiStatus) {
+		t.Helper()
+		r := httptest.NewRequest("GET", path, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var st apiStatus
+		if w.Code == http.StatusOK {
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("GET %s: Content-Type %q, body %s", path, ct, w.Body)
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, st
+	}
+
+	w := <-clock.waits // Wait for the poller to fail and start waiting.
+	_, st := get("/api/status", "")
+	if st.Seq != 1 || len(st.Versions) != 1 {
+		t.Fatalf("status = %+v, want 1 version after 1 change", st)
+	}
+	if v := st.Versions[0]; v.Tagged || v.FirstSeen != nil || v.LastPoll == nil || !strings.Contains(v.LastError, "no such file") {
+		t.Errorf("status of 1.x = %+v, want a failed poll", v)
+	}
+	if _, st := get("/go1.x", "application/json"); len(st.Versions) != 1 || st.Versions[0].Version != "1.x" {
+		t.Errorf("JSON status of /go1.x = %+v", st)
+	}
+	if _, st := get("/api/status?version=1.x", ""); len(st.Versions) != 1 || st.Versions[0].Version != "1.x" {
+		t.Errorf("status of version 1.x = %+v", st)
+	}
+	if code, _ := get("/api/status?version=1.z", ""); code != http.StatusNotFound {
+		t.Errorf("status of unknown version: %d, want 404", code)
+	}
+	if code, _ := get("/api/status?wait=forever", ""); code != http.StatusBadRequest {
+		t.Errorf("bad wait: %d, want 400", code)
+	}
+
+	// Without a change, a long poll times out and returns the same status.
+	result := make(chan apiStatus)
+	go func() {
+		_, st := get("/api/status?wait=1m&seq=1", "")
+		result <- st
+	}()
+	lw := <-clock.waits
+	if lw.d != time.Minute {
+		t.Errorf("long poll waited %v, want 1m", lw.d)
+	}
+	lw.wake <- clock.now
+	if st := <-result; st.Seq != 1 {
+		t.Errorf("timed-out long poll returned %+v", st)
+	}
+	// It returns at once if the status changed since the given seq.
+	if _, st := get("/api/status?wait=1h&seq=0", ""); st.Seq != 1 {
+		t.Errorf("long poll for old seq returned %+v", st)
+	}
+
+	// A long poll sees 1.x get tagged.
+	go func() {
+		_, st := get("/api/status?wait=1m&seq=1", "")
+		result <- st
+	}()
+	if err := os.WriteFile(tags, []byte("go1.x\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	w.wake <- clock.now
+	st = <-result
+	if st.Seq != 2 || len(st.Versions) != 1 {
+		t.Fatalf("long poll returned %+v, want 1.x after 2 changes", st)
+	}
+	if v := st.Versions[0]; !v.Tagged || v.FirstSeen == nil || v.LastError != "" {
+		t.Errorf("status of 1.x = %+v, want tagged", v)
+	}
+}
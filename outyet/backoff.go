@@ -0,0 +1,71 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// pollDelay returns how long to wait before the next poll, after the given
+// number of consecutive failed polls, the last of which returned err.
+//
+// Without failures it's period. After them it backs off exponentially,
+// doubling the wait with each failure, and picks a random wait between half
+// that and all of it, so that servers restarting together don't poll in
+// lockstep. The backoff never exceeds maxPeriod, but the wait is still at
+// least as long as a Retry-After header asks, taking a date in it to be
+// relative to now.
+//
+// random returns a random number in [0, n); it's rand.Int63n except in tests.
+func pollDelay(period, maxPeriod time.Duration, failures int, err error, now time.Time, random func(n int64) int64) time.Duration {
+	if maxPeriod < period {
+		maxPeriod = period
+	}
+	if failures == 0 {
+		return period
+	}
+	d := period
+	for i := 0; i < failures && d < maxPeriod; i++ {
+		d *= 2
+	}
+	if d > maxPeriod {
+		d = maxPeriod
+	}
+	if half := d / 2; half > 0 {
+		d = half + time.Duration(random(int64(d-half)))
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		if wait := parseRetryAfter(se.retryAfter, now); wait > d {
+			d = wait
+		}
+	}
+	return d
+}
+
+// pollErrorClass classifies an error from a TagChecker for the statistics:
+// "ratelimit" for 429 Too Many Requests responses, "server" for 5xx
+// responses, "network" for failures to talk to the server at all, and
+// "other" for anything else, such as a malformed response.
+func pollErrorClass(err error) string {
+	var se *statusError
+	if errors.As(err, &se) {
+		switch {
+		case se.code == http.StatusTooManyRequests:
+			return "ratelimit"
+		case se.code >= 500:
+			return "server"
+		}
+		return "other"
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return "network"
+	}
+	return "other"
+}
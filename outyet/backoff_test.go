@@ -0,0 +1,160 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPollDelay(t *testing.T) {
+	const (
+		period = 5 * time.Second
+		max    = time.Minute
+	)
+	lowest := func(n int64) int64 { return 0 }
+	highest := func(n int64) int64 { return n - 1 }
+	now := time.Date(2024, 2, 6, 12, 0, 0, 0, time.UTC)
+	limited := &statusError{code: http.StatusTooManyRequests, retryAfter: "30"}
+	limitedUntil := &statusError{code: http.StatusTooManyRequests, retryAfter: "Tue, 06 Feb 2024 12:00:45 GMT"}
+	slowDown := &statusError{code: http.StatusServiceUnavailable, retryAfter: "3600"}
+	for _, tt := range []struct {
+		failures int
+		err      error
+		random   func(int64) int64
+		want     time.Duration
+	}{
+		{0, nil, highest, period},
+		{1, errors.New("boom"), lowest, 5 * time.Second},
+		{1, errors.New("boom"), highest, 10*time.Second - 1},
+		{2, errors.New("boom"), lowest, 10 * time.Second},
+		{3, errors.New("boom"), highest, 40*time.Second - 1},
+		{10, errors.New("boom"), lowest, 30 * time.Second},
+		{10, errors.New("boom"), highest, max - 1},
+		{1, limited, lowest, 30 * time.Second},
+		{1, fmt.Errorf("checking: %w", limited), highest, 30 * time.Second},
+		{4, limited, highest, max - 1},
+		{1, limitedUntil, lowest, 45 * time.Second},
+		{1, slowDown, lowest, time.Hour},
+	} {
+		if got := pollDelay(period, max, tt.failures, tt.err, now, tt.random); got != tt.want {
+			t.Errorf("pollDelay after %d failures, error %v = %v, want %v", tt.failures, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 2, 6, 12, 0, 0, 0, time.UTC)
+	for h, want := range map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-1":                            0,
+		"soon":                          0,
+		"Tue, 06 Feb 2024 12:01:30 GMT": 90 * time.Second,
+		"Tue, 06 Feb 2024 11:00:00 GMT": 0,
+	} {
+		if got := parseRetryAfter(h, now); got != want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", h, got, want)
+		}
+	}
+}
+
+func TestPollErrorClass(t *testing.T) {
+	status := statusHandler(http.StatusTooManyRequests)
+	s := httptest.NewServer(&status)
+	c := headChecker{base: s.URL + "/", client: s.Client()}
+	check := func() error {
+		t.Helper()
+		ok, err := c.IsTagged(context.Background(), "go1.x")
+		if ok {
+			t.Fatalf("IsTagged = true, want an error")
+		}
+		return err
+	}
+
+	for code, want := range map[int]string{
+		http.StatusTooManyRequests:     "ratelimit",
+		http.StatusServiceUnavailable:  "server",
+		http.StatusInternalServerError: "server",
+		http.StatusForbidden:           "other",
+	} {
+		status = statusHandler(code)
+		if got := pollErrorClass(check()); got != want {
+			t.Errorf("class of %d response = %q, want %q", code, got, want)
+		}
+	}
+	status = http.StatusNotFound
+	if err := check(); err != nil {
+		t.Errorf("404 response: %v, want no error", err)
+	}
+
+	s.Close()
+	if got := pollErrorClass(check()); got != "network" {
+		t.Errorf("class of error from closed server = %q, want network", got)
+	}
+	if got := pollErrorClass(errors.New("bad JSON")); got != "other" {
+		t.Errorf("class of other error = %q, want other", got)
+	}
+}
+
+// scriptedChecker returns the results of a script of errors, one per poll,
+// and then reports the tag as existing.
+type scriptedChecker struct {
+	errs []error
+}
+
+func (c *scriptedChecker) IsTagged(ctx context.Context, tag string) (bool, error) {
+	if len(c.errs) == 0 {
+		return true, nil
+	}
+	err := c.errs[0]
+	c.errs = c.errs[1:]
+	return false, err
+}
+
+func (c *scriptedChecker) URL(tag string) string { return "" }
+
+func TestPollBackoff(t *testing.T) {
+	others := count(pollErrors, "other")
+	failed := errors.New("malformed response")
+	c := &scriptedChecker{errs: []error{nil, failed, failed, failed, nil, failed}}
+	clock := newFakeClock()
+	clock.instant = true
+	s := NewServer(context.Background(), []Version{{Name: "1.x", Tag: "go1.x"}},
+		WithChecker(c), WithClock(clock), WithPollPeriod(time.Second, 3*time.Second))
+	defer s.Close()
+	waitForTag(t, s, "go1.x")
+
+	// Backoff starts over after a successful poll that found no tag.
+	want := []struct{ min, max time.Duration }{
+		{time.Second, time.Second},
+		{time.Second, 2 * time.Second},
+		{1500 * time.Millisecond, 3 * time.Second},
+		{1500 * time.Millisecond, 3 * time.Second},
+		{time.Second, time.Second},
+		{time.Second, 2 * time.Second},
+	}
+	close(clock.waits)
+	var delays []time.Duration
+	for w := range clock.waits {
+		delays = append(delays, w.d)
+	}
+	if len(delays) != len(want) {
+		t.Fatalf("waited %v, want %d waits", delays, len(want))
+	}
+	for i, d := range delays {
+		if d < want[i].min || d > want[i].max {
+			t.Errorf("wait %d was %v, want between %v and %v", i, d, want[i].min, want[i].max)
+		}
+	}
+	if got := count(pollErrors, "other") - others; got != 4 {
+		t.Errorf("counted %d errors, want 4", got)
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A TagChecker reports whether a tag exists in some repository.
+type TagChecker interface {
+	// IsTagged reports whether the tag exists.
+	IsTagged(ctx context.Context, tag string) (bool, error)
+
+	// URL returns the URL of a page about the tag, or "" if there isn't one.
+	URL(tag string) string
+}
+
+// Default sources for the checkers that have one.
+const (
+	baseChangeURL = "https://go.googlesource.com/go/+/"
+	goDevDLURL    = "https://go.dev/dl/?mode=json&include=all"
+)
+
+// newChecker returns the TagChecker of the given kind, reading tags from
+// source: a URL for the "googlesource", "godev" and "git" kinds, which use
+// client, or a file name for "file". An empty source selects the kind's
+// default, if any.
+func newChecker(kind, source string, client *http.Client) (TagChecker, error) {
+	switch kind {
+	case "googlesource":
+		if source == "" {
+			source = baseChangeURL
+		}
+		return headChecker{base: source, client: client}, nil
+	case "godev":
+		if source == "" {
+			source = goDevDLURL
+		}
+		return goDevChecker{url: source, client: client}, nil
+	case "git":
+		if source == "" {
+			return nil, errors.New("the git checker needs a repository URL")
+		}
+		return gitChecker{repo: strings.TrimSuffix(source, "/"), client: client}, nil
+	case "file":
+		if source == "" {
+			return nil, errors.New("the file checker needs a file name")
+		}
+		return fileChecker{name: source}, nil
+	}
+	return nil, fmt.Errorf("unknown checker %q", kind)
+}
+
+// get makes an HTTP request with the given method and no body.
+func get(ctx context.Context, client *http.Client, method, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+// A statusError is an unexpected HTTP response from a tag source.
+type statusError struct {
+	url        string
+	code       int
+	status     string
+	retryAfter string // the Retry-After header, if any; see parseRetryAfter
+}
+
+func newStatusError(url string, r *http.Response) *statusError {
+	return &statusError{
+		url:        url,
+		code:       r.StatusCode,
+		status:     r.Status,
+		retryAfter: r.Header.Get("Retry-After"),
+	}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.url, e.status)
+}
+
+// parseRetryAfter returns the wait asked for by a Retry-After header, which
+// is either a number of seconds or an HTTP date, or 0 if there isn't one.
+func parseRetryAfter(h string, now time.Time) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// headChecker makes an HTTP HEAD request to the tag's URL, base+tag, and
+// reports the tag as existing if it returns a 200 OK response, and as not
+// existing if it returns 404 Not Found. Any other response is an error.
+// It suits Gitiles servers such as go.googlesource.com.
+type headChecker struct {
+	base   string
+	client *http.Client
+}
+
+func (c headChecker) IsTagged(ctx context.Context, tag string) (bool, error) {
+	url := c.URL(tag)
+	r, err := get(ctx, c.client, "HEAD", url)
+	if err != nil {
+		return false, err
+	}
+	r.Body.Close()
+	switch r.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, newStatusError(url, r)
+}
+
+func (c headChecker) URL(tag string) string {
+	return c.base + tag
+}
+
+// goDevChecker looks for the tag among the releases listed by the JSON form
+// of the go.dev download page.
+type goDevChecker struct {
+	url    string
+	client *http.Client
+}
+
+func (c goDevChecker) IsTagged(ctx context.Context, tag string) (bool, error) {
+	r, err := get(ctx, c.client, "GET", c.url)
+	if err != nil {
+		return false, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return false, newStatusError(c.url, r)
+	}
+	var releases []struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&releases); err != nil {
+		return false, fmt.Errorf("%s: %v", c.url, err)
+	}
+	for _, rel := range releases {
+		if rel.Version == tag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c goDevChecker) URL(tag string) string {
+	return "https://go.dev/dl/#" + tag
+}
+
+// gitChecker lists the references of a Git repository over the smart HTTP
+// protocol, like git ls-remote, and looks for the tag among them.
+type gitChecker struct {
+	repo   string
+	client *http.Client
+}
+
+func (c gitChecker) IsTagged(ctx context.Context, tag string) (bool, error) {
+	url := c.repo + "/info/refs?service=git-upload-pack"
+	r, err := get(ctx, c.client, "GET", url)
+	if err != nil {
+		return false, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return false, newStatusError(url, r)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/x-git-upload-pack-advertisement" {
+		return false, fmt.Errorf("%s: unexpected content type %q; not a smart HTTP Git server?", url, ct)
+	}
+	refs, err := readRefs(r.Body)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", url, err)
+	}
+	for _, ref := range refs {
+		if ref == "refs/tags/"+tag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c gitChecker) URL(tag string) string {
+	return c.repo
+}
+
+// readRefs returns the names of the references in a Git smart HTTP reference
+// advertisement: a "# service=git-upload-pack" line and a flush packet,
+// followed by a packet per reference and another flush packet.
+func readRefs(r io.Reader) ([]string, error) {
+	br := bufio.NewReader(r)
+	var refs []string
+	flushes := 0
+	for flushes < 2 {
+		pkt, err := readPacket(br)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case pkt == nil:
+			flushes++
+		case flushes == 0:
+			// The service line.
+		default:
+			// "<object ID> <name>\x00<capabilities>\n" for the first
+			// reference, "<object ID> <name>\n" for the rest.
+			line, _, _ := bytes.Cut(bytes.TrimSuffix(pkt, []byte("\n")), []byte{0})
+			_, name, ok := bytes.Cut(line, []byte(" "))
+			if !ok {
+				return nil, fmt.Errorf("bad reference line %q", line)
+			}
+			refs = append(refs, string(name))
+		}
+	}
+	return refs, nil
+}
+
+// readPacket reads a Git pkt-line. It returns nil for a flush packet.
+func readPacket(r *bufio.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading packet: %v", err)
+	}
+	n, err := strconv.ParseUint(string(hdr[:]), 16, 16)
+	if err != nil || n == 1 || n == 2 || n == 3 {
+		return nil, fmt.Errorf("bad packet length %q", hdr[:])
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	pkt := make([]byte, n-4)
+	if _, err := io.ReadFull(r, pkt); err != nil {
+		return nil, fmt.Errorf("reading packet: %v", err)
+	}
+	return pkt, nil
+}
+
+// fileChecker looks for the tag in a local file listing one tag per line.
+// It's meant for testing.
+type fileChecker struct {
+	name string
+}
+
+func (c fileChecker) IsTagged(ctx context.Context, tag string) (bool, error) {
+	data, err := os.ReadFile(c.name)
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == tag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c fileChecker) URL(tag string) string {
+	return ""
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHeadChecker(t *testing.T) {
+	// Set up a fake "Google Code" web server reporting 404 not found.
+	status := statusHandler(http.StatusNotFound)
+	s := httptest.NewServer(&status)
+	defer s.Close()
+	c := headChecker{base: s.URL + "/", client: s.Client()}
+
+	if ok, err := c.IsTagged(context.Background(), "go1.x"); ok || err != nil {
+		t.Fatalf("IsTagged = %v, %v, want false", ok, err)
+	}
+
+	// Change fake server status to 200 OK and try again.
+	status = http.StatusOK
+
+	if ok, err := c.IsTagged(context.Background(), "go1.x"); !ok || err != nil {
+		t.Fatalf("IsTagged = %v, %v, want true", ok, err)
+	}
+	if got, want := c.URL("go1.x"), s.URL+"/go1.x"; got != want {
+		t.Errorf("URL = %q, want %q", got, want)
+	}
+}
+
+func TestGoDevChecker(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("mode") != "json" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `[{"version": "go1.24.1", "stable": true, "files": []}, {"version": "go1.24rc1", "stable": false}]`)
+	}))
+	defer s.Close()
+	c := goDevChecker{url: s.URL + "/dl/?mode=json&include=all", client: s.Client()}
+
+	for tag, want := range map[string]bool{"go1.24.1": true, "go1.24rc1": true, "go1.24": false} {
+		if ok, err := c.IsTagged(context.Background(), tag); ok != want || err != nil {
+			t.Errorf("IsTagged(%q) = %v, %v, want %v", tag, ok, err, want)
+		}
+	}
+
+	c.url = s.URL + "/dl/"
+	if _, err := c.IsTagged(context.Background(), "go1.24.1"); err == nil {
+		t.Errorf("IsTagged succeeded on a 404")
+	}
+}
+
+// pktLine formats s as a Git pkt-line.
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+func TestGitChecker(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef01234567"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/project/info/refs" || r.URL.Query().Get("service") != "git-upload-pack" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		fmt.Fprint(w, pktLine("# service=git-upload-pack\n")+"0000"+
+			pktLine(id+" HEAD\x00multi_ack side-band-64k\n")+
+			pktLine(id+" refs/heads/main\n")+
+			pktLine(id+" refs/tags/v1.0.0\n")+
+			pktLine(id+" refs/tags/v1.0.0^{}\n")+
+			"0000")
+	}))
+	defer s.Close()
+
+	c, err := newChecker("git", s.URL+"/project/", s.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tag, want := range map[string]bool{"v1.0.0": true, "v1.1.0": false, "main": false} {
+		if ok, err := c.IsTagged(context.Background(), tag); ok != want || err != nil {
+			t.Errorf("IsTagged(%q) = %v, %v, want %v", tag, ok, err, want)
+		}
+	}
+
+	// A dumb HTTP server, or something else entirely, is an error.
+	c = gitChecker{repo: s.URL, client: s.Client()}
+	if _, err := c.IsTagged(context.Background(), "v1.0.0"); err == nil {
+		t.Errorf("IsTagged succeeded on a 404")
+	}
+}
+
+func TestFileChecker(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "tags")
+	c := fileChecker{name: name}
+	if _, err := c.IsTagged(context.Background(), "v1"); err == nil {
+		t.Errorf("IsTagged succeeded without a file")
+	}
+	if err := os.WriteFile(name, []byte("v1\nv2\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for tag, want := range map[string]bool{"v1": true, "v2": true, "v3": false} {
+		if ok, err := c.IsTagged(context.Background(), tag); ok != want || err != nil {
+			t.Errorf("IsTagged(%q) = %v, %v, want %v", tag, ok, err, want)
+		}
+	}
+}
+
+func TestNewChecker(t *testing.T) {
+	for _, tt := range []struct{ kind, source string }{
+		{"git", ""},
+		{"file", ""},
+		{"svn", "https://example.com/"},
+	} {
+		if _, err := newChecker(tt.kind, tt.source, http.DefaultClient); err == nil {
+			t.Errorf("newChecker(%q, %q) succeeded", tt.kind, tt.source)
+		}
+	}
+	if c, err := newChecker("googlesource", "", http.DefaultClient); err != nil || c.URL("go1.24") != "https://go.googlesource.com/go/+/go1.24" {
+		t.Errorf("newChecker(googlesource) = %v, %v", c, err)
+	}
+}
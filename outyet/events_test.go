@@ -0,0 +1,122 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	tags := filepath.Join(t.TempDir(), "tags")
+	if err := os.WriteFile(tags, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	s := NewServer(context.Background(), []Version{{Name: "1.x", Tag: "go1.x"}},
+		WithChecker(fileChecker{name: tags}), WithClock(clock), WithHeartbeat(time.Minute))
+	defer s.Close()
+	w := <-clock.waits // The first poll found no tag.
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	lines := bufio.NewScanner(resp.Body)
+
+	// next returns the next event, skipping heartbeats, and the number of
+	// heartbeats skipped.
+	next := func() (id string, st apiStatus, heartbeats int) {
+		t.Helper()
+		var event string
+		for lines.Scan() {
+			line := lines.Text()
+			switch {
+			case line == ": heartbeat":
+				heartbeats++
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &st); err != nil {
+					t.Fatal(err)
+				}
+			case line == "" && event != "":
+				if event != "status" {
+					t.Fatalf("event %q, want status", event)
+				}
+				return id, st, heartbeats
+			}
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return
+	}
+
+	// The current status comes first.
+	if id, st, _ := next(); id != "0" || len(st.Versions) != 1 || st.Versions[0].Tagged {
+		t.Fatalf("first event: id %s, status %+v", id, st)
+	}
+
+	// Heartbeats keep the connection busy until 1.x is tagged. Send a few
+	// before tagging it.
+	for n := 0; n < 3; n++ {
+		hw := <-clock.waits
+		if hw.d != time.Minute {
+			t.Fatalf("waited %v for a heartbeat, want 1m", hw.d)
+		}
+		hw.wake <- clock.now
+		if !lines.Scan() || lines.Text() != ": heartbeat" {
+			t.Fatalf("got %q, %v; want a heartbeat", lines.Text(), lines.Err())
+		}
+		if !lines.Scan() || lines.Text() != "" {
+			t.Fatalf("heartbeat followed by %q, %v", lines.Text(), lines.Err())
+		}
+	}
+	if err := os.WriteFile(tags, []byte("go1.x\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	w.wake <- clock.now
+	id, st, _ := next()
+	if id != "1" || !st.Versions[0].Tagged || st.Versions[0].FirstSeen == nil {
+		t.Errorf("event after tagging: id %s, status %+v", id, st)
+	}
+}
+
+func TestPageSubscribes(t *testing.T) {
+	st, err := openStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.save("go1.x", savedVersion{Version: "1.x", Tagged: true, FirstSeen: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(context.Background(), []Version{{Name: "1.x", Tag: "go1.x"}}, WithChecker(failingChecker{t}), WithState(st))
+	defer s.Close()
+	for _, path := range []string{"/", "/go1.x"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		b := w.Body.String()
+		for _, want := range []string{`new EventSource("/events")`, `id="answer-go1.x" data-tagged="yes"`, `id="seen-go1.x"`} {
+			if !strings.Contains(b, want) {
+				t.Errorf("%s doesn't contain %q:\n%s", path, want, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// atomFeed and the types below are an Atom feed (RFC 4287), as much of it as
+// outyet needs.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    []atomLink  `xml:"link"`
+	Author  atomPerson  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+// feedID is the Atom ID of the feed, and the prefix of its entries' IDs,
+// which add the version's tag. IDs must never change, so unlike the links
+// they don't depend on the host the feed was requested from.
+const feedID = "tag:golang.org,2023:outyet"
+
+// serveFeed serves an Atom feed with an entry for each version that has
+// been tagged, newest first. Feed readers can poll it cheaply: the response
+// has an ETag, and a request with a matching If-None-Match header gets a
+// 304 Not Modified response.
+func (s *Server) serveFeed(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := scheme + "://" + r.Host
+
+	var tagged []status
+	s.mu.RLock()
+	for _, vs := range s.versions {
+		if vs.yes {
+			tagged = append(tagged, s.status(vs))
+		}
+	}
+	s.mu.RUnlock()
+	sort.SliceStable(tagged, func(i, j int) bool {
+		return tagged[i].FirstSeen.After(tagged[j].FirstSeen)
+	})
+
+	feed := atomFeed{
+		Title:  "Are they out yet?",
+		ID:     feedID,
+		Link:   []atomLink{{Rel: "self", Href: base + "/feed.atom"}, {Href: base + "/"}},
+		Author: atomPerson{Name: "outyet"},
+	}
+	// Until there's an entry, the feed has a fixed update time, so that it
+	// and its ETag stay the same across restarts.
+	updated := time.Unix(0, 0)
+	if len(tagged) > 0 {
+		updated = tagged[0].FirstSeen
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+	for _, st := range tagged {
+		link := st.URL
+		if link == "" {
+			link = base + "/" + st.Tag
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   "Go " + st.Version + " is out!",
+			ID:      feedID + "/" + st.Tag,
+			Updated: st.FirstSeen.UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: link},
+			Summary: "Go " + st.Version + " was tagged as " + st.Tag + ".",
+		})
+	}
+
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	body = append([]byte(xml.Header), body...)
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	if _, err := w.Write(body); err != nil {
+		log.Print(err)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFeed(t *testing.T) {
+	tags := filepath.Join(t.TempDir(), "tags")
+	if err := os.WriteFile(tags, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	versions := []Version{{Name: "1.1", Tag: "go1.1"}, {Name: "1.2", Tag: "go1.2"}}
+	s := NewServer(context.Background(), versions, WithChecker(fileChecker{name: tags}), WithClock(clock))
+	defer s.Close()
+
+	get := func(etag string) (*httptest.ResponseRecorder, atomFeed) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "http://outyet.example.com/feed.atom", nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var feed atomFeed
+		if w.Code == http.StatusOK {
+			if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+				t.Fatalf("%v:\n%s", err, w.Body)
+			}
+		}
+		return w, feed
+	}
+
+	w, feed := get("")
+	if len(feed.Entries) != 0 || feed.Updated != "1970-01-01T00:00:00Z" || feed.ID != "tag:golang.org,2023:outyet" {
+		t.Errorf("feed before any tags = %+v", feed)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	// A server started later serves the same empty feed.
+	later := newFakeClock()
+	later.now = clock.now.Add(time.Hour)
+	s2 := NewServer(context.Background(), versions, WithChecker(fileChecker{name: tags}), WithClock(later))
+	rec := httptest.NewRecorder()
+	s2.ServeHTTP(rec, httptest.NewRequest("GET", "http://outyet.example.com/feed.atom", nil))
+	s2.Close()
+	if got := rec.Header().Get("ETag"); got != etag {
+		t.Errorf("ETag after a restart = %s, want %s", got, etag)
+	}
+	if w, _ := get(etag); w.Code != http.StatusNotModified {
+		t.Errorf("request with matching ETag: status %d, want 304", w.Code)
+	}
+
+	// Tag 1.1, and an hour later 1.2.
+	w1, w2 := <-clock.waits, <-clock.waits
+	if err := os.WriteFile(tags, []byte("go1.1\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	w1.wake <- clock.now
+	w2.wake <- clock.now
+	waitForTag(t, s, "go1.1")
+	w2 = <-clock.waits
+	clock.now = clock.now.Add(time.Hour) // The poller is waiting, so this is safe.
+	if err := os.WriteFile(tags, []byte("go1.1\ngo1.2\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	w2.wake <- clock.now
+	waitForTag(t, s, "go1.2")
+
+	w, feed = get(etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("request with old ETag: status %d, want 200", w.Code)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Errorf("ETag didn't change")
+	}
+	if len(feed.Entries) != 2 || feed.Updated != "2024-02-06T13:00:00Z" {
+		t.Fatalf("feed = %+v, want 2 entries", feed)
+	}
+	e := feed.Entries[0]
+	if e.ID != "tag:golang.org,2023:outyet/go1.2" || e.Updated != "2024-02-06T13:00:00Z" || e.Link.Href != "http://outyet.example.com/go1.2" {
+		t.Errorf("first entry = %+v, want 1.2", e)
+	}
+	if e := feed.Entries[1]; e.ID != "tag:golang.org,2023:outyet/go1.1" || e.Updated != "2024-02-06T12:00:00Z" {
+		t.Errorf("second entry = %+v, want 1.1", e)
+	}
+
+	// Through a proxy with another name, the IDs are the same.
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "https://proxy.example.org/feed.atom", nil))
+	var proxied atomFeed
+	if err := xml.Unmarshal(rec.Body.Bytes(), &proxied); err != nil {
+		t.Fatal(err)
+	}
+	if proxied.ID != feed.ID || len(proxied.Entries) != 2 || proxied.Entries[0].ID != feed.Entries[0].ID {
+		t.Errorf("feed through proxy = %+v, want the same IDs as %+v", proxied, feed)
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	for header, want := range map[string]bool{
+		`"abc"`:          true,
+		`W/"abc"`:        true,
+		`"xyz", "abc"`:   true,
+		`*`:              true,
+		`"xyz"`:          false,
+		``:               false,
+		`"abc`:           false,
+		`W/"xyz",W/"ab"`: false,
+	} {
+		if got := etagMatches(header, `"abc"`); got != want {
+			t.Errorf("etagMatches(%s) = %v, want %v", header, got, want)
+		}
+	}
+}
@@ -2,36 +2,185 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Outyet is a web server that announces whether or not a particular Go version
-// has been tagged.
+// Outyet is a web server that announces whether or not particular Go versions
+// have been tagged.
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 // Command-line flags.
 var (
-	httpAddr   = flag.String("http", "localhost:8080", "Listen address")
-	pollPeriod = flag.Duration("poll", 5*time.Second, "Poll period")
-	version    = flag.String("version", "1.4", "Go version")
-)
+	httpAddr    = flag.String("http", "localhost:8080", "Listen address")
+	pollPeriod  = flag.Duration("poll", 5*time.Second, "Poll period")
+	maxPoll     = flag.Duration("max-poll", 5*time.Minute, "Maximum poll period when backing off after errors")
+	stateFile   = flag.String("state", "", "File to keep the versions' status in across restarts")
+	version     = flag.String("version", "1.4", "Go versions, comma-separated")
+	versionFile = flag.String("version-file", "", "File listing Go versions, one per line (overrides -version)")
+	checkerKind = flag.String("checker", "googlesource", "How to check for tags: googlesource, godev, git or file")
+	source      = flag.String("source", "", "URL or file the checker reads tags from (default depends on -checker)")
+	tagPrefix   = flag.String("tag-prefix", "go", "Prefix of a version's tag")
 
-const baseChangeURL = "https://go.googlesource.com/go/+/"
+	webhooks  = flag.String("webhook", "", "URLs to POST a JSON notification to when a version is tagged, comma-separated")
+	smtpAddr  = flag.String("smtp", "", "SMTP server `host:port` to send email notifications through")
+	smtpUser  = flag.String("smtp-user", "", "SMTP user name; the password is read from $SMTP_PASSWORD")
+	mailFrom  = flag.String("mail-from", "", "Sender of email notifications")
+	mailTo    = flag.String("mail-to", "", "Recipients of email notifications, comma-separated")
+	notifyCmd = flag.String("notify-command", "", "Command to run when a version is tagged, with arguments separated by spaces")
+)
 
 func main() {
 	flag.Parse()
-	changeURL := fmt.Sprintf("%sgo%s", baseChangeURL, *version)
-	http.Handle("/", NewServer(*version, changeURL, *pollPeriod))
-	log.Printf("serving http://%s", *httpAddr)
-	log.Fatal(http.ListenAndServe(*httpAddr, nil))
+	names := strings.Split(*version, ",")
+	if *versionFile != "" {
+		var err error
+		names, err = readVersionFile(*versionFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	versions, err := parseVersions(names, *tagPrefix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	checker, err := newChecker(*checkerKind, *source, http.DefaultClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	notifiers, err := notifiersFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := []Option{
+		WithChecker(checker),
+		WithPollPeriod(*pollPeriod, *maxPoll),
+		WithNotifiers(notifiers...),
+	}
+	if *stateFile != "" {
+		state, err := openStateStore(*stateFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithState(state))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	s := NewServer(ctx, versions, opts...)
+	http.Handle("/", s)
+	srv := &http.Server{Addr: *httpAddr}
+	go func() {
+		log.Printf("serving http://%s", *httpAddr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// On SIGTERM or an interrupt, stop polling, and give requests in
+	// flight, such as long polls, a few seconds to finish.
+	<-ctx.Done()
+	log.Print("shutting down")
+	s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Print(err)
+	}
+}
+
+// notifiersFromFlags returns the Notifiers configured by the command-line
+// flags.
+func notifiersFromFlags() ([]Notifier, error) {
+	var notifiers []Notifier
+	for _, url := range strings.Split(*webhooks, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			notifiers = append(notifiers, webhookNotifier{url: url, client: http.DefaultClient})
+		}
+	}
+	if *smtpAddr != "" {
+		var to []string
+		for _, addr := range strings.Split(*mailTo, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				to = append(to, addr)
+			}
+		}
+		n, err := newEmailNotifier(*smtpAddr, *smtpUser, os.Getenv("SMTP_PASSWORD"), *mailFrom, to)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	if args := strings.Fields(*notifyCmd); len(args) > 0 {
+		notifiers = append(notifiers, commandNotifier{args: args})
+	}
+	return notifiers, nil
+}
+
+// A Version is a Go version to watch for.
+type Version struct {
+	Name string // such as "1.24"
+	Tag  string // such as "go1.24"
+}
+
+// parseVersions returns the Versions with the given names, whose tags are
+// the names with tagPrefix prepended. The names may already have the prefix.
+// Blank names are ignored, and duplicates are an error.
+func parseVersions(names []string, tagPrefix string) ([]Version, error) {
+	var versions []Version
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimPrefix(strings.TrimSpace(name), tagPrefix)
+		if name == "" {
+			continue
+		}
+		if strings.ContainsAny(name, "/?# ") {
+			return nil, fmt.Errorf("bad Go version %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Go version %s listed twice", name)
+		}
+		seen[name] = true
+		versions = append(versions, Version{Name: name, Tag: tagPrefix + name})
+	}
+	if len(versions) == 0 {
+		return nil, errors.New("no Go versions to watch")
+	}
+	return versions, nil
+}
+
+// readVersionFile returns the versions listed in the named file, one per
+// line. Blank lines and lines starting with # are ignored.
+func readVersionFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			names = append(names, line)
+		}
+	}
+	return names, scanner.Err()
 }
 
 // Exported variables for monitoring the server.
@@ -41,89 +190,362 @@ var (
 	pollCount      = expvar.NewInt("pollCount")
 	pollError      = expvar.NewString("pollError")
 	pollErrorCount = expvar.NewInt("pollErrorCount")
+
+	// pollErrors counts errors by pollErrorClass, and pollNotTaggedCount
+	// polls that found no tag.
+	pollErrors         = expvar.NewMap("pollErrors")
+	pollNotTaggedCount = expvar.NewInt("pollNotTaggedCount")
 )
 
 // Server implements the outyet server.
 // It serves the user interface (it's an http.Handler)
 // and polls the remote repository for changes.
 type Server struct {
-	version string
-	url     string
-	period  time.Duration
+	checker   TagChecker
+	client    *http.Client // for the default checker
+	clock     Clock
+	period    time.Duration
+	maxPeriod time.Duration
+	notifiers []Notifier
+	state     *stateStore // or nil, to not keep state
+	heartbeat time.Duration
+
+	ctx    context.Context // canceled by Close
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // counts running pollers
+
+	mu       sync.RWMutex // protects the following and the status fields of versions
+	versions []*versionStatus
+	seq      int64         // counts changes to the versions' status
+	changed  chan struct{} // closed and replaced at each change
+}
 
-	mu  sync.RWMutex // protects the yes variable
-	yes bool
+// versionStatus is the status of one version watched by a Server.
+type versionStatus struct {
+	Version
+	yes           bool
+	firstSeen     time.Time // when the poller first saw the tag
+	notifyPending bool      // tagged, but the notifiers haven't all been told
+	lastPoll      time.Time
+	lastError     string // from the last poll, if it failed
+
+	lastSuccess time.Time  // of the last poll that didn't fail
+	pollLatency *histogram // of polls, in seconds
 }
 
-// NewServer returns an initialized outyet server.
-func NewServer(version, url string, period time.Duration) *Server {
-	s := &Server{version: version, url: url, period: period}
-	go s.poll()
+// NewServer returns an initialized outyet server that polls for each of the
+// given versions independently until it's tagged, and tells the notifiers
+// when it is. Polling stops when ctx is canceled or Close is called.
+//
+// Notifications that were still being sent when a Server with the same state
+// stopped are sent again.
+func NewServer(ctx context.Context, versions []Version, opts ...Option) *Server {
+	s := &Server{
+		client:    http.DefaultClient,
+		clock:     systemClock{},
+		period:    5 * time.Second,
+		maxPeriod: 5 * time.Minute,
+		heartbeat: 15 * time.Second,
+		changed:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.checker == nil {
+		s.checker = headChecker{base: baseChangeURL, client: s.client}
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	for _, v := range versions {
+		vs := &versionStatus{Version: v, pollLatency: newHistogram(pollLatencyBuckets)}
+		if s.state != nil {
+			s.state.restore(vs)
+		}
+		s.versions = append(s.versions, vs)
+		switch {
+		case !vs.yes:
+			s.wg.Add(1)
+			go s.poll(vs)
+		case vs.notifyPending:
+			s.wg.Add(1)
+			go func(vs *versionStatus) {
+				defer s.wg.Done()
+				s.sendNotifications(vs)
+			}(vs)
+		}
+	}
 	return s
 }
 
-// poll polls the change URL for the specified period until the tag exists.
-// Then it sets the Server's yes field true and exits.
-func (s *Server) poll() {
-	for !isTagged(s.url) {
-		pollSleep(s.period)
+// Close stops polling, canceling any checks and notifications in progress,
+// waits for the pollers to exit and saves the versions' last poll times.
+// An email being sent can't be canceled, so Close waits for it to be sent.
+func (s *Server) Close() {
+	s.cancel()
+	s.wg.Wait()
+	for _, vs := range s.versions {
+		s.saveState(vs)
+	}
+}
+
+// poll polls for the version's tag for the specified period until it exists,
+// backing off while polls fail. Then it marks the version as tagged, with its
+// notifications pending, sends them and exits. It also exits when the Server is closed.
+func (s *Server) poll(vs *versionStatus) {
+	defer s.wg.Done()
+	failures := 0
+	for {
+		start := s.clock.Now()
+		ok, err := s.isTagged(vs.Tag)
+		if s.ctx.Err() != nil {
+			return
+		}
+		if s.recordPoll(vs, ok, err, s.clock.Now().Sub(start)) {
+			s.saveState(vs)
+		}
+		if ok {
+			break
+		}
+		if err != nil {
+			failures++
+		} else {
+			failures = 0
+		}
+		select {
+		case <-s.clock.After(pollDelay(s.period, s.maxPeriod, failures, err, s.clock.Now(), rand.Int63n)):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+	s.sendNotifications(vs)
+}
+
+// sendNotifications tells the notifiers that vs is tagged. Once they've all
+// been told, or have failed for good, it records that the notifications are
+// no longer pending. If the Server is closed first, they stay pending, to be
+// sent again after a restart; notifiers that were already told are then
+// told twice.
+func (s *Server) sendNotifications(vs *versionStatus) {
+	s.mu.RLock()
+	e := Event{Version: vs.Name, Tag: vs.Tag, URL: s.checker.URL(vs.Tag), Time: vs.firstSeen}
+	s.mu.RUnlock()
+	notify(s.ctx, s.clock, s.notifiers, e)
+	if s.ctx.Err() != nil {
+		return
 	}
 	s.mu.Lock()
-	s.yes = true
+	vs.notifyPending = false
 	s.mu.Unlock()
-	pollDone()
+	s.saveState(vs)
 }
 
-// Hooks that may be overridden for integration tests.
-var (
-	pollSleep = time.Sleep
-	pollDone  = func() {}
-)
+// recordPoll updates vs with the result of a poll, which took the given
+// time, and reports whether its status changed. A new tag, or polls starting
+// or stopping to fail, count as a change in status; a different error from
+// a poll that failed before doesn't.
+func (s *Server) recordPoll(vs *versionStatus, ok bool, err error, latency time.Duration) bool {
+	errText := ""
+	if err != nil {
+		errText = err.Error()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vs.lastPoll = s.clock.Now()
+	vs.pollLatency.observe(latency.Seconds())
+	if err == nil {
+		vs.lastSuccess = vs.lastPoll
+	}
+	changed := (vs.lastError != "") != (err != nil)
+	vs.lastError = errText
+	if ok && !vs.yes {
+		vs.yes = true
+		vs.firstSeen = vs.lastPoll
+		vs.notifyPending = true
+		changed = true
+	}
+	if changed {
+		s.seq++
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+	return changed
+}
 
-// isTagged makes an HTTP HEAD request to the given URL and reports whether it
-// returned a 200 OK response.
-func isTagged(url string) bool {
+// isTagged asks the Server's checker whether the tag exists, and counts the
+// result.
+func (s *Server) isTagged(tag string) (bool, error) {
 	pollCount.Add(1)
-	r, err := http.Head(url)
-	if err != nil {
+	ok, err := s.checker.IsTagged(s.ctx, tag)
+	if s.ctx.Err() != nil {
+		// Closing the Server canceled the check.
+		return false, s.ctx.Err()
+	}
+	switch {
+	case err != nil:
 		log.Print(err)
 		pollError.Set(err.Error())
 		pollErrorCount.Add(1)
-		return false
+		pollErrors.Add(pollErrorClass(err), 1)
+	case !ok:
+		pollNotTaggedCount.Add(1)
+	}
+	return ok, err
+}
+
+// saveState saves the status of vs, if the Server keeps state. It's called
+// when the status changes and when the Server is closed, so the saved poll
+// times may lag behind after a crash.
+func (s *Server) saveState(vs *versionStatus) {
+	if s.state == nil {
+		return
+	}
+	s.mu.RLock()
+	v := savedVersion{
+		Version:       vs.Name,
+		Tagged:        vs.yes,
+		FirstSeen:     vs.firstSeen,
+		LastChecked:   vs.lastPoll,
+		LastSuccess:   vs.lastSuccess,
+		NotifyPending: vs.notifyPending,
+	}
+	s.mu.RUnlock()
+	if err := s.state.save(vs.Tag, v); err != nil {
+		log.Printf("saving state: %v", err)
 	}
-	return r.StatusCode == http.StatusOK
 }
 
-// ServeHTTP implements the HTTP user interface.
+// ServeHTTP implements the HTTP user interface. The root page lists every
+// version, and /<tag>, such as /go1.24, shows a single one. Both are also
+// available as JSON, as is /api/status; see serveJSON. /events streams
+// changes to the status, /feed.atom is an Atom feed of new tags, and /metrics
+// serves metrics for Prometheus.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/metrics" {
+		s.serveMetrics(w, r)
+		return
+	}
 	hitCount.Add(1)
+	switch r.URL.Path {
+	case "/feed.atom":
+		s.serveFeed(w, r)
+		return
+	case "/events":
+		s.serveEvents(w, r)
+		return
+	}
+	w.Header().Set("Vary", "Accept")
+	if r.URL.Path == "/api/status" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		s.serveJSON(w, r)
+		return
+	}
+	var statuses []status
 	s.mu.RLock()
-	data := struct {
-		URL     string
-		Version string
-		Yes     bool
-	}{
-		s.url,
-		s.version,
-		s.yes,
+	for _, vs := range s.versions {
+		if r.URL.Path == "/" || r.URL.Path == "/"+vs.Tag {
+			statuses = append(statuses, s.status(vs))
+		}
 	}
 	s.mu.RUnlock()
-	err := tmpl.Execute(w, data)
+
+	var err error
+	switch {
+	case r.URL.Path == "/":
+		err = listTmpl.Execute(w, statuses)
+	case len(statuses) == 1:
+		err = tmpl.Execute(w, statuses[0])
+	default:
+		http.NotFound(w, r)
+	}
 	if err != nil {
 		log.Print(err)
 	}
 }
 
-// tmpl is the HTML template that drives the user interface.
+// status is a snapshot of a versionStatus, for the templates.
+type status struct {
+	URL       string
+	Version   string
+	Tag       string
+	Yes       bool
+	FirstSeen time.Time
+	LastPoll  time.Time
+	LastError string
+}
+
+// status returns a snapshot of vs. s.mu must be held.
+func (s *Server) status(vs *versionStatus) status {
+	return status{
+		URL:       s.checker.URL(vs.Tag),
+		Version:   vs.Name,
+		Tag:       vs.Tag,
+		Yes:       vs.yes,
+		FirstSeen: vs.firstSeen,
+		LastPoll:  vs.lastPoll,
+		LastError: vs.lastError,
+	}
+}
+
+// tmpl is the HTML template that drives the user interface for one version.
 var tmpl = template.Must(template.New("tmpl").Parse(`
 <!DOCTYPE html><html><body><center>
 	<h2>Is Go {{.Version}} out yet?</h2>
-	<h1>
+	<h1 id="answer-{{.Tag}}"{{if .Yes}} data-tagged="yes"{{end}}>
 	{{if .Yes}}
 		<a href="{{.URL}}">YES!</a>
 	{{else}}
 		No. :-(
 	{{end}}
 	</h1>
-</center></body></html>
+	<p id="seen-{{.Tag}}" data-prefix="First seen tagged ">
+	{{if .Yes}}First seen tagged {{.FirstSeen.Format "2006-01-02 15:04 MST"}}{{end}}
+	</p>
+</center>` + eventsScript + `</body></html>
 `))
+
+// listTmpl is the HTML template for the page listing every version.
+var listTmpl = template.Must(template.New("list").Parse(`
+<!DOCTYPE html><html>
+<head><link rel="alternate" type="application/atom+xml" title="Are they out yet?" href="/feed.atom"></head>
+<body><center>
+	<h2>Are they out yet?</h2>
+	<table>
+	{{range .}}
+	<tr>
+		<td><a href="/{{.Tag}}">Go {{.Version}}</a></td>
+		{{if .Yes}}
+		<td id="answer-{{.Tag}}" data-tagged="yes"><a href="{{.URL}}">YES!</a></td>
+		<td id="seen-{{.Tag}}">first seen {{.FirstSeen.Format "2006-01-02 15:04 MST"}}</td>
+		{{else}}
+		<td id="answer-{{.Tag}}">No. :-(</td>
+		<td id="seen-{{.Tag}}" data-prefix="first seen "></td>
+		{{end}}
+	</tr>
+	{{end}}
+	</table>
+</center>` + eventsScript + `</body></html>
+`))
+
+// eventsScript updates the pages in place as versions are tagged, using the
+// server-sent events from /events. The pages mark each version's answer and
+// first-seen time with the IDs answer-<tag> and seen-<tag>, and the answers
+// of versions already tagged with a data-tagged attribute.
+const eventsScript = `
+<script>
+new EventSource("/events").addEventListener("status", function(e) {
+	JSON.parse(e.data).versions.forEach(function(v) {
+		var answer = document.getElementById("answer-" + v.tag);
+		var seen = document.getElementById("seen-" + v.tag);
+		if (!v.tagged || !answer || answer.dataset.tagged) {
+			return;
+		}
+		answer.dataset.tagged = "yes";
+		var a = document.createElement("a");
+		a.href = v.url;
+		a.textContent = "YES!";
+		answer.replaceChildren(a);
+		if (seen) {
+			seen.textContent = seen.dataset.prefix + new Date(v.firstSeen).toLocaleString();
+		}
+	});
+});
+</script>
+`
@@ -5,8 +5,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -20,21 +25,59 @@ func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(int(*h))
 }
 
-func TestIsTagged(t *testing.T) {
-	// Set up a fake "Google Code" web server reporting 404 not found.
-	status := statusHandler(http.StatusNotFound)
-	s := httptest.NewServer(&status)
-	defer s.Close()
+// fakeClock is a Clock whose waits only end when the test wakes them, unless
+// it's instant.
+type fakeClock struct {
+	now     time.Time
+	instant bool          // end waits at once
+	waits   chan fakeWait // receives each wait as it starts
+}
 
-	if isTagged(s.URL) {
-		t.Fatal("isTagged == true, want false")
+type fakeWait struct {
+	d    time.Duration
+	wake chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:   time.Date(2024, 2, 6, 12, 0, 0, 0, time.UTC),
+		waits: make(chan fakeWait, 100),
 	}
+}
 
-	// Change fake server status to 200 OK and try again.
-	status = http.StatusOK
+func (c *fakeClock) Now() time.Time { return c.now }
 
-	if !isTagged(s.URL) {
-		t.Fatal("isTagged == false, want true")
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	w := fakeWait{d: d, wake: make(chan time.Time, 1)}
+	if c.instant {
+		w.wake <- c.now
+	}
+	c.waits <- w
+	return w.wake
+}
+
+// waitForTag waits until s has seen the tag.
+func waitForTag(t *testing.T, s *Server, tag string) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		s.mu.RLock()
+		changed := s.changed
+		yes := false
+		for _, vs := range s.versions {
+			if vs.Tag == tag {
+				yes = vs.yes
+			}
+		}
+		s.mu.RUnlock()
+		if yes {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("%s wasn't tagged", tag)
+		}
 	}
 }
 
@@ -43,45 +86,154 @@ func TestIntegration(t *testing.T) {
 	ts := httptest.NewServer(&status)
 	defer ts.Close()
 
-	// Replace the pollSleep with a closure that we can block and unblock.
-	sleep := make(chan bool)
-	pollSleep = func(time.Duration) {
-		sleep <- true
-		sleep <- true
-	}
-
-	// Replace pollDone with a closure that will tell us when the poller is
-	// exiting.
-	done := make(chan bool)
-	pollDone = func() { done <- true }
-
-	// Put things as they were when the test finishes.
-	defer func() {
-		pollSleep = time.Sleep
-		pollDone = func() {}
-	}()
-
-	s := NewServer("1.x", ts.URL, 1*time.Millisecond)
+	// Replace the clock with one whose waits we can end.
+	clock := newFakeClock()
+	checker := headChecker{base: ts.URL + "/", client: ts.Client()}
+	s := NewServer(context.Background(), []Version{{Name: "1.x", Tag: "go1.x"}}, WithChecker(checker), WithClock(clock))
+	defer s.Close()
 
-	<-sleep // Wait for poll loop to start sleeping.
+	w := <-clock.waits // Wait for poll loop to start waiting.
 
 	// Make first request to the server.
 	r, _ := http.NewRequest("GET", "/", nil)
-	w := httptest.NewRecorder()
-	s.ServeHTTP(w, r)
-	if b := w.Body.String(); !strings.Contains(b, "No.") {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if b := rec.Body.String(); !strings.Contains(b, "No.") {
 		t.Fatalf("body = %s, want no", b)
 	}
 
 	status = http.StatusOK
 
-	<-sleep // Permit poll loop to stop sleeping.
-	<-done  // Wait for poller to see the "OK" status and exit.
+	w.wake <- clock.now       // Permit poll loop to stop waiting.
+	waitForTag(t, s, "go1.x") // Wait for poller to see the "OK" status.
 
 	// Make second request to the server.
-	w = httptest.NewRecorder()
-	s.ServeHTTP(w, r)
-	if b := w.Body.String(); !strings.Contains(b, "YES!") {
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if b := rec.Body.String(); !strings.Contains(b, ">YES!<") {
 		t.Fatalf("body = %q, want yes", b)
 	}
 }
+
+func TestMultipleVersions(t *testing.T) {
+	tags := filepath.Join(t.TempDir(), "tags")
+	if err := os.WriteFile(tags, []byte("go1.1\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	versions := []Version{{Name: "1.1", Tag: "go1.1"}, {Name: "1.2", Tag: "go1.2"}}
+	s := NewServer(context.Background(), versions, WithChecker(fileChecker{name: tags}), WithClock(clock))
+	defer s.Close()
+
+	waitForTag(t, s, "go1.1") // 1.1 is tagged at the first poll.
+	w := <-clock.waits        // 1.2 isn't, and its poller is waiting.
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+	if _, b := get("/"); !strings.Contains(b, `href="/go1.1"`) || !strings.Contains(b, `href="/go1.2"`) || strings.Count(b, ">YES!<") != 1 {
+		t.Errorf("list body = %s, want 1.1 tagged and 1.2 not", b)
+	}
+	if _, b := get("/go1.1"); !strings.Contains(b, ">YES!<") || !strings.Contains(b, "First seen tagged") {
+		t.Errorf("/go1.1 body = %s, want yes", b)
+	}
+	if _, b := get("/go1.2"); !strings.Contains(b, "No.") {
+		t.Errorf("/go1.2 body = %s, want no", b)
+	}
+	if code, _ := get("/go1.3"); code != http.StatusNotFound {
+		t.Errorf("/go1.3 status = %d, want 404", code)
+	}
+
+	if err := os.WriteFile(tags, []byte("go1.1\ngo1.2\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	w.wake <- clock.now
+	waitForTag(t, s, "go1.2")
+	if _, b := get("/"); strings.Count(b, ">YES!<") != 2 {
+		t.Errorf("list body = %s, want both tagged", b)
+	}
+}
+
+func TestClose(t *testing.T) {
+	// The tag source hangs until the request is canceled.
+	polled := make(chan bool, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polled <- true
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	checker := headChecker{base: ts.URL + "/", client: ts.Client()}
+	s := NewServer(context.Background(), []Version{{Name: "1.x", Tag: "go1.x"}}, WithChecker(checker))
+	<-polled
+	closed := make(chan bool)
+	go func() {
+		s.Close()
+		closed <- true
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close didn't stop the poller")
+	}
+
+	// Canceling the context stops a waiting poller too.
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	s = NewServer(ctx, []Version{{Name: "1.x", Tag: "go1.x"}}, WithChecker(fileChecker{name: "no-such-file"}), WithClock(clock))
+	<-clock.waits
+	cancel()
+	s.wg.Wait()
+	s.Close()
+}
+
+func TestParseVersions(t *testing.T) {
+	got, err := parseVersions([]string{"1.23", " go1.24", ""}, "go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Version{{Name: "1.23", Tag: "go1.23"}, {Name: "1.24", Tag: "go1.24"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseVersions = %v, want %v", got, want)
+	}
+	for _, bad := range [][]string{{}, {"1.23", "go1.23"}, {"1.24/x"}} {
+		if _, err := parseVersions(bad, "go"); err == nil {
+			t.Errorf("parseVersions(%q) succeeded", bad)
+		}
+	}
+
+	name := filepath.Join(t.TempDir(), "versions")
+	if err := os.WriteFile(name, []byte("# Releases\n1.23\n\ngo1.24\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	names, err := readVersionFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"1.23", "go1.24"}) {
+		t.Errorf("readVersionFile = %q", names)
+	}
+}
+
+func TestStatusChanges(t *testing.T) {
+	// Two failures with different errors, a poll that finds no tag and one
+	// that finds it.
+	c := &scriptedChecker{errs: []error{errors.New("timeout"), errors.New("connection reset"), nil}}
+	clock := newFakeClock()
+	clock.instant = true
+	s := NewServer(context.Background(), []Version{{Name: "1.x", Tag: "go1.x"}}, WithChecker(c), WithClock(clock))
+	defer s.Close()
+	waitForTag(t, s, "go1.x")
+
+	// The second error doesn't change the status.
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.seq != 3 {
+		t.Errorf("status changed %d times, want 3", s.seq)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// pollLatencyBuckets are the upper bounds, in seconds, of the buckets of the
+// poll latency histograms.
+var pollLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// A histogram counts observations in buckets, like a Prometheus histogram.
+// It isn't safe for concurrent use.
+type histogram struct {
+	bounds []float64 // upper bounds of the buckets, ascending
+	counts []int64   // counts[i] counts observations in (bounds[i-1], bounds[i]]
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// serveMetrics serves the expvar counters and the versions' status in the
+// Prometheus text format.
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	metric("outyet_hits_total", "counter", "Requests for the user interface.")
+	fmt.Fprintf(&buf, "outyet_hits_total %d\n", hitCount.Value())
+	metric("outyet_polls_total", "counter", "Polls for tags.")
+	fmt.Fprintf(&buf, "outyet_polls_total %d\n", pollCount.Value())
+	metric("outyet_poll_not_tagged_total", "counter", "Polls that found no tag.")
+	fmt.Fprintf(&buf, "outyet_poll_not_tagged_total %d\n", pollNotTaggedCount.Value())
+	metric("outyet_poll_errors_total", "counter", "Failed polls, by kind of error.")
+	pollErrors.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(&buf, "outyet_poll_errors_total{class=%s} %s\n", label(kv.Key), kv.Value)
+	})
+	metric("outyet_notifications_total", "counter", "Notifications, by kind of notifier and result.")
+	for _, c := range []struct {
+		result string
+		counts *expvar.Map
+	}{
+		{"success", notifySuccessCount},
+		{"failure", notifyFailureCount},
+	} {
+		c.counts.Do(func(kv expvar.KeyValue) {
+			fmt.Fprintf(&buf, "outyet_notifications_total{kind=%s,result=%q} %s\n", label(kv.Key), c.result, kv.Value)
+		})
+	}
+
+	s.mu.RLock()
+	metric("outyet_tagged", "gauge", "Whether the version has been tagged.")
+	for _, vs := range s.versions {
+		tagged := 0
+		if vs.yes {
+			tagged = 1
+		}
+		fmt.Fprintf(&buf, "outyet_tagged{version=%s} %d\n", label(vs.Name), tagged)
+	}
+	metric("outyet_last_success_timestamp_seconds", "gauge", "When a poll for the version last succeeded, in seconds since the Unix epoch.")
+	for _, vs := range s.versions {
+		if !vs.lastSuccess.IsZero() {
+			fmt.Fprintf(&buf, "outyet_last_success_timestamp_seconds{version=%s} %s\n", label(vs.Name), float(float64(vs.lastSuccess.UnixNano())/1e9))
+		}
+	}
+	metric("outyet_poll_duration_seconds", "histogram", "How long polls for the version took.")
+	for _, vs := range s.versions {
+		h, v := vs.pollLatency, label(vs.Name)
+		var n int64
+		for i, b := range h.bounds {
+			n += h.counts[i]
+			fmt.Fprintf(&buf, "outyet_poll_duration_seconds_bucket{version=%s,le=%q} %d\n", v, float(b), n)
+		}
+		fmt.Fprintf(&buf, "outyet_poll_duration_seconds_bucket{version=%s,le=\"+Inf\"} %d\n", v, h.count)
+		fmt.Fprintf(&buf, "outyet_poll_duration_seconds_sum{version=%s} %s\n", v, float(h.sum))
+		fmt.Fprintf(&buf, "outyet_poll_duration_seconds_count{version=%s} %d\n", v, h.count)
+	}
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Print(err)
+	}
+}
+
+// labelEscaper escapes a Prometheus label value.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label returns s as a quoted Prometheus label value.
+func label(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
+
+// float formats a sample value or bucket bound.
+func float(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
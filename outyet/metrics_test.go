@@ -0,0 +1,71 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.observe(v)
+	}
+	if h.counts[0] != 2 || h.counts[1] != 1 || h.count != 4 || h.sum != 3.65 {
+		t.Errorf("histogram = %+v", h)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	tags := filepath.Join(t.TempDir(), "tags")
+	if err := os.WriteFile(tags, []byte("go1.1\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	versions := []Version{{Name: "1.1", Tag: "go1.1"}, {Name: "1.2", Tag: "go1.2"}}
+	s := NewServer(context.Background(), versions, WithChecker(fileChecker{name: tags}), WithClock(clock))
+	defer s.Close()
+	waitForTag(t, s, "go1.1")
+	<-clock.waits // 1.2 has been polled too.
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := w.Body.String()
+
+	sample := regexp.MustCompile(`^[a-z_]+(\{([a-z]+="[^"]*",?)+\})? [0-9.e+-]+$`)
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if !strings.HasPrefix(line, "# HELP ") && !strings.HasPrefix(line, "# TYPE ") && !sample.MatchString(line) {
+			t.Errorf("bad line %q", line)
+		}
+	}
+	for _, want := range []string{
+		"# TYPE outyet_polls_total counter\noutyet_polls_total ",
+		`outyet_tagged{version="1.1"} 1`,
+		`outyet_tagged{version="1.2"} 0`,
+		`outyet_last_success_timestamp_seconds{version="1.2"} 1.7072208e+09`,
+		`outyet_poll_duration_seconds_bucket{version="1.1",le="0.05"} 1`,
+		`outyet_poll_duration_seconds_bucket{version="1.2",le="+Inf"} 1`,
+		`outyet_poll_duration_seconds_count{version="1.2"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestLabel(t *testing.T) {
+	if got, want := label("a\"b\\c\nd"), `"a\"b\\c\nd"`; got != want {
+		t.Errorf("label = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// An Event describes a version that has just been tagged.
+type Event struct {
+	Version string    `json:"version"`
+	Tag     string    `json:"tag"`
+	URL     string    `json:"url,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// A Notifier tells someone that a version has been tagged.
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+
+	// Kind names the kind of notifier, such as "webhook", in logs and in
+	// the delivery statistics.
+	Kind() string
+}
+
+// Delivery statistics, by notifier kind.
+var (
+	notifySuccessCount = expvar.NewMap("notifySuccessCount")
+	notifyFailureCount = expvar.NewMap("notifyFailureCount")
+	notifyError        = expvar.NewString("notifyError")
+)
+
+// A notification is tried this many times, waiting notifyRetryDelay after
+// the first failure and doubling the wait after each one after that.
+const (
+	notifyAttempts   = 3
+	notifyRetryDelay = 2 * time.Second
+)
+
+// notify delivers e with each of the notifiers, retrying failures after
+// waiting on clock. It gives up when ctx is canceled, without counting the
+// notifications it didn't get to deliver as failures.
+func notify(ctx context.Context, clock Clock, notifiers []Notifier, e Event) {
+	for _, n := range notifiers {
+		var err error
+		delay := notifyRetryDelay
+		for i := 0; i < notifyAttempts; i++ {
+			if i > 0 {
+				select {
+				case <-clock.After(delay):
+				case <-ctx.Done():
+				}
+				delay *= 2
+			}
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			if err = n.Notify(ctx, e); err == nil {
+				break
+			}
+			log.Printf("%s notification for %s, attempt %d: %v", n.Kind(), e.Tag, i+1, err)
+		}
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			notifyError.Set(err.Error())
+			notifyFailureCount.Add(n.Kind(), 1)
+		} else {
+			notifySuccessCount.Add(n.Kind(), 1)
+		}
+	}
+}
+
+// webhookNotifier POSTs the event as JSON to a URL.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n webhookNotifier) Kind() string { return "webhook" }
+
+func (n webhookNotifier) Notify(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	r, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	if r.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", n.url, r.Status)
+	}
+	return nil
+}
+
+// emailNotifier sends an email through an SMTP server.
+type emailNotifier struct {
+	addr string // host:port of the SMTP server
+	auth smtp.Auth
+	from string
+	to   []string
+
+	// send sends the message; it's smtp.SendMail except in tests.
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// newEmailNotifier returns an emailNotifier sending from and to the given
+// addresses through the SMTP server at addr, authenticating with PLAIN if
+// user isn't empty.
+func newEmailNotifier(addr, user, password, from string, to []string) (*emailNotifier, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("bad SMTP server address: %v", err)
+	}
+	if from == "" || len(to) == 0 {
+		return nil, errors.New("email notifications need sender and recipient addresses")
+	}
+	n := &emailNotifier{addr: addr, from: from, to: to, send: smtp.SendMail}
+	if user != "" {
+		n.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return n, nil
+}
+
+func (n *emailNotifier) Kind() string { return "email" }
+
+// Notify sends the email. The SMTP client can't be canceled, so it ignores
+// ctx.
+func (n *emailNotifier) Notify(ctx context.Context, e Event) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s is out!\r\n", e.Tag)
+	fmt.Fprintf(&msg, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Version %s was tagged as %s at %s.\r\n", e.Version, e.Tag, e.Time.Format(time.RFC1123))
+	if e.URL != "" {
+		fmt.Fprintf(&msg, "\r\n%s\r\n", e.URL)
+	}
+	return n.send(n.addr, n.auth, n.from, n.to, msg.Bytes())
+}
+
+// commandNotifier runs a local command, passing it the event as JSON on its
+// standard input and as the environment variables OUTYET_VERSION,
+// OUTYET_TAG, OUTYET_URL and OUTYET_TIME.
+type commandNotifier struct {
+	args []string
+}
+
+func (n commandNotifier) Kind() string { return "command" }
+
+func (n commandNotifier) Notify(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, n.args[0], n.args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"OUTYET_VERSION="+e.Version,
+		"OUTYET_TAG="+e.Tag,
+		"OUTYET_URL="+e.URL,
+		"OUTYET_TIME="+e.Time.Format(time.RFC3339),
+	)
+	cmd.Stdin = bytes.NewReader(body)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v\n%s", n.args[0], err, out)
+	}
+	return nil
+}
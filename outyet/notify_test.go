@@ -0,0 +1,205 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// count returns the value of the key in an expvar.Map of counters.
+func count(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestNotifyRetries(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		failures = 2
+		events   []Event
+	)
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		var e Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("bad webhook request: %v", err)
+		}
+		events = append(events, e)
+	}))
+	defer flaky.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	successes, failed := count(notifySuccessCount, "webhook"), count(notifyFailureCount, "webhook")
+	e := Event{Version: "1.x", Tag: "go1.x", URL: "https://example.com/go1.x", Time: time.Date(2024, 2, 6, 12, 0, 0, 0, time.UTC)}
+	clock := newFakeClock()
+	clock.instant = true
+	notify(context.Background(), clock, []Notifier{
+		webhookNotifier{url: flaky.URL, client: flaky.Client()},
+		webhookNotifier{url: broken.URL, client: broken.Client()},
+	}, e)
+	close(clock.waits)
+	var delays []time.Duration
+	for w := range clock.waits {
+		delays = append(delays, w.d)
+	}
+
+	if len(events) != 1 || events[0] != e {
+		t.Errorf("webhook got %v, want %v", events, e)
+	}
+	want := []time.Duration{notifyRetryDelay, 2 * notifyRetryDelay, notifyRetryDelay, 2 * notifyRetryDelay}
+	if !reflect.DeepEqual(delays, want) {
+		t.Errorf("retry delays = %v, want %v", delays, want)
+	}
+	if got := count(notifySuccessCount, "webhook") - successes; got != 1 {
+		t.Errorf("%d webhook successes counted, want 1", got)
+	}
+	if got := count(notifyFailureCount, "webhook") - failed; got != 1 {
+		t.Errorf("%d webhook failures counted, want 1", got)
+	}
+	if !strings.Contains(notifyError.Value(), "500") {
+		t.Errorf("notifyError = %q, want the 500 error", notifyError.Value())
+	}
+}
+
+func TestNotifyCanceled(t *testing.T) {
+	// The first notifier fails until the server is closed, and the second
+	// is never tried.
+	failed := count(notifyFailureCount, "recording")
+	first := &recordingNotifier{err: errors.New("unavailable")}
+	second := &recordingNotifier{}
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := newFakeClock()
+	done := make(chan bool)
+	go func() {
+		notify(ctx, clock, []Notifier{first, second}, Event{Version: "1.x", Tag: "go1.x"})
+		close(done)
+	}()
+	<-clock.waits // The first attempt failed.
+	cancel()
+	<-done
+
+	if len(first.events) != 1 || len(second.events) != 0 {
+		t.Errorf("notified %d and %d times, want 1 and 0", len(first.events), len(second.events))
+	}
+	if got := count(notifyFailureCount, "recording") - failed; got != 0 {
+		t.Errorf("%d failures counted for canceled notifications, want 0", got)
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	n, err := newEmailNotifier("smtp.example.com:587", "outyet", "sekrit", "outyet@example.com", []string{"a@example.com", "b@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotAddr string
+	var gotTo []string
+	var gotMsg string
+	n.send = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		gotAddr, gotTo, gotMsg = addr, to, string(msg)
+		return nil
+	}
+	e := Event{Version: "1.x", Tag: "go1.x", URL: "https://example.com/go1.x", Time: time.Now()}
+	if err := n.Notify(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if gotAddr != "smtp.example.com:587" || len(gotTo) != 2 || n.auth == nil {
+		t.Errorf("sent to %s %v with auth %v", gotAddr, gotTo, n.auth)
+	}
+	for _, want := range []string{"To: a@example.com, b@example.com\r\n", "Subject: go1.x is out!\r\n", "\r\n\r\nVersion 1.x was tagged", e.URL} {
+		if !strings.Contains(gotMsg, want) {
+			t.Errorf("message doesn't contain %q:\n%s", want, gotMsg)
+		}
+	}
+
+	if _, err := newEmailNotifier("smtp.example.com:25", "", "", "outyet@example.com", nil); err == nil {
+		t.Errorf("newEmailNotifier succeeded without recipients")
+	}
+}
+
+func TestCommandNotifier(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$1 $OUTYET_TAG\" > \"$2\"\ncat >> \"$2\"\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	e := Event{Version: "1.x", Tag: "go1.x", Time: time.Now()}
+	if err := (commandNotifier{args: []string{script, "tagged", out}}).Notify(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); !strings.HasPrefix(got, "tagged go1.x\n{") || !strings.Contains(got, `"version":"1.x"`) {
+		t.Errorf("hook wrote %q", got)
+	}
+
+	if err := (commandNotifier{args: []string{"false"}}).Notify(context.Background(), e); err == nil {
+		t.Errorf("failing command succeeded")
+	}
+}
+
+// recordingNotifier records the events it's told about, and sends them on
+// notified if it isn't nil. It fails with err, if that's set.
+type recordingNotifier struct {
+	mu       sync.Mutex
+	events   []Event
+	notified chan Event
+	err      error
+}
+
+func (n *recordingNotifier) Kind() string { return "recording" }
+
+func (n *recordingNotifier) Notify(ctx context.Context, e Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, e)
+	if n.notified != nil {
+		n.notified <- e
+	}
+	return n.err
+}
+
+func TestNotifyOnTag(t *testing.T) {
+	tags := filepath.Join(t.TempDir(), "tags")
+	if err := os.WriteFile(tags, []byte("go1.x\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	n := &recordingNotifier{notified: make(chan Event, 1)}
+	s := NewServer(context.Background(), []Version{{Name: "1.x", Tag: "go1.x"}}, WithChecker(fileChecker{name: tags}), WithNotifiers(n))
+	<-n.notified
+	s.Close()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.events) != 1 || n.events[0].Tag != "go1.x" || n.events[0].Time.IsZero() {
+		t.Errorf("notified of %v, want one event for go1.x", n.events)
+	}
+}
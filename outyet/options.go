@@ -0,0 +1,68 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// An Option configures a Server.
+type Option func(*Server)
+
+// WithChecker sets how the Server checks for tags.
+// The default is an HTTP HEAD request to go.googlesource.com.
+func WithChecker(c TagChecker) Option {
+	return func(s *Server) { s.checker = c }
+}
+
+// WithHTTPClient sets the HTTP client used by the default TagChecker.
+// The default is http.DefaultClient.
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *Server) { s.client = c }
+}
+
+// WithClock sets the Server's clock. The default is the system clock.
+func WithClock(c Clock) Option {
+	return func(s *Server) { s.clock = c }
+}
+
+// WithPollPeriod sets how often the Server polls for tags, and how long it
+// may back off to after errors. The defaults are 5 seconds and 5 minutes.
+func WithPollPeriod(period, maxPeriod time.Duration) Option {
+	return func(s *Server) { s.period, s.maxPeriod = period, maxPeriod }
+}
+
+// WithNotifiers adds notifiers for the Server to tell when a version is
+// tagged.
+func WithNotifiers(n ...Notifier) Option {
+	return func(s *Server) { s.notifiers = append(s.notifiers, n...) }
+}
+
+// WithState makes the Server start from the status saved in st, and save
+// the status there when it changes. Versions already tagged aren't polled
+// again.
+func WithState(st *stateStore) Option {
+	return func(s *Server) { s.state = st }
+}
+
+// WithHeartbeat sets how often the Server sends a comment to /events
+// clients while the status doesn't change, to keep proxies from closing the
+// idle connections. The default is 15 seconds.
+func WithHeartbeat(d time.Duration) Option {
+	return func(s *Server) { s.heartbeat = d }
+}
+
+// A Clock tells the time and waits.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,110 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A stateStore keeps the status of a Server's versions in a JSON file, so
+// that it survives restarts.
+type stateStore struct {
+	path string
+
+	mu    sync.Mutex // serializes saves, and protects state
+	state savedState
+}
+
+// savedState is the contents of a state file.
+type savedState struct {
+	// Versions maps tags to the status of their versions. It keeps the
+	// versions the server no longer watches, as history.
+	Versions map[string]savedVersion `json:"versions"`
+}
+
+// savedVersion is the saved status of a version.
+type savedVersion struct {
+	Version     string    `json:"version"`
+	Tagged      bool      `json:"tagged"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastChecked time.Time `json:"lastChecked"`
+	LastSuccess time.Time `json:"lastSuccess"` // of the last poll that didn't fail
+
+	// NotifyPending is set while the version is tagged but its
+	// notifications haven't all been sent, so that a restarted server
+	// sends them.
+	NotifyPending bool `json:"notifyPending,omitempty"`
+}
+
+// openStateStore returns a stateStore for the named file, loading the state
+// saved in it. The file needn't exist yet.
+func openStateStore(path string) (*stateStore, error) {
+	st := &stateStore{path: path, state: savedState{Versions: make(map[string]savedVersion)}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &st.state); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if st.state.Versions == nil {
+		st.state.Versions = make(map[string]savedVersion)
+	}
+	return st, nil
+}
+
+// restore sets the status of vs to its saved status, if any.
+func (st *stateStore) restore(vs *versionStatus) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if v, ok := st.state.Versions[vs.Tag]; ok {
+		vs.yes = v.Tagged
+		vs.firstSeen = v.FirstSeen
+		vs.lastPoll = v.LastChecked
+		vs.lastSuccess = v.LastSuccess
+		vs.notifyPending = v.NotifyPending
+	}
+}
+
+// save records the status of the version with the given tag and writes the
+// state file. The file is replaced atomically, so a crash leaves either the
+// old or the new state.
+func (st *stateStore) save(tag string, v savedVersion) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.state.Versions[tag] = v
+	data, err := json.MarshalIndent(&st.state, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(st.path), filepath.Base(st.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), st.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,204 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	st, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := time.Date(2024, 2, 6, 12, 0, 0, 0, time.UTC)
+	if err := st.save("go1.1", savedVersion{Version: "1.1", Tagged: true, FirstSeen: seen, LastChecked: seen, LastSuccess: seen}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.save("go1.2", savedVersion{Version: "1.2", LastChecked: seen}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the state file is left behind.
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 1 {
+		t.Errorf("files after saving: %q", names)
+	}
+
+	st, err = openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs := &versionStatus{Version: Version{Name: "1.1", Tag: "go1.1"}}
+	st.restore(vs)
+	if !vs.yes || !vs.firstSeen.Equal(seen) || !vs.lastPoll.Equal(seen) || !vs.lastSuccess.Equal(seen) {
+		t.Errorf("restored %+v", vs)
+	}
+
+	// Versions that aren't being watched any more are kept.
+	if err := st.save("go1.3", savedVersion{Version: "1.3"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{`"go1.1"`, `"go1.2"`, `"go1.3"`} {
+		if !strings.Contains(string(data), tag) {
+			t.Errorf("state file doesn't mention %s:\n%s", tag, data)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(`{"versions": [`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openStateStore(path); err == nil {
+		t.Errorf("openStateStore succeeded on a corrupt file")
+	}
+}
+
+// failingChecker fails the test if it's used.
+type failingChecker struct {
+	t *testing.T
+}
+
+func (c failingChecker) IsTagged(ctx context.Context, tag string) (bool, error) {
+	c.t.Errorf("IsTagged(%q) called", tag)
+	return false, nil
+}
+
+func (c failingChecker) URL(tag string) string { return "" }
+
+func TestServerState(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	tags := filepath.Join(dir, "tags")
+	if err := os.WriteFile(tags, []byte("go1.x\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	st, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &recordingNotifier{notified: make(chan Event, 1)}
+	versions := []Version{{Name: "1.x", Tag: "go1.x"}}
+	s := NewServer(context.Background(), versions, WithChecker(fileChecker{name: tags}), WithState(st), WithNotifiers(n))
+	<-n.notified
+	s.Close()
+
+	// After a restart, the version is still tagged, without polling or
+	// notifying again.
+	st, err = openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = NewServer(context.Background(), versions, WithChecker(failingChecker{t}), WithState(st), WithNotifiers(n))
+	defer s.Close()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/go1.x", nil))
+	if b := w.Body.String(); !strings.Contains(b, ">YES!<") {
+		t.Errorf("body after restart = %s, want yes", b)
+	}
+	s.mu.RLock()
+	firstSeen := s.versions[0].firstSeen
+	s.mu.RUnlock()
+	if firstSeen.IsZero() {
+		t.Errorf("first-seen time was lost")
+	}
+	if len(n.events) != 1 {
+		t.Errorf("notified %d times, want once", len(n.events))
+	}
+}
+
+func TestServerStatePendingNotification(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	tags := filepath.Join(dir, "tags")
+	if err := os.WriteFile(tags, []byte("go1.x\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	st, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := &recordingNotifier{notified: make(chan Event, 1), err: errors.New("unavailable")}
+	clock := newFakeClock()
+	versions := []Version{{Name: "1.x", Tag: "go1.x"}}
+	s := NewServer(context.Background(), versions, WithChecker(fileChecker{name: tags}), WithState(st), WithNotifiers(failing), WithClock(clock))
+	<-failing.notified
+	<-clock.waits // Wait for the retry to start waiting.
+	s.Close()
+
+	// The server stopped before the notification was sent, so a restart
+	// sends it.
+	st, err = openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &recordingNotifier{notified: make(chan Event, 1)}
+	s = NewServer(context.Background(), versions, WithChecker(failingChecker{t}), WithState(st), WithNotifiers(n))
+	select {
+	case e := <-n.notified:
+		if e.Tag != "go1.x" || e.Time.IsZero() {
+			t.Errorf("notified of %+v after restart", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("pending notification wasn't sent after restart")
+	}
+	s.Close()
+
+	st, err = openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := st.state.Versions["go1.x"]; !v.Tagged || v.NotifyPending {
+		t.Errorf("saved %+v after notifying, want tagged and not pending", v)
+	}
+}
+
+func TestServerStateSavedOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	st, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := statusHandler(http.StatusNotFound)
+	ts := httptest.NewServer(&status)
+	defer ts.Close()
+	clock := newFakeClock()
+	checker := headChecker{base: ts.URL + "/", client: ts.Client()}
+	s := NewServer(context.Background(), []Version{{Name: "1.x", Tag: "go1.x"}}, WithChecker(checker), WithState(st), WithClock(clock))
+
+	// Polls that find no tag, as before, don't change the status.
+	for i := 0; i < 3; i++ {
+		w := <-clock.waits
+		clock.now = clock.now.Add(w.d)
+		w.wake <- clock.now
+	}
+	<-clock.waits
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file was written without a change in status: %v", err)
+	}
+
+	// Closing the server saves the time of its last poll.
+	s.Close()
+	st, err = openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := st.state.Versions["go1.x"]
+	if !v.LastChecked.Equal(clock.now) || !v.LastSuccess.Equal(clock.now) {
+		t.Errorf("saved %+v after polling at %v", v, clock.now)
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// The audit log: a record of every question answered, the documents used
+// and the answer given.
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// auditRecord is an entry in the audit log recording an answer.
+type auditRecord struct {
+	Type      string    `json:"type"` // "answer"
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Endpoint  string    `json:"endpoint"`
+	Question  string    `json:"question"`
+	Rewrites  []string  `json:"rewrites,omitempty"`
+	DocIDs    []string  `json:"docIds"`
+	Answer    string    `json:"answer"`
+	Model     string    `json:"model,omitempty"`
+	Cached    bool      `json:"cached,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMS int64     `json:"latencyMs"`
+}
+
+// auditSink receives audit records and the feedback given on answers.
+// Implementations must be safe for concurrent use.
+type auditSink interface {
+	writeRecord(rec *auditRecord) error
+	writeFeedback(fb *feedbackRecord) error
+}
+
+// jsonlSink writes audit records and feedback to w as JSON lines, one Write
+// call per line.
+type jsonlSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *jsonlSink) writeRecord(rec *auditRecord) error { return s.writeLine(rec) }
+
+func (s *jsonlSink) writeFeedback(fb *feedbackRecord) error { return s.writeLine(fb) }
+
+func (s *jsonlSink) writeLine(v any) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(js, '\n'))
+	return err
+}
+
+// auditor redacts audit records and hands them to a sink.
+type auditor struct {
+	sink         auditSink
+	redactions   []redaction
+	tenantHeader string
+
+	// file is the audit log file, or nil if the log isn't written to a
+	// file.
+	file *rotatingFile
+
+	// answers maps the request IDs of recently logged answers to their
+	// tenants, so that feedback on them can be checked without reading the
+	// log.
+	answers *lruCache[string, string]
+}
+
+// recentAnswers is the number of answers an auditor remembers.
+const recentAnswers = 10000
+
+// newAuditor returns an auditor configured by cfg, or nil if cfg doesn't
+// enable the audit log.
+func newAuditor(cfg *config) (*auditor, error) {
+	if cfg.AuditLog == "" {
+		return nil, nil
+	}
+
+	a := &auditor{
+		tenantHeader: cfg.TenantHeader,
+		answers:      newLRUCache[string, string](recentAnswers, 0),
+	}
+	var w io.Writer = os.Stdout
+	if cfg.AuditLog != "-" {
+		var err error
+		a.file, err = openRotatingFile(cfg.AuditLog, int64(cfg.AuditMaxSizeMB)<<20, cfg.AuditMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w = a.file
+	}
+	a.sink = &jsonlSink{w: w}
+
+	var err error
+	a.redactions, err = parseRedactions(cfg.AuditRedact, cfg.AuditRedactFile)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// pendingAudit is an audit record being filled in while a request is
+// handled.
+type pendingAudit struct {
+	auditRecord
+	start time.Time
+}
+
+// startAudit starts an audit record for a request to endpoint asking
+// question. The request ID is taken from the X-Request-ID header if there
+// is one, and echoed in the response.
+func (rs *ragServer) startAudit(w http.ResponseWriter, req *http.Request, endpoint, question string) *pendingAudit {
+	pa := &pendingAudit{start: time.Now()}
+	pa.Type = "answer"
+	pa.Time = pa.start
+	pa.RequestID = cmp.Or(req.Header.Get("X-Request-ID"), uuid.NewString())
+	pa.Endpoint = endpoint
+	pa.Question = question
+	if rs.auditor != nil {
+		pa.Tenant = req.Header.Get(rs.auditor.tenantHeader)
+	}
+	w.Header().Set("X-Request-ID", pa.RequestID)
+	return pa
+}
+
+// recordResult records the outcome of a /query/ request.
+func (pa *pendingAudit) recordResult(res *queryResult) {
+	pa.Rewrites = res.rewrites
+	pa.DocIDs = res.docIDs
+	pa.Answer = res.resp.Text
+	pa.Model = res.resp.Generator
+}
+
+// finishAudit completes the record and writes it to the audit log, if
+// there is one. Failing to write it is logged but doesn't fail the request.
+func (rs *ragServer) finishAudit(pa *pendingAudit) {
+	if rs.auditor == nil {
+		return
+	}
+	rec := pa.auditRecord
+	rec.LatencyMS = time.Since(pa.start).Milliseconds()
+	rec.Question = rs.auditor.redact(rec.Question)
+	rec.Answer = rs.auditor.redact(rec.Answer)
+	rec.Rewrites = slices.Clone(rec.Rewrites)
+	for i, r := range rec.Rewrites {
+		rec.Rewrites[i] = rs.auditor.redact(r)
+	}
+	if rec.DocIDs == nil {
+		rec.DocIDs = []string{}
+	}
+	if err := rs.auditor.sink.writeRecord(&rec); err != nil {
+		log.Printf("writing audit record %s: %v", rec.RequestID, err)
+		return
+	}
+	rs.auditor.answers.put(rec.RequestID, rec.Tenant)
+}
+
+// A redaction replaces matches of a pattern with [REDACTED:name].
+type redaction struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// builtinRedactions are the patterns AUDIT_REDACT can name, in the order
+// they're applied: more specific patterns go first so that, for example, a
+// card number isn't partly redacted as a phone number.
+var builtinRedactions = []redaction{
+	{"email", regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{"ssn", regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)},
+	{"card", regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)},
+	{"ipv4", regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)},
+	{"phone", regexp.MustCompile(`(?:\+|\b)\d[\d ().-]{6,}\d\b`)},
+}
+
+const defaultRedactions = "email,ssn,card,phone"
+
+// parseRedactions returns the built-in redactions named in the
+// comma-separated list names ("none" for none), followed by one for each
+// regular expression in the file at path, if path isn't empty.
+func parseRedactions(names, path string) ([]redaction, error) {
+	var rs []redaction
+	if names != "none" {
+		want := strings.Split(names, ",")
+		for i, n := range want {
+			want[i] = strings.TrimSpace(n)
+			if !slices.ContainsFunc(builtinRedactions, func(r redaction) bool { return r.name == want[i] }) {
+				return nil, fmt.Errorf("unknown redaction %q", want[i])
+			}
+		}
+		for _, r := range builtinRedactions {
+			if slices.Contains(want, r.name) {
+				rs = append(rs, r)
+			}
+		}
+	}
+
+	if path == "" {
+		return rs, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		pat := strings.TrimSpace(scanner.Text())
+		if pat == "" || strings.HasPrefix(pat, "#") {
+			continue
+		}
+		re, err := regexp.Compile(pat)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		rs = append(rs, redaction{"custom", re})
+	}
+	return rs, scanner.Err()
+}
+
+func (a *auditor) redact(s string) string {
+	for _, r := range a.redactions {
+		s = r.re.ReplaceAllLiteralString(s, "[REDACTED:"+r.name+"]")
+	}
+	return s
+}
+
+// rotatingFile is an append-only file that's rotated when it would grow
+// beyond maxSize: path is renamed to path.1, path.1 to path.2 and so on,
+// keeping at most maxBackups old files. A single Write is never split
+// across files.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// Write appends p to the file and syncs it, rotating first if needed. If
+// rotation fails, p is appended to the current file anyway, so no record is
+// lost while it keeps failing.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			log.Printf("rotating %s: %v", r.path, err)
+		}
+	}
+	if r.f == nil {
+		// A rotation failed to reopen the file; try again.
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err == nil {
+		err = r.f.Sync()
+	}
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	// The file is closed while it's renamed, which some systems require.
+	// Whatever happens, it's reopened: if the renames failed, the records
+	// keep going to the old file.
+	err := r.f.Close()
+	r.f = nil
+	if err == nil {
+		err = r.shiftBackups()
+	}
+	if oerr := r.open(); oerr != nil {
+		return errors.Join(err, oerr)
+	}
+	return err
+}
+
+// shiftBackups renames the file and its backups to make room for a new
+// file, dropping the oldest backup.
+func (r *rotatingFile) shiftBackups() error {
+	backup := func(i int) string { return r.path + "." + strconv.Itoa(i) }
+	if r.maxBackups == 0 {
+		return os.Remove(r.path)
+	}
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(backup(i), backup(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(r.path, backup(1))
+}
+
+// openAll opens the file and its backups for reading, oldest first. The
+// files are opened together so that a concurrent rotation can't make one be
+// read twice or not at all.
+func (r *rotatingFile) openAll() ([]*os.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var files []*os.File
+	for i := r.maxBackups; i >= 0; i-- {
+		name := r.path
+		if i > 0 {
+			name += "." + strconv.Itoa(i)
+		}
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
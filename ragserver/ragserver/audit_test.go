@@ -0,0 +1,172 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedact(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "patterns")
+	if err := os.WriteFile(file, []byte("# employee numbers\nEMP-\\d+\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := parseRedactions(defaultRedactions, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &auditor{redactions: rs}
+
+	tests := []struct{ in, want string }{
+		{"mail gopher@golang.org now", "mail [REDACTED:email] now"},
+		{"my ssn is 123-45-6789.", "my ssn is [REDACTED:ssn]."},
+		{"card 4111 1111 1111 1111 expired", "card [REDACTED:card] expired"},
+		{"call +1 (650) 253-0000 today", "call [REDACTED:phone] today"},
+		{"ask EMP-1234 about it", "ask [REDACTED:custom] about it"},
+		{"released in 2024, version 1.23", "released in 2024, version 1.23"},
+	}
+	for _, tt := range tests {
+		if got := a.redact(tt.in); got != tt.want {
+			t.Errorf("redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := parseRedactions("email,passport", ""); err == nil {
+		t.Error("unknown redaction accepted")
+	}
+	if rs, err := parseRedactions("none", ""); err != nil || len(rs) != 0 {
+		t.Errorf(`parseRedactions("none") = %v, %v`, rs, err)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	r, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each file holds what fits in 10 bytes, and the oldest is dropped.
+	want := map[string]string{
+		path:        "four\nfive\n",
+		path + ".1": "three\n",
+		path + ".2": "one\ntwo\n",
+	}
+	for name, content := range want {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), b, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than 2 backups kept")
+	}
+}
+
+func TestRotatingFileRenameFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	r, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// A non-empty directory in the way of the backup makes renaming fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatalf("writing %q: %v", line, err)
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "one\ntwo\nthree\nfour\n"; string(b) != want {
+		t.Errorf("audit.jsonl = %q, want %q", b, want)
+	}
+}
+
+// memorySink is an auditSink that keeps records in memory.
+type memorySink struct {
+	mu       sync.Mutex
+	records  []auditRecord
+	feedback []feedbackRecord
+}
+
+func (s *memorySink) writeRecord(rec *auditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, *rec)
+	return nil
+}
+
+func (s *memorySink) writeFeedback(fb *feedbackRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.feedback = append(s.feedback, *fb)
+	return nil
+}
+
+func TestQueryAudit(t *testing.T) {
+	rs := newFileTestServer(t, &fakeGenerator{chunks: []string{"Write to gopher@golang.org."}}, "aaaa", "bbbb")
+	rs.cache = newLRUCache[queryKey, *queryResult](10, time.Hour)
+	sink := &memorySink{}
+	redactions, _ := parseRedactions(defaultRedactions, "")
+	rs.auditor = &auditor{sink: sink, redactions: redactions, tenantHeader: "X-Tenant-ID", answers: newLRUCache[string, string](10, 0)}
+
+	query := func(requestID string) {
+		req := httptest.NewRequest("POST", "/query/", strings.NewReader(`{"content": "who owns aaaa? I'm rob@golang.org"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Tenant-ID", "acme")
+		req.Header.Set("X-Request-ID", requestID)
+		w := httptest.NewRecorder()
+		rs.queryHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-Request-ID"); got != requestID {
+			t.Errorf("X-Request-ID = %q, want %q", got, requestID)
+		}
+	}
+	query("req-1")
+	query("req-2")
+
+	if len(sink.records) != 2 {
+		t.Fatalf("%d audit records, want 2", len(sink.records))
+	}
+	for i, rec := range sink.records {
+		if rec.Tenant != "acme" || rec.Endpoint != "/query/" || rec.Model != "fake" {
+			t.Errorf("record %d = %+v", i, rec)
+		}
+		if rec.Question != "who owns aaaa? I'm [REDACTED:email]" || rec.Answer != "Write to [REDACTED:email]." {
+			t.Errorf("record %d not redacted: question %q, answer %q", i, rec.Question, rec.Answer)
+		}
+		if len(rec.DocIDs) != 2 || !slices.Contains(rec.DocIDs, contentID("aaaa")) {
+			t.Errorf("record %d doc IDs = %q", i, rec.DocIDs)
+		}
+	}
+	if first, second := sink.records[0], sink.records[1]; first.RequestID != "req-1" || first.Cached || !second.Cached {
+		t.Errorf("records = %+v", sink.records)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lruCache is a size-bounded cache whose entries expire after a TTL, unless
+// it's 0. When full, adding an entry evicts the least recently used one.
+// It's safe for concurrent use. A cache with size 0 stores nothing.
+type lruCache[K comparable, V any] struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[K]*list.Element // of *cacheEntry[K, V]
+	order   list.List           // most recently used first
+}
+
+type cacheEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+func newLRUCache[K comparable, V any](size int, ttl time.Duration) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[K]*list.Element),
+	}
+}
+
+// get returns the value stored for key, if it's present and hasn't expired.
+func (c *lruCache[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero V
+	el, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	e := el.Value.(*cacheEntry[K, V])
+	if c.ttl > 0 && c.now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+// put stores value for key.
+func (c *lruCache[K, V]) put(key K, value V) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry[K, V])
+		e.value, e.expires = value, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	for c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry[K, V]).key)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry[K, V]{key, value, expires})
+}
+
+// clear removes all entries.
+func (c *lruCache[K, V]) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+	c.order.Init()
+}
+
+// queryKey identifies a /query/ response in the cache. It holds everything
+// the response depends on: the question, any request options, and the
+// version of the corpus it was retrieved from.
+type queryKey struct {
+	question string
+	options  string
+	corpus   uint64
+}
+
+// normalizeQuestion returns q with case and whitespace differences removed,
+// so trivially different phrasings of a question share a cache entry.
+func normalizeQuestion(q string) string {
+	return strings.Join(strings.Fields(strings.ToLower(q)), " ")
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newLRUCache[string, int](2, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.put("a", 1)
+	c.put("b", 2)
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Errorf(`get("a") = %v, %v; want 1, true`, v, ok)
+	}
+
+	// "b" is now the least recently used entry and gets evicted.
+	c.put("c", 3)
+	if _, ok := c.get("b"); ok {
+		t.Error(`get("b") succeeded after eviction`)
+	}
+	if v, ok := c.get("c"); !ok || v != 3 {
+		t.Errorf(`get("c") = %v, %v; want 3, true`, v, ok)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.get("a"); ok {
+		t.Error(`get("a") succeeded after TTL`)
+	}
+
+	c.put("d", 4)
+	c.clear()
+	if _, ok := c.get("d"); ok {
+		t.Error(`get("d") succeeded after clear`)
+	}
+}
+
+func TestLRUCacheNoTTL(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newLRUCache[string, int](2, 0)
+	c.now = func() time.Time { return now }
+	c.put("a", 1)
+	now = now.Add(24 * time.Hour)
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Errorf(`get("a") = %v, %v with no TTL; want 1, true`, v, ok)
+	}
+}
+
+func TestLRUCacheDisabled(t *testing.T) {
+	c := newLRUCache[string, int](0, time.Minute)
+	c.put("a", 1)
+	if _, ok := c.get("a"); ok {
+		t.Error("cache with size 0 stored an entry")
+	}
+}
+
+func TestNormalizeQuestion(t *testing.T) {
+	got := normalizeQuestion("  What   is\tTDXIRV?\n")
+	if want := "what is tdxirv?"; got != want {
+		t.Errorf("normalizeQuestion = %q, want %q", got, want)
+	}
+}
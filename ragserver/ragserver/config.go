@@ -0,0 +1,307 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Configuration. Settings are read from a JSON file, if one is given with
+// -config, and from environment variables, which override the file.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// config holds ragserver's settings. Each field's json tag is its key in
+// the config file, and its env tag the environment variable overriding it.
+// Fields tagged secret aren't shown by -print-config.
+type config struct {
+	Address     string `json:"address" env:"ADDRESS"` // default "localhost:" + ServerPort
+	ServerPort  string `json:"serverPort" env:"SERVERPORT"`
+	TLSCertFile string `json:"tlsCertFile" env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `json:"tlsKeyFile" env:"TLS_KEY_FILE"`
+
+	GeminiAPIKey    string `json:"geminiApiKey" env:"GEMINI_API_KEY" secret:"true"`
+	OpenAIAPIKey    string `json:"openaiApiKey" env:"OPENAI_API_KEY" secret:"true"`
+	Generators      string `json:"generators" env:"GENERATORS"`
+	EmbeddingModel  string `json:"embeddingModel" env:"EMBEDDING_MODEL"`
+	MaxOutputTokens int    `json:"maxOutputTokens" env:"MAX_OUTPUT_TOKENS"`
+
+	VectorStore        string `json:"vectorStore" env:"VECTOR_STORE"`
+	WeaviateAddress    string `json:"weaviateAddress" env:"WEAVIATE_ADDRESS"` // default "localhost:" + WVPort
+	WVPort             string `json:"wvPort" env:"WVPORT"`
+	DataDir            string `json:"dataDir" env:"DATA_DIR"`
+	VectorIndex        string `json:"vectorIndex" env:"VECTOR_INDEX"`
+	HNSWM              int    `json:"hnswM" env:"HNSW_M"`
+	HNSWEfConstruction int    `json:"hnswEfConstruction" env:"HNSW_EF_CONSTRUCTION"`
+	HNSWEfSearch       int    `json:"hnswEfSearch" env:"HNSW_EF_SEARCH"`
+
+	IngestWorkers   int      `json:"ingestWorkers" env:"INGEST_WORKERS"`
+	JobRetention    duration `json:"jobRetention" env:"JOB_RETENTION"`
+	QueryCacheSize  int      `json:"queryCacheSize" env:"QUERY_CACHE_SIZE"`
+	QueryCacheTTL   duration `json:"queryCacheTTL" env:"QUERY_CACHE_TTL"`
+	DedupPolicy     string   `json:"dedupPolicy" env:"DEDUP_POLICY"`
+	DedupSimilarity float64  `json:"dedupSimilarity" env:"DEDUP_SIMILARITY"`
+
+	AuditLog        string `json:"auditLog" env:"AUDIT_LOG"`
+	AuditMaxSizeMB  int    `json:"auditMaxSizeMB" env:"AUDIT_MAX_SIZE_MB"`
+	AuditMaxBackups int    `json:"auditMaxBackups" env:"AUDIT_MAX_BACKUPS"`
+	AuditRedact     string `json:"auditRedact" env:"AUDIT_REDACT"`
+	AuditRedactFile string `json:"auditRedactFile" env:"AUDIT_REDACT_FILE"`
+	TenantHeader    string `json:"tenantHeader" env:"TENANT_HEADER"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		ServerPort:         "9020",
+		Generators:         defaultGenerators,
+		EmbeddingModel:     defaultEmbeddingModelName,
+		MaxOutputTokens:    2048,
+		VectorStore:        "weaviate",
+		WVPort:             "9035",
+		DataDir:            "ragserver-data",
+		VectorIndex:        "flat",
+		HNSWM:              defaultHNSWConfig.M,
+		HNSWEfConstruction: defaultHNSWConfig.EfConstruction,
+		HNSWEfSearch:       defaultHNSWConfig.EfSearch,
+		IngestWorkers:      4,
+		JobRetention:       duration(time.Hour),
+		QueryCacheSize:     1000,
+		QueryCacheTTL:      duration(10 * time.Minute),
+		DedupPolicy:        string(dedupSkip),
+		AuditMaxSizeMB:     100,
+		AuditMaxBackups:    10,
+		AuditRedact:        defaultRedactions,
+		TenantHeader:       "X-Tenant-ID",
+	}
+}
+
+// loadConfig returns the configuration from the defaults, the JSON file at
+// path (if path isn't empty) and the environment, in increasing order of
+// precedence. It doesn't validate it.
+func loadConfig(path string, getenv func(string) string) (*config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	var errs []error
+	v := reflect.ValueOf(cfg).Elem()
+	for i := range v.NumField() {
+		f := v.Type().Field(i)
+		s := getenv(f.Tag.Get("env"))
+		if s == "" {
+			continue
+		}
+		if err := setField(v.Field(i), s); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", describe(f.Tag.Get("json")), err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	if cfg.Address == "" {
+		cfg.Address = "localhost:" + cfg.ServerPort
+	}
+	if cfg.WeaviateAddress == "" {
+		cfg.WeaviateAddress = "localhost:" + cfg.WVPort
+	}
+	return cfg, nil
+}
+
+// setField parses s into the config field v.
+func setField(v reflect.Value, s string) error {
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(s)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q isn't an integer", s)
+		}
+		v.SetInt(int64(n))
+	case float64:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%q isn't a number", s)
+		}
+		v.SetFloat(x)
+	case duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%q isn't a duration", s)
+		}
+		v.SetInt(int64(d))
+	default:
+		panic("unexpected config field type " + v.Type().String())
+	}
+	return nil
+}
+
+// describe names the config field with the given key by the key and its
+// environment variable, for error messages.
+func describe(key string) string {
+	t := reflect.TypeFor[config]()
+	for i := range t.NumField() {
+		if f := t.Field(i); f.Tag.Get("json") == key {
+			return fmt.Sprintf("%s (%s)", key, f.Tag.Get("env"))
+		}
+	}
+	panic("no config field " + key)
+}
+
+// validate checks cfg, and returns an error describing every bad setting.
+func (cfg *config) validate() error {
+	var errs []error
+	bad := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", describe(key), fmt.Sprintf(format, args...)))
+	}
+	atLeast := func(key string, n, min int) {
+		if n < min {
+			bad(key, "must be at least %d, not %d", min, n)
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		bad("address", "%v", err)
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		bad("tlsCertFile", "TLS needs both a certificate and a key file")
+	}
+	for _, f := range []struct{ key, path string }{
+		{"tlsCertFile", cfg.TLSCertFile},
+		{"tlsKeyFile", cfg.TLSKeyFile},
+		{"auditRedactFile", cfg.AuditRedactFile},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			bad(f.key, "%v", err)
+		}
+	}
+
+	noGemini := func(string) generator { return nil }
+	noOpenAI := func(string, string) generator { return nil }
+	if _, err := parseGenerators(cfg.Generators, noGemini, noOpenAI); err != nil {
+		bad("generators", "%v", err)
+	}
+	if cfg.EmbeddingModel == "" {
+		bad("embeddingModel", "must be set")
+	}
+	atLeast("maxOutputTokens", cfg.MaxOutputTokens, 1)
+	if cfg.MaxOutputTokens > math.MaxInt32 {
+		bad("maxOutputTokens", "must be at most %d", math.MaxInt32)
+	}
+
+	if cfg.VectorStore != "weaviate" && cfg.VectorStore != "file" {
+		bad("vectorStore", "is %q; want weaviate or file", cfg.VectorStore)
+	}
+	if _, _, err := net.SplitHostPort(cfg.WeaviateAddress); err != nil {
+		bad("weaviateAddress", "%v", err)
+	}
+	if cfg.VectorIndex != "flat" && cfg.VectorIndex != "hnsw" {
+		bad("vectorIndex", "is %q; want flat or hnsw", cfg.VectorIndex)
+	}
+	atLeast("hnswM", cfg.HNSWM, 1)
+	atLeast("hnswEfConstruction", cfg.HNSWEfConstruction, 1)
+	atLeast("hnswEfSearch", cfg.HNSWEfSearch, 1)
+
+	atLeast("ingestWorkers", cfg.IngestWorkers, 1)
+	if cfg.JobRetention <= 0 {
+		bad("jobRetention", "must be positive")
+	}
+	atLeast("queryCacheSize", cfg.QueryCacheSize, 0)
+	if cfg.QueryCacheTTL < 0 {
+		bad("queryCacheTTL", "must not be negative")
+	}
+	if _, err := parseDedupPolicy(cfg.DedupPolicy); err != nil {
+		bad("dedupPolicy", "%v", err)
+	}
+	if cfg.DedupSimilarity < 0 || cfg.DedupSimilarity > 1 {
+		bad("dedupSimilarity", "must be between 0 and 1, not %v", cfg.DedupSimilarity)
+	}
+
+	atLeast("auditMaxSizeMB", cfg.AuditMaxSizeMB, 1)
+	atLeast("auditMaxBackups", cfg.AuditMaxBackups, 0)
+	if _, err := parseRedactions(cfg.AuditRedact, ""); err != nil {
+		bad("auditRedact", "%v", err)
+	}
+	if cfg.TenantHeader == "" {
+		bad("tenantHeader", "must be set")
+	}
+	return errors.Join(errs...)
+}
+
+// hnsw returns the parameters of the file store's index, or nil if it
+// searches by brute force.
+func (cfg *config) hnsw() *hnswConfig {
+	if cfg.VectorIndex != "hnsw" {
+		return nil
+	}
+	return &hnswConfig{M: cfg.HNSWM, EfConstruction: cfg.HNSWEfConstruction, EfSearch: cfg.HNSWEfSearch}
+}
+
+// masked returns the configuration as JSON, with secrets replaced by
+// asterisks.
+func (cfg *config) masked() ([]byte, error) {
+	c := *cfg
+	v := reflect.ValueOf(&c).Elem()
+	for i := range v.NumField() {
+		if v.Type().Field(i).Tag.Get("secret") == "true" && v.Field(i).String() != "" {
+			v.Field(i).SetString("********")
+		}
+	}
+	return json.MarshalIndent(&c, "", "  ")
+}
+
+// isLoopback reports whether address only listens on a loopback interface.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// duration is a time.Duration written as a string like "10m" in the config
+// file.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10m\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ragserver.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"serverPort": "8000",
+		"weaviateAddress": "weaviate.internal:8080",
+		"geminiApiKey": "from-file",
+		"ingestWorkers": 8,
+		"queryCacheTTL": "1m"
+	}`)
+	env := map[string]string{
+		"GEMINI_API_KEY":   "from-env",
+		"DEDUP_SIMILARITY": "0.9",
+		"JOB_RETENTION":    "2h",
+	}
+	cfg, err := loadConfig(path, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := defaultConfig()
+	want.Address = "localhost:8000"
+	want.ServerPort = "8000"
+	want.WeaviateAddress = "weaviate.internal:8080"
+	want.GeminiAPIKey = "from-env"
+	want.IngestWorkers = 8
+	want.QueryCacheTTL = duration(time.Minute)
+	want.DedupSimilarity = 0.9
+	want.JobRetention = duration(2 * time.Hour)
+	if *cfg != *want {
+		t.Errorf("loaded config\n%+v\nwant\n%+v", cfg, want)
+	}
+
+	// Without a file, the defaults apply.
+	cfg, err = loadConfig("", func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Address != "localhost:9020" || cfg.WeaviateAddress != "localhost:9035" {
+		t.Errorf("default addresses %q and %q", cfg.Address, cfg.WeaviateAddress)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		file string
+		env  map[string]string
+		want []string
+	}{
+		{file: `{"port": "1"}`, want: []string{`unknown field "port"`}},
+		{file: `{"jobRetention": 60}`, want: []string{"duration must be a string"}},
+		{
+			env:  map[string]string{"INGEST_WORKERS": "many", "QUERY_CACHE_TTL": "soon"},
+			want: []string{`ingestWorkers (INGEST_WORKERS): "many" isn't an integer`, `queryCacheTTL (QUERY_CACHE_TTL): "soon" isn't a duration`},
+		},
+	}
+	for _, tt := range tests {
+		path := ""
+		if tt.file != "" {
+			path = writeConfigFile(t, tt.file)
+		}
+		_, err := loadConfig(path, func(k string) string { return tt.env[k] })
+		if err == nil {
+			t.Errorf("loadConfig(%s, %v) succeeded", tt.file, tt.env)
+			continue
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("loadConfig(%s, %v) error %q doesn't mention %q", tt.file, tt.env, err, w)
+			}
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Address = "0.0.0.0"
+	cfg.WeaviateAddress = "localhost:9035"
+	cfg.TLSCertFile = "cert.pem"
+	cfg.IngestWorkers = 0
+	cfg.VectorStore = "sqlite"
+	cfg.DedupSimilarity = 1.5
+	cfg.Generators = "gemini:"
+	cfg.AuditRedact = "email,passport"
+
+	err := cfg.validate()
+	if err == nil {
+		t.Fatal("validate succeeded")
+	}
+	// Every problem is reported, on its own line.
+	for _, want := range []string{
+		"address (ADDRESS): address 0.0.0.0: missing port in address",
+		"tlsCertFile (TLS_CERT_FILE): TLS needs both a certificate and a key file",
+		"tlsCertFile (TLS_CERT_FILE): stat cert.pem: no such file or directory",
+		`generators (GENERATORS): bad generator "gemini:"`,
+		`vectorStore (VECTOR_STORE): is "sqlite"; want weaviate or file`,
+		"ingestWorkers (INGEST_WORKERS): must be at least 1, not 0",
+		"dedupSimilarity (DEDUP_SIMILARITY): must be between 0 and 1, not 1.5",
+		`auditRedact (AUDIT_REDACT): unknown redaction "passport"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("validate error doesn't mention %q:\n%v", want, err)
+		}
+	}
+	if n := strings.Count(err.Error(), "\n") + 1; n != 8 {
+		t.Errorf("validate reported %d problems, want 8:\n%v", n, err)
+	}
+}
+
+func TestConfigMasked(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.GeminiAPIKey = "sekrit"
+	js, err := cfg.masked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(js), "sekrit") {
+		t.Errorf("masked config shows the API key:\n%s", js)
+	}
+
+	// The printed configuration can be used as a config file.
+	var printed map[string]any
+	if err := json.Unmarshal(js, &printed); err != nil {
+		t.Fatal(err)
+	}
+	if printed["geminiApiKey"] != "********" || printed["openaiApiKey"] != "" || printed["queryCacheTTL"] != "10m0s" {
+		t.Errorf("masked config:\n%s", js)
+	}
+	path := writeConfigFile(t, string(js))
+	if _, err := loadConfig(path, func(string) string { return "" }); err != nil {
+		t.Errorf("loading printed config: %v", err)
+	}
+	if cfg.GeminiAPIKey != "sekrit" {
+		t.Errorf("masked changed the config")
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"localhost:9020": true,
+		"127.0.0.1:9020": true,
+		"[::1]:9020":     true,
+		":9020":          false,
+		"0.0.0.0:9020":   false,
+		"10.1.2.3:443":   false,
+		"example.com:80": false,
+	} {
+		if got := isLoopback(addr); got != want {
+			t.Errorf("isLoopback(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Deduplication of documents on ingest.
+//
+// A document's ID is derived from a hash of its text (with whitespace
+// normalized), so an exact duplicate of a stored document has the same ID
+// and is found with a cheap lookup. Optionally, a document whose vector is
+// more similar than a threshold to that of a stored document is treated as
+// a near duplicate too.
+//
+// What happens to duplicates is decided per request by a dedupPolicy.
+// Concurrent requests adding near duplicates of each other may still both
+// store theirs.
+//
+// Documents stored with dedupKeep, or by ragserver versions that predate
+// deduplication, have random IDs, so the lookup never finds them; only the
+// similarity check does. A re-index doesn't give them content IDs, since
+// audit and feedback records refer to documents by ID.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// dedupPolicy says what to do with a document that duplicates a stored one.
+type dedupPolicy string
+
+const (
+	dedupSkip    dedupPolicy = "skip"    // don't store it
+	dedupReplace dedupPolicy = "replace" // store it in place of the stored one
+	dedupKeep    dedupPolicy = "keep"    // store it alongside the stored one
+)
+
+func parseDedupPolicy(s string) (dedupPolicy, error) {
+	switch p := dedupPolicy(s); p {
+	case dedupSkip, dedupReplace, dedupKeep:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown dedup policy %q; want skip, replace or keep", s)
+}
+
+// docNamespace is the UUID namespace of content-derived document IDs.
+var docNamespace = uuid.MustParse("5b1f0c9e-2a4d-4f6b-8e3a-9c7d1e2f4a6b")
+
+// contentID returns the ID of a document with the given text: a UUIDv5 of
+// the text with whitespace normalized.
+func contentID(text string) string {
+	normalized := strings.Join(strings.Fields(text), " ")
+	return uuid.NewSHA1(docNamespace, []byte(normalized)).String()
+}
+
+// ingestResult counts what happened to the documents of an ingest request.
+type ingestResult struct {
+	Stored   int `json:"stored"`
+	Skipped  int `json:"skipped"`  // duplicates not stored
+	Replaced int `json:"replaced"` // stored documents that replaced a duplicate
+}
+
+func (r *ingestResult) add(o ingestResult) {
+	r.Stored += o.Stored
+	r.Skipped += o.Skipped
+	r.Replaced += o.Replaced
+}
+
+// exactDuplicates returns documents for texts with their IDs set, leaving
+// out exact duplicates that policy says to skip, whether of documents
+// stored in coll or of others in texts. It also returns which of the
+// documents' IDs are already stored in coll.
+func (rs *ragServer) exactDuplicates(coll collection, texts []string, policy dedupPolicy) ([]storedDoc, ingestResult, map[string]bool, error) {
+	var res ingestResult
+	docs := make([]storedDoc, 0, len(texts))
+	if policy == dedupKeep {
+		for _, text := range texts {
+			docs = append(docs, storedDoc{ID: uuid.NewString(), Text: text})
+		}
+		return docs, res, nil, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, text := range texts {
+		id := contentID(text)
+		if seen[id] {
+			res.Skipped++
+			continue
+		}
+		seen[id] = true
+		docs = append(docs, storedDoc{ID: id, Text: text})
+	}
+
+	ids := make([]string, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.ID
+	}
+	stored, err := rs.store.existing(rs.ctx, coll.Class, ids)
+	if err != nil {
+		return nil, ingestResult{}, nil, err
+	}
+	kept := docs[:0]
+	for _, doc := range docs {
+		switch {
+		case !stored[doc.ID]:
+			kept = append(kept, doc)
+		case policy == dedupReplace:
+			// Storing the document under the same ID replaces the old one.
+			kept = append(kept, doc)
+			res.Replaced++
+		default:
+			res.Skipped++
+		}
+	}
+	return kept, res, stored, nil
+}
+
+// nearDuplicates looks for stored documents in coll whose vectors are at
+// least rs.dedupSimilarity similar to those of docs. It returns the
+// documents policy says to store, the IDs of stored documents they replace,
+// and the number of documents skipped.
+func (rs *ragServer) nearDuplicates(coll collection, docs []storedDoc, policy dedupPolicy) (kept []storedDoc, replaced []string, skipped int, err error) {
+	for _, doc := range docs {
+		similar, err := rs.store.search(rs.ctx, coll.Class, doc.Vector, 1)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if len(similar) == 0 || similar[0].ID == doc.ID || similar[0].Score < rs.dedupSimilarity {
+			kept = append(kept, doc)
+			continue
+		}
+		if policy == dedupReplace {
+			kept = append(kept, doc)
+			replaced = append(replaced, similar[0].ID)
+			continue
+		}
+		skipped++
+	}
+	return kept, replaced, skipped, nil
+}
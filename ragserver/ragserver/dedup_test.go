@@ -0,0 +1,88 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestIngestExactDuplicates(t *testing.T) {
+	const page = "The quick brown fox jumps over the lazy dog."
+	tests := []struct {
+		policy    dedupPolicy
+		want      ingestResult
+		wantCount int
+	}{
+		{dedupSkip, ingestResult{Stored: 1, Skipped: 2}, 3},
+		{dedupReplace, ingestResult{Stored: 2, Skipped: 1, Replaced: 1}, 3},
+		{dedupKeep, ingestResult{Stored: 3}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			rs := newFileTestServer(t, nil)
+			if _, err := rs.ingest([]string{page, "another page"}, dedupSkip); err != nil {
+				t.Fatal(err)
+			}
+			// The page again, differing only in whitespace, twice.
+			texts := []string{"The quick brown fox\njumps over the lazy dog. ", "a third page", page}
+			res, err := rs.ingest(texts, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != tt.want {
+				t.Errorf("result = %+v, want %+v", res, tt.want)
+			}
+			if n, _ := rs.store.count(rs.ctx, rs.coll.Class); n != tt.wantCount {
+				t.Errorf("%d documents stored, want %d", n, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestIngestNearDuplicates(t *testing.T) {
+	const page = "The quick brown fox jumps over the lazy dog."
+	const edited = "The quick brown fox jumped over the lazy dog."
+	for _, policy := range []dedupPolicy{dedupSkip, dedupReplace} {
+		t.Run(string(policy), func(t *testing.T) {
+			rs := newFileTestServer(t, nil)
+			rs.dedupSimilarity = 0.95
+			if _, err := rs.ingest([]string{page, "zzz"}, dedupSkip); err != nil {
+				t.Fatal(err)
+			}
+			res, err := rs.ingest([]string{edited}, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			docs, err := rs.store.search(rs.ctx, rs.coll.Class, mustEmbed(t, page), 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var texts []string
+			for _, d := range docs {
+				texts = append(texts, d.Text)
+			}
+			want, wantRes := page, ingestResult{Skipped: 1}
+			if policy == dedupReplace {
+				want, wantRes = edited, ingestResult{Stored: 1, Replaced: 1}
+			}
+			if res != wantRes {
+				t.Errorf("result = %+v, want %+v", res, wantRes)
+			}
+			if len(texts) != 2 || texts[0] != want {
+				t.Errorf("stored %q, want %q and zzz", texts, want)
+			}
+		})
+	}
+}
+
+func mustEmbed(t *testing.T, text string) []float32 {
+	t.Helper()
+	v, err := letterEmbedder{}.embed(context.Background(), []string{text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v[0]
+}
@@ -0,0 +1,60 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// embedder computes embedding vectors for texts using a single embedding
+// model. Vectors computed by different embedders are not comparable, so every
+// collection records the model that produced its vectors.
+type embedder interface {
+	embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// geminiEmbedder is an embedder backed by a Google AI embedding model.
+type geminiEmbedder struct {
+	model *genai.EmbeddingModel
+}
+
+func (e geminiEmbedder) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	// Use the batch embedding API to embed all texts at once.
+	batch := e.model.NewBatch()
+	for _, text := range texts {
+		batch.AddContent(genai.Text(text))
+	}
+	rsp, err := e.model.BatchEmbedContents(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("embedded batch size mismatch")
+	}
+	vectors := make([][]float32, len(texts))
+	for i, e := range rsp.Embeddings {
+		vectors[i] = e.Values
+	}
+	return vectors, nil
+}
+
+// checkDimensions returns an error if any of vectors doesn't have the number
+// of dimensions recorded for coll. Collections created before dimensions were
+// recorded have Dimensions == 0 and aren't checked.
+func checkDimensions(coll collection, vectors [][]float32) error {
+	if coll.Dimensions == 0 {
+		return nil
+	}
+	for _, v := range vectors {
+		if len(v) != coll.Dimensions {
+			return fmt.Errorf("embedding has %d dimensions, collection %s expects %d (model %q)",
+				len(v), coll.Class, coll.Dimensions, coll.Model)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/weaviate/weaviate/entities/models"
+)
+
+// fakeWeaviate is an in-memory stand-in for the parts of the Weaviate REST
+// and GraphQL APIs that weaviateStore uses.
+type fakeWeaviate struct {
+	addr string // host:port of the fake
+
+	mu      sync.Mutex
+	classes map[string]*models.Class
+	objects map[string]map[string]*models.Object // by class, then ID
+
+	// failPath makes requests whose path starts with it fail with status
+	// 500, if it's not empty.
+	failPath string
+}
+
+// newFakeWeaviate starts a fakeWeaviate.
+func newFakeWeaviate(t *testing.T) *fakeWeaviate {
+	fw := &fakeWeaviate{
+		classes: make(map[string]*models.Class),
+		objects: make(map[string]map[string]*models.Object),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/meta", fw.meta)
+	mux.HandleFunc("GET /v1/schema", fw.getSchema)
+	mux.HandleFunc("POST /v1/schema", fw.createClass)
+	mux.HandleFunc("GET /v1/schema/{class}", fw.getClass)
+	mux.HandleFunc("POST /v1/schema/{class}/properties", fw.addProperty)
+	mux.HandleFunc("POST /v1/objects", fw.createObject)
+	mux.HandleFunc("GET /v1/objects", fw.listObjects)
+	mux.HandleFunc("HEAD /v1/objects/{class}/{id}", fw.checkObject)
+	mux.HandleFunc("GET /v1/objects/{class}/{id}", fw.getObject)
+	mux.HandleFunc("PATCH /v1/objects/{class}/{id}", fw.mergeObject)
+	mux.HandleFunc("POST /v1/batch/objects", fw.batchCreate)
+	mux.HandleFunc("DELETE /v1/batch/objects", fw.batchDelete)
+	mux.HandleFunc("POST /v1/graphql", fw.graphql)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fw.mu.Lock()
+		fail := fw.failPath != "" && strings.HasPrefix(req.URL.Path, fw.failPath)
+		fw.mu.Unlock()
+		if fail {
+			http.Error(w, `{"error": [{"message": "injected failure"}]}`, http.StatusInternalServerError)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	}))
+	t.Cleanup(srv.Close)
+	fw.addr = strings.TrimPrefix(srv.URL, "http://")
+	return fw
+}
+
+// setFailPath sets fw.failPath.
+func (fw *fakeWeaviate) setFailPath(path string) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.failPath = path
+}
+
+// dropClass deletes class and its objects.
+func (fw *fakeWeaviate) dropClass(class string) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	delete(fw.classes, class)
+	delete(fw.objects, class)
+}
+
+// count returns the number of objects of class.
+func (fw *fakeWeaviate) count(class string) int {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return len(fw.objects[class])
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (fw *fakeWeaviate) meta(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, map[string]any{"version": "1.26.1"})
+}
+
+func (fw *fakeWeaviate) getSchema(w http.ResponseWriter, req *http.Request) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	var classes []*models.Class
+	for _, c := range fw.classes {
+		classes = append(classes, c)
+	}
+	writeJSON(w, map[string]any{"classes": classes})
+}
+
+func (fw *fakeWeaviate) createClass(w http.ResponseWriter, req *http.Request) {
+	var c models.Class
+	if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if _, ok := fw.classes[c.Class]; ok {
+		http.Error(w, "class exists", http.StatusUnprocessableEntity)
+		return
+	}
+	fw.classes[c.Class] = &c
+	fw.objects[c.Class] = make(map[string]*models.Object)
+	writeJSON(w, &c)
+}
+
+func (fw *fakeWeaviate) getClass(w http.ResponseWriter, req *http.Request) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	c, ok := fw.classes[req.PathValue("class")]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	writeJSON(w, c)
+}
+
+func (fw *fakeWeaviate) addProperty(w http.ResponseWriter, req *http.Request) {
+	var p models.Property
+	if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	c, ok := fw.classes[req.PathValue("class")]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	c.Properties = append(c.Properties, &p)
+	writeJSON(w, &p)
+}
+
+// putObject stores obj; fw.mu must be held.
+func (fw *fakeWeaviate) putObject(obj *models.Object) error {
+	objs, ok := fw.objects[obj.Class]
+	if !ok {
+		return fmt.Errorf("class %q not found", obj.Class)
+	}
+	objs[obj.ID.String()] = obj
+	return nil
+}
+
+func (fw *fakeWeaviate) createObject(w http.ResponseWriter, req *http.Request) {
+	var obj models.Object
+	if err := json.NewDecoder(req.Body).Decode(&obj); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if err := fw.putObject(&obj); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, &obj)
+}
+
+// object returns the object named in req's path; fw.mu must be held.
+func (fw *fakeWeaviate) object(req *http.Request) *models.Object {
+	return fw.objects[req.PathValue("class")][req.PathValue("id")]
+}
+
+func (fw *fakeWeaviate) checkObject(w http.ResponseWriter, req *http.Request) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.object(req) == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (fw *fakeWeaviate) getObject(w http.ResponseWriter, req *http.Request) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	obj := fw.object(req)
+	if obj == nil {
+		http.NotFound(w, req)
+		return
+	}
+	writeJSON(w, obj)
+}
+
+func (fw *fakeWeaviate) mergeObject(w http.ResponseWriter, req *http.Request) {
+	var patch models.Object
+	if err := json.NewDecoder(req.Body).Decode(&patch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	obj := fw.object(req)
+	if obj == nil {
+		http.NotFound(w, req)
+		return
+	}
+	props, _ := obj.Properties.(map[string]any)
+	for k, v := range patch.Properties.(map[string]any) {
+		props[k] = v
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listObjects lists the objects of a class in ID order, as used by scan.
+func (fw *fakeWeaviate) listObjects(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	limit, _ := strconv.Atoi(cmp.Or(q.Get("limit"), "25"))
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	objs := fw.sortedObjects(q.Get("class"))
+	i, _ := slices.BinarySearchFunc(objs, q.Get("after"), func(o *models.Object, id string) int {
+		return cmp.Compare(o.ID.String(), id)
+	})
+	if q.Get("after") != "" && i < len(objs) && objs[i].ID.String() == q.Get("after") {
+		i++
+	}
+	objs = objs[i:]
+	writeJSON(w, map[string]any{"objects": objs[:min(limit, len(objs))]})
+}
+
+// sortedObjects returns the objects of class in ID order; fw.mu must be
+// held.
+func (fw *fakeWeaviate) sortedObjects(class string) []*models.Object {
+	var objs []*models.Object
+	for _, obj := range fw.objects[class] {
+		objs = append(objs, obj)
+	}
+	slices.SortFunc(objs, func(a, b *models.Object) int { return cmp.Compare(a.ID, b.ID) })
+	return objs
+}
+
+func (fw *fakeWeaviate) batchCreate(w http.ResponseWriter, req *http.Request) {
+	var body struct{ Objects []*models.Object }
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	var results []*models.ObjectsGetResponse
+	for _, obj := range body.Objects {
+		res := &models.ObjectsGetResponse{Object: *obj, Result: &models.ObjectsGetResponseAO2Result{}}
+		if err := fw.putObject(obj); err != nil {
+			res.Result.Errors = &models.ErrorResponse{Error: []*models.ErrorResponseErrorItems0{{Message: err.Error()}}}
+		}
+		results = append(results, res)
+	}
+	writeJSON(w, results)
+}
+
+func (fw *fakeWeaviate) batchDelete(w http.ResponseWriter, req *http.Request) {
+	var body models.BatchDelete
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ids, err := whereIDs(body.Match.Where)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	objs := fw.objects[body.Match.Class]
+	var matches int64
+	for _, id := range ids {
+		if _, ok := objs[id]; ok {
+			delete(objs, id)
+			matches++
+		}
+	}
+	writeJSON(w, &models.BatchDeleteResponse{
+		Output:  body.Output,
+		Results: &models.BatchDeleteResponseResults{Matches: matches, Successful: matches},
+	})
+}
+
+// whereIDs returns the IDs matched by a filter built by idFilter.
+func whereIDs(where *models.WhereFilter) ([]string, error) {
+	if where == nil || !slices.Equal(where.Path, []string{"id"}) || where.Operator != "ContainsAny" {
+		return nil, fmt.Errorf("unsupported filter")
+	}
+	return where.ValueTextArray, nil
+}
+
+// The GraphQL queries weaviateStore sends are simple enough to pick apart
+// with regular expressions.
+var (
+	gqlClassRE  = regexp.MustCompile(`^\s*\{\s*(Get|Aggregate)\s*\{\s*(\w+)`)
+	gqlLimitRE  = regexp.MustCompile(`limit:\s*(\d+)`)
+	gqlVectorRE = regexp.MustCompile(`nearVector:\s*\{\s*vector:\s*\[([^\]]*)\]`)
+	gqlIDsRE    = regexp.MustCompile(`operator:\s*ContainsAny\s*path:\s*\["id"\]\s*valueText:\s*\[([^\]]*)\]`)
+)
+
+func (fw *fakeWeaviate) graphql(w http.ResponseWriter, req *http.Request) {
+	var body struct{ Query string }
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m := gqlClassRE.FindStringSubmatch(body.Query)
+	if m == nil {
+		http.Error(w, "unsupported query: "+body.Query, http.StatusBadRequest)
+		return
+	}
+	op, class := m[1], m[2]
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if _, ok := fw.classes[class]; !ok {
+		writeJSON(w, map[string]any{"errors": []map[string]any{{"message": fmt.Sprintf("class %q not found", class)}}})
+		return
+	}
+	if op == "Aggregate" {
+		writeJSON(w, map[string]any{"data": map[string]any{"Aggregate": map[string]any{
+			class: []any{map[string]any{"meta": map[string]any{"count": len(fw.objects[class])}}},
+		}}})
+		return
+	}
+
+	objs := fw.sortedObjects(class)
+	var dists []float64
+	if m := gqlIDsRE.FindStringSubmatch(body.Query); m == nil && strings.Contains(body.Query, "where:") {
+		http.Error(w, "unsupported filter: "+body.Query, http.StatusBadRequest)
+		return
+	} else if m != nil {
+		var ids []string
+		if err := json.Unmarshal([]byte("["+m[1]+"]"), &ids); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		objs = slices.DeleteFunc(objs, func(o *models.Object) bool { return !slices.Contains(ids, o.ID.String()) })
+	}
+	if m := gqlVectorRE.FindStringSubmatch(body.Query); m != nil {
+		var v []float32
+		if err := json.Unmarshal([]byte("["+m[1]+"]"), &v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dist := func(o *models.Object) float64 { return cosineDistance(v, o.Vector) }
+		slices.SortStableFunc(objs, func(a, b *models.Object) int { return cmp.Compare(dist(a), dist(b)) })
+		for _, o := range objs {
+			dists = append(dists, dist(o))
+		}
+	}
+	if m := gqlLimitRE.FindStringSubmatch(body.Query); m != nil {
+		limit, _ := strconv.Atoi(m[1])
+		objs = objs[:min(limit, len(objs))]
+	}
+
+	results := []any{}
+	for i, o := range objs {
+		additional := map[string]any{"id": o.ID}
+		if dists != nil {
+			additional["distance"] = dists[i]
+		}
+		props, _ := o.Properties.(map[string]any)
+		results = append(results, map[string]any{"text": props["text"], "_additional": additional})
+	}
+	writeJSON(w, map[string]any{"data": map[string]any{"Get": map[string]any{class: results}}})
+}
+
+func cosineDistance(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range min(len(a), len(b)) {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 1
+	}
+	return 1 - dot/math.Sqrt(na*nb)
+}
@@ -0,0 +1,319 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Feedback on answers. Users rate an answer, identified by the request ID
+// it was given for, and the rating is appended to the audit log next to
+// the answer's record. The export joins the two, with the texts of the
+// documents the answer was based on, to build evaluation sets.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// feedbackRecord is an entry in the audit log recording feedback on an
+// answer.
+type feedbackRecord struct {
+	Type      string    `json:"type"` // "feedback"
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Rating    string    `json:"rating"` // "up" or "down"
+	Comment   string    `json:"comment,omitempty"`
+}
+
+func (rs *ragServer) feedbackHandler(w http.ResponseWriter, req *http.Request) {
+	type feedbackRequest struct {
+		RequestID string
+		Rating    string
+		Comment   string
+	}
+	fr := &feedbackRequest{}
+	err := readRequestJSON(req, fr)
+	if err == nil && fr.RequestID == "" {
+		err = errors.New("missing requestId")
+	}
+	if err == nil && fr.Rating != "up" && fr.Rating != "down" {
+		err = fmt.Errorf("rating is %q; want up or down", fr.Rating)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rs.auditor == nil {
+		http.Error(w, "feedback is stored in the audit log, which isn't enabled", http.StatusNotImplemented)
+		return
+	}
+	// Feedback may only be given on an answer the tenant got. Answers of
+	// other tenants are reported as unknown, like answers that don't exist.
+	tenant := req.Header.Get(rs.auditor.tenantHeader)
+	answerTenant, ok, err := rs.auditor.answerTenant(fr.RequestID)
+	if err != nil {
+		log.Printf("looking up answer %s: %v", fr.RequestID, err)
+		http.Error(w, "looking up the answer failed", http.StatusInternalServerError)
+		return
+	}
+	if !ok || answerTenant != tenant {
+		http.Error(w, fmt.Sprintf("no answer with request ID %q", fr.RequestID), http.StatusNotFound)
+		return
+	}
+
+	fb := &feedbackRecord{
+		Type:      "feedback",
+		Time:      time.Now(),
+		RequestID: fr.RequestID,
+		Tenant:    tenant,
+		Rating:    fr.Rating,
+		Comment:   rs.auditor.redact(fr.Comment),
+	}
+	if err := rs.auditor.sink.writeFeedback(fb); err != nil {
+		log.Printf("writing feedback on %s: %v", fb.RequestID, err)
+		http.Error(w, "storing feedback failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// answerTenant returns the tenant of the answer with the given request ID,
+// and whether there's such an answer in the audit log. Answers not among the
+// recent ones a remembers are looked for in the log file, if there is one.
+func (a *auditor) answerTenant(requestID string) (tenant string, ok bool, err error) {
+	if tenant, ok := a.answers.get(requestID); ok {
+		return tenant, true, nil
+	}
+	if a.file == nil {
+		return "", false, nil
+	}
+	files, err := a.file.openAll()
+	if err != nil {
+		return "", false, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	err = readAuditLog(files, func(line *auditLine) {
+		if rec := line.answer; rec != nil && rec.RequestID == requestID {
+			tenant, ok = rec.Tenant, true
+		}
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if ok {
+		a.answers.put(requestID, tenant)
+	}
+	return tenant, ok, nil
+}
+
+// feedbackExample is an answer with the feedback given on it, as exported.
+type feedbackExample struct {
+	RequestID string        `json:"requestId"`
+	Time      time.Time     `json:"time"` // when the answer was given
+	Tenant    string        `json:"tenant,omitempty"`
+	Question  string        `json:"question"`
+	Rewrites  []string      `json:"rewrites,omitempty"`
+	Answer    string        `json:"answer"`
+	Model     string        `json:"model,omitempty"`
+	Documents []exportedDoc `json:"documents"`
+	Rating    string        `json:"rating"`
+	Comment   string        `json:"comment,omitempty"`
+}
+
+// exportedDoc is a document an exported answer was based on. Deleted is set
+// if it's no longer stored, and its text is unknown.
+type exportedDoc struct {
+	ID      string `json:"id"`
+	Text    string `json:"text,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// exportFeedbackHandler writes the answers that have feedback as JSON lines
+// of feedbackExample, in the order the feedback was given. Only the latest
+// feedback on an answer is used. The "rating" query parameter restricts
+// the export to "up" or "down" ratings.
+func (rs *ragServer) exportFeedbackHandler(w http.ResponseWriter, req *http.Request) {
+	rating := req.URL.Query().Get("rating")
+	if rating != "" && rating != "up" && rating != "down" {
+		http.Error(w, fmt.Sprintf("rating is %q; want up or down", rating), http.StatusBadRequest)
+		return
+	}
+	if rs.auditor == nil || rs.auditor.file == nil {
+		http.Error(w, "exporting feedback needs an audit log file", http.StatusNotImplemented)
+		return
+	}
+	examples, err := rs.feedbackExamples(req.Context(), rating)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, ex := range examples {
+		if err := enc.Encode(ex); err != nil {
+			return
+		}
+	}
+}
+
+// feedbackExamples reads the audit log and returns the answers with
+// feedback of the given rating ("" for any), in the order the feedback was
+// given. Feedback on answers no longer in the log is left out.
+func (rs *ragServer) feedbackExamples(ctx context.Context, rating string) ([]*feedbackExample, error) {
+	files, err := rs.auditor.file.openAll()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	// The log may be large, so read it twice rather than keep every
+	// answer: first for the feedback, then for the answers it's on.
+	var order []string
+	latest := make(map[string]*feedbackRecord)
+	err = readAuditLog(files, func(line *auditLine) {
+		fb := line.feedback
+		if fb == nil {
+			return
+		}
+		if _, ok := latest[fb.RequestID]; !ok {
+			order = append(order, fb.RequestID)
+		}
+		latest[fb.RequestID] = fb
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	answers := make(map[string]*auditRecord)
+	err = readAuditLog(files, func(line *auditLine) {
+		if rec := line.answer; rec != nil && latest[rec.RequestID] != nil {
+			answers[rec.RequestID] = rec
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var examples []*feedbackExample
+	var ids []string
+	for _, id := range order {
+		fb, rec := latest[id], answers[id]
+		if rec == nil || rating != "" && fb.Rating != rating {
+			continue
+		}
+		examples = append(examples, &feedbackExample{
+			RequestID: id,
+			Time:      rec.Time,
+			Tenant:    rec.Tenant,
+			Question:  rec.Question,
+			Rewrites:  rec.Rewrites,
+			Answer:    rec.Answer,
+			Model:     rec.Model,
+			Rating:    fb.Rating,
+			Comment:   fb.Comment,
+		})
+		ids = append(ids, rec.DocIDs...)
+	}
+
+	texts, err := rs.documentTexts(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, ex := range examples {
+		ex.Documents = []exportedDoc{}
+		for _, id := range answers[ex.RequestID].DocIDs {
+			text, ok := texts[id]
+			ex.Documents = append(ex.Documents, exportedDoc{ID: id, Text: text, Deleted: !ok})
+		}
+	}
+	return examples, nil
+}
+
+// documentTexts returns the texts of the documents with the given IDs in
+// the active collection, by ID.
+func (rs *ragServer) documentTexts(ctx context.Context, ids []string) (map[string]string, error) {
+	const batchSize = 100
+	class := rs.collection().Class
+	texts := make(map[string]string)
+	for len(ids) > 0 {
+		batch := ids[:min(batchSize, len(ids))]
+		ids = ids[len(batch):]
+		docs, err := rs.store.fetch(ctx, class, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			texts[doc.ID] = doc.Text
+		}
+	}
+	return texts, nil
+}
+
+// auditLine is a line of the audit log. One of its fields is set,
+// according to the line's type.
+type auditLine struct {
+	answer   *auditRecord
+	feedback *feedbackRecord
+}
+
+func (l *auditLine) UnmarshalJSON(data []byte) error {
+	var typ struct{ Type string }
+	if err := json.Unmarshal(data, &typ); err != nil {
+		return err
+	}
+	switch typ.Type {
+	case "answer":
+		l.answer = &auditRecord{}
+		return json.Unmarshal(data, l.answer)
+	case "feedback":
+		l.feedback = &feedbackRecord{}
+		return json.Unmarshal(data, l.feedback)
+	}
+	return fmt.Errorf("unknown audit log line type %q", typ.Type)
+}
+
+// readAuditLog calls f for each line of files in turn. Lines that can't be
+// decoded, such as one cut short by a crash, are logged and skipped.
+func readAuditLog(files []*os.File, f func(*auditLine)) error {
+	for _, file := range files {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r := bufio.NewReader(file)
+		for n := 1; ; n++ {
+			data, err := r.ReadBytes('\n')
+			if len(data) > 0 && err == nil {
+				line := &auditLine{}
+				if err := json.Unmarshal(data, line); err != nil {
+					log.Printf("%s:%d: %v", file.Name(), n, err)
+					continue
+				}
+				f(line)
+			}
+			if err == io.EOF {
+				// An unterminated last line is still being written.
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFeedbackExport(t *testing.T) {
+	rs := newFileTestServer(t, &fakeGenerator{chunks: []string{"an answer"}}, "aaaa", "bbbb", "cccc", "dddd")
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	file, err := openRotatingFile(path, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	// An answer logged before the server started, so it's only in the file.
+	file.Write([]byte(`{"type":"answer","time":"2024-01-02T03:04:05Z","requestId":"q0","endpoint":"/query/","question":"dddd","docIds":[],"answer":"old","latencyMs":1}` + "\n"))
+	rs.auditor = &auditor{sink: &jsonlSink{w: file}, file: file, tenantHeader: "X-Tenant-ID", answers: newLRUCache[string, string](10, 0)}
+
+	do := func(method, target, body, requestID string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Request-ID", requestID)
+		req.Header.Set("X-Tenant-ID", "t1")
+		w := httptest.NewRecorder()
+		switch {
+		case target == "/query/":
+			rs.queryHandler(w, req)
+		case method == "POST":
+			rs.feedbackHandler(w, req)
+		default:
+			rs.exportFeedbackHandler(w, req)
+		}
+		return w
+	}
+	do("POST", "/query/", `{"content": "aaaa"}`, "q1")
+	do("POST", "/query/", `{"content": "bbbb"}`, "q2")
+	do("POST", "/query/", `{"content": "cccc"}`, "q3")
+	for _, fb := range []struct{ id, body string }{
+		{"q2", `{"requestId": "q2", "rating": "up"}`},
+		{"q1", `{"requestId": "q1", "rating": "up"}`},
+		{"q1", `{"requestId": "q1", "rating": "down", "comment": "wrong"}`}, // changed their mind
+	} {
+		if w := do("POST", "/feedback/", fb.body, ""); w.Code != http.StatusNoContent {
+			t.Fatalf("feedback on %s: status %d: %s", fb.id, w.Code, w.Body)
+		}
+	}
+	if w := do("POST", "/feedback/", `{"requestId": "q3", "rating": "meh"}`, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("bad rating: status %d, want 400", w.Code)
+	}
+	if w := do("POST", "/feedback/", `{"requestId": "q9", "rating": "down"}`, ""); w.Code != http.StatusNotFound {
+		t.Errorf("feedback on an unknown answer: status %d, want 404", w.Code)
+	}
+
+	// q0 was answered for another tenant.
+	if w := do("POST", "/feedback/", `{"requestId": "q0", "rating": "up"}`, ""); w.Code != http.StatusNotFound {
+		t.Errorf("feedback on another tenant's answer: status %d, want 404", w.Code)
+	}
+	req := httptest.NewRequest("POST", "/feedback/", strings.NewReader(`{"requestId": "q0", "rating": "up"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	rs.feedbackHandler(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("feedback on q0 without a tenant: status %d: %s", w.Code, w.Body)
+	}
+
+	// A line cut short by a crash is skipped.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"type": "feedb` + "\n")
+	f.Close()
+
+	// bbbb, which q2's answer was based on, is deleted.
+	if err := rs.store.delete(rs.ctx, rs.coll.Class, []string{contentID("bbbb")}); err != nil {
+		t.Fatal(err)
+	}
+
+	export := func(query string) []feedbackExample {
+		t.Helper()
+		w := do("GET", "/feedback/"+query, "", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("export: status %d: %s", w.Code, w.Body)
+		}
+		var examples []feedbackExample
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var ex feedbackExample
+			if err := json.Unmarshal(scanner.Bytes(), &ex); err != nil {
+				t.Fatal(err)
+			}
+			examples = append(examples, ex)
+		}
+		return examples
+	}
+
+	examples := export("")
+	if len(examples) != 3 {
+		t.Fatalf("exported %d examples, want 3: %+v", len(examples), examples)
+	}
+	q2, q1, q0 := examples[0], examples[1], examples[2]
+	if q2.RequestID != "q2" || q2.Question != "bbbb" || q2.Answer != "an answer" || q2.Rating != "up" {
+		t.Errorf("first example = %+v", q2)
+	}
+	if q1.RequestID != "q1" || q1.Rating != "down" || q1.Comment != "wrong" {
+		t.Errorf("second example = %+v", q1)
+	}
+	if i := slices.IndexFunc(q2.Documents, func(d exportedDoc) bool { return d.ID == contentID("bbbb") }); i < 0 || !q2.Documents[i].Deleted {
+		t.Errorf("q2 documents = %+v, want bbbb deleted", q2.Documents)
+	}
+	if len(q1.Documents) == 0 || q1.Documents[0].Text != "aaaa" {
+		t.Errorf("q1 documents = %+v, want aaaa first", q1.Documents)
+	}
+	if q0.RequestID != "q0" || q0.Question != "dddd" || q0.Answer != "old" || q0.Rating != "up" {
+		t.Errorf("example of an answer from before the server started = %+v", q0)
+	}
+
+	if examples := export("?rating=down"); len(examples) != 1 || examples[0].RequestID != "q1" {
+		t.Errorf("export of down ratings = %+v", examples)
+	}
+}
@@ -0,0 +1,573 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// A vector store in a local directory, for single-node deployments that
+// don't want to run Weaviate.
+//
+// All documents are kept in memory. Every change is appended to log.jsonl as
+// a JSON record and synced before it's applied, so it survives a crash.
+// Periodically the whole state is written to snapshot.jsonl (via a
+// temporary file and a rename) and the log is truncated. On startup the
+// snapshot is loaded and the log replayed on top of it. Records are
+// idempotent, so replaying a log that was already folded into the snapshot
+// (if we crash between the rename and the truncation) is harmless.
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	fileStoreLog      = "log.jsonl"
+	fileStoreSnapshot = "snapshot.jsonl"
+
+	// snapshotBatchSize is the number of documents per record in a snapshot.
+	snapshotBatchSize = 100
+)
+
+// fileStore is a vectorStore persisted to a local directory. Reads only take
+// a read lock on the in-memory state, so they proceed while a write is being
+// synced to disk or a snapshot is being written.
+type fileStore struct {
+	dir  string
+	hnsw *hnswConfig // nil for brute-force search
+	done chan struct{}
+
+	closeOnce sync.Once
+
+	// logMu serializes writers and compaction.
+	logMu   sync.Mutex
+	logFile *os.File
+	logSize int64
+
+	mu          sync.RWMutex // protects the fields below
+	colls       map[string]*fileCollection
+	activeClass string
+}
+
+type fileCollection struct {
+	info  collection
+	docs  map[string]fileDoc
+	index *hnswIndex // nil for brute-force search
+}
+
+// fileDoc is a stored document. If the collection has an index, the vector
+// is only kept there, normalized.
+type fileDoc struct {
+	text   string
+	vector []float32
+	norm   float64
+}
+
+// fileRecord is one line of the log or snapshot.
+type fileRecord struct {
+	Op         string      `json:"op"` // "create", "active", "put" or "delete"
+	Collection *collection `json:"collection,omitempty"`
+	Class      string      `json:"class,omitempty"`
+	Docs       []storedDoc `json:"docs,omitempty"`
+	IDs        []string    `json:"ids,omitempty"` // for "delete"
+}
+
+// openFileStore opens the store in dir, creating dir if needed, and starts
+// compacting its log every compactEvery. If hnsw is non-nil, collections are
+// searched with an HNSW index built with those parameters instead of by
+// comparing the query to every document.
+func openFileStore(dir string, compactEvery time.Duration, hnsw *hnswConfig) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	fs := &fileStore{
+		dir:   dir,
+		hnsw:  hnsw,
+		done:  make(chan struct{}),
+		colls: make(map[string]*fileCollection),
+	}
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+	go fs.compactLoop(compactEvery)
+	return fs, nil
+}
+
+// load reads the snapshot and replays the log, leaving the log open for
+// appending.
+func (fs *fileStore) load() error {
+	snap, err := os.Open(filepath.Join(fs.dir, fileStoreSnapshot))
+	switch {
+	case err == nil:
+		_, err = fs.replay(snap)
+		snap.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", fileStoreSnapshot, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(fs.dir, fileStoreLog), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	good, err := fs.replay(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("reading %s: %w", fileStoreLog, err)
+	}
+	// Drop a partial record left by a crash in the middle of an append.
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	fs.logFile, fs.logSize = f, good
+	return nil
+}
+
+// replay applies the records read from r. It returns the offset just past
+// the last complete record; an incomplete final line is not an error.
+func (fs *fileStore) replay(r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+	var off int64
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return off, nil // line, if any, is a torn write
+		}
+		if err != nil {
+			return off, err
+		}
+		var rec fileRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if _, perr := br.Peek(1); perr == io.EOF {
+				return off, nil // a torn write that happened to end in a newline
+			}
+			return off, fmt.Errorf("bad record at offset %d: %w", off, err)
+		}
+		if err := fs.apply(&rec); err != nil {
+			return off, fmt.Errorf("record at offset %d: %w", off, err)
+		}
+		off += int64(len(line))
+	}
+}
+
+// apply applies rec to the in-memory state. The caller must hold fs.mu or
+// otherwise have exclusive access.
+func (fs *fileStore) apply(rec *fileRecord) error {
+	switch rec.Op {
+	case "create":
+		if rec.Collection == nil {
+			return errors.New("create without collection")
+		}
+		if _, ok := fs.colls[rec.Collection.Class]; !ok {
+			fc := &fileCollection{
+				info: *rec.Collection,
+				docs: make(map[string]fileDoc),
+			}
+			if fs.hnsw != nil {
+				fc.index = newHNSWIndex(*fs.hnsw)
+			}
+			fs.colls[rec.Collection.Class] = fc
+		}
+	case "active":
+		fs.activeClass = rec.Class
+	case "put":
+		fc, ok := fs.colls[rec.Class]
+		if !ok {
+			return fmt.Errorf("no collection %s", rec.Class)
+		}
+		for _, d := range rec.Docs {
+			if fc.index != nil {
+				fc.index.add(d.ID, d.Vector)
+				fc.docs[d.ID] = fileDoc{text: d.Text}
+				continue
+			}
+			fc.docs[d.ID] = fileDoc{text: d.Text, vector: d.Vector, norm: norm(d.Vector)}
+		}
+	case "delete":
+		fc, ok := fs.colls[rec.Class]
+		if !ok {
+			return fmt.Errorf("no collection %s", rec.Class)
+		}
+		for _, id := range rec.IDs {
+			delete(fc.docs, id)
+			if fc.index != nil {
+				fc.index.delete(id)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown op %q", rec.Op)
+	}
+	return nil
+}
+
+// write appends rec to the log, syncs it and then applies it.
+func (fs *fileStore) write(rec *fileRecord) error {
+	js, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+
+	fs.logMu.Lock()
+	defer fs.logMu.Unlock()
+	if fs.logFile == nil {
+		return errors.New("file store is closed")
+	}
+	n, err := fs.logFile.Write(js)
+	if err == nil {
+		err = fs.logFile.Sync()
+	}
+	if err != nil {
+		// Cut off whatever part of the record made it to the file: records
+		// appended after a torn one couldn't be replayed.
+		if terr := fs.truncateLog(); terr != nil {
+			err = errors.Join(err, terr)
+		}
+		return fmt.Errorf("writing %s: %w", fileStoreLog, err)
+	}
+	fs.logSize += int64(n)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.apply(rec)
+}
+
+// truncateLog truncates the log to fs.logSize, the end of the last complete
+// record, and positions it there for the next append. If that fails, the
+// log is closed, since it can't be appended to safely. fs.logMu must be held.
+func (fs *fileStore) truncateLog() error {
+	err := fs.logFile.Truncate(fs.logSize)
+	if err == nil {
+		_, err = fs.logFile.Seek(fs.logSize, io.SeekStart)
+	}
+	if err != nil {
+		fs.logFile.Close()
+		fs.logFile = nil
+	}
+	return err
+}
+
+func (fs *fileStore) active(ctx context.Context) (collection, bool, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	fc, ok := fs.colls[fs.activeClass]
+	if !ok {
+		return collection{}, false, nil
+	}
+	return fc.info, true, nil
+}
+
+func (fs *fileStore) setActive(ctx context.Context, coll collection) error {
+	if _, err := fs.collection(coll.Class); err != nil {
+		return err
+	}
+	return fs.write(&fileRecord{Op: "active", Class: coll.Class})
+}
+
+func (fs *fileStore) create(ctx context.Context, coll collection) error {
+	fs.mu.RLock()
+	_, exists := fs.colls[coll.Class]
+	fs.mu.RUnlock()
+	if exists {
+		return fmt.Errorf("collection %s already exists", coll.Class)
+	}
+	return fs.write(&fileRecord{Op: "create", Collection: &coll})
+}
+
+func (fs *fileStore) count(ctx context.Context, class string) (int, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	fc, ok := fs.colls[class]
+	if !ok {
+		return 0, fmt.Errorf("no collection %s", class)
+	}
+	return len(fc.docs), nil
+}
+
+func (fs *fileStore) store(ctx context.Context, class string, docs []storedDoc) error {
+	if _, err := fs.collection(class); err != nil {
+		return err
+	}
+	return fs.write(&fileRecord{Op: "put", Class: class, Docs: docs})
+}
+
+func (fs *fileStore) scan(ctx context.Context, class, after string, limit int) ([]storedDoc, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	fc, ok := fs.colls[class]
+	if !ok {
+		return nil, fmt.Errorf("no collection %s", class)
+	}
+	var ids []string
+	for id := range fc.docs {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	ids = ids[:min(limit, len(ids))]
+	docs := make([]storedDoc, len(ids))
+	for i, id := range ids {
+		docs[i] = storedDoc{ID: id, Text: fc.docs[id].text}
+	}
+	return docs, nil
+}
+
+// search finds the documents with the highest cosine similarity to vector,
+// using the collection's index if it has one, or else a brute-force scan.
+func (fs *fileStore) search(ctx context.Context, class string, vector []float32, limit int) ([]storedDoc, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	fc, ok := fs.colls[class]
+	if !ok {
+		return nil, fmt.Errorf("no collection %s", class)
+	}
+	if fc.index != nil {
+		ids, dists := fc.index.search(vector, limit)
+		docs := make([]storedDoc, len(ids))
+		for i, id := range ids {
+			docs[i] = storedDoc{ID: id, Text: fc.docs[id].text, Score: 1 - float64(dists[i])}
+		}
+		return docs, nil
+	}
+
+	type hit struct {
+		id    string
+		score float64
+	}
+	qnorm := norm(vector)
+	hits := make([]hit, 0, len(fc.docs))
+	for id, d := range fc.docs {
+		hits = append(hits, hit{id, cosine(vector, qnorm, d.vector, d.norm)})
+	}
+	slices.SortFunc(hits, func(a, b hit) int {
+		return cmp.Or(cmp.Compare(b.score, a.score), cmp.Compare(a.id, b.id))
+	})
+	hits = hits[:min(limit, len(hits))]
+	docs := make([]storedDoc, len(hits))
+	for i, h := range hits {
+		docs[i] = storedDoc{ID: h.id, Text: fc.docs[h.id].text, Score: h.score}
+	}
+	return docs, nil
+}
+
+func (fs *fileStore) fetch(ctx context.Context, class string, ids []string) ([]storedDoc, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	fc, ok := fs.colls[class]
+	if !ok {
+		return nil, fmt.Errorf("no collection %s", class)
+	}
+	var docs []storedDoc
+	for _, id := range ids {
+		if doc, ok := fc.docs[id]; ok {
+			docs = append(docs, storedDoc{ID: id, Text: doc.text})
+		}
+	}
+	return docs, nil
+}
+
+func (fs *fileStore) existing(ctx context.Context, class string, ids []string) (map[string]bool, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	fc, ok := fs.colls[class]
+	if !ok {
+		return nil, fmt.Errorf("no collection %s", class)
+	}
+	found := make(map[string]bool)
+	for _, id := range ids {
+		if _, ok := fc.docs[id]; ok {
+			found[id] = true
+		}
+	}
+	return found, nil
+}
+
+func (fs *fileStore) delete(ctx context.Context, class string, ids []string) error {
+	if _, err := fs.collection(class); err != nil {
+		return err
+	}
+	return fs.write(&fileRecord{Op: "delete", Class: class, IDs: ids})
+}
+
+func (fs *fileStore) collection(class string) (*fileCollection, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	fc, ok := fs.colls[class]
+	if !ok {
+		return nil, fmt.Errorf("no collection %s", class)
+	}
+	return fc, nil
+}
+
+func (fs *fileStore) compactLoop(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fs.done:
+			return
+		case <-ticker.C:
+			if err := fs.compact(); err != nil {
+				log.Printf("compacting file store: %v", err)
+			}
+		}
+	}
+}
+
+// compact writes the current state to a new snapshot and truncates the log.
+// Writers wait while it runs; readers don't.
+func (fs *fileStore) compact() error {
+	fs.logMu.Lock()
+	defer fs.logMu.Unlock()
+	if fs.logFile == nil || fs.logSize == 0 {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(fs.dir, fileStoreSnapshot+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+	if err := fs.writeSnapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(fs.dir, fileStoreSnapshot)); err != nil {
+		return err
+	}
+	// Make sure the rename is on disk before truncating the log, or a crash
+	// could leave the old snapshot and an empty log.
+	if err := syncDir(fs.dir); err != nil {
+		return err
+	}
+
+	if err := fs.logFile.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := fs.logFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fs.logSize = 0
+	return nil
+}
+
+func (fs *fileStore) writeSnapshot(w io.Writer) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, fc := range fs.colls {
+		if err := enc.Encode(&fileRecord{Op: "create", Collection: &fc.info}); err != nil {
+			return err
+		}
+		var docs []storedDoc
+		for id, d := range fc.docs {
+			vector := d.vector
+			if fc.index != nil {
+				vector = fc.index.vector(id)
+			}
+			docs = append(docs, storedDoc{ID: id, Text: d.text, Vector: vector})
+			if len(docs) == snapshotBatchSize {
+				if err := enc.Encode(&fileRecord{Op: "put", Class: fc.info.Class, Docs: docs}); err != nil {
+					return err
+				}
+				docs = docs[:0]
+			}
+		}
+		if len(docs) > 0 {
+			if err := enc.Encode(&fileRecord{Op: "put", Class: fc.info.Class, Docs: docs}); err != nil {
+				return err
+			}
+		}
+	}
+	if fs.activeClass != "" {
+		if err := enc.Encode(&fileRecord{Op: "active", Class: fs.activeClass}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// syncDir syncs the directory dir, making renames in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// close compacts the store and closes its log. Calls after the first do
+// nothing.
+func (fs *fileStore) close() error {
+	first := false
+	fs.closeOnce.Do(func() {
+		close(fs.done)
+		first = true
+	})
+	if !first {
+		return nil
+	}
+	err := fs.compact()
+	fs.logMu.Lock()
+	defer fs.logMu.Unlock()
+	if fs.logFile == nil {
+		return err
+	}
+	if cerr := fs.logFile.Close(); err == nil {
+		err = cerr
+	}
+	fs.logFile = nil
+	return err
+}
+
+func norm(v []float32) float64 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	return math.Sqrt(sum)
+}
+
+// cosine returns the cosine similarity of a and b, given their norms.
+func cosine(a []float32, anorm float64, b []float32, bnorm float64) float64 {
+	if anorm == 0 || bnorm == 0 || len(a) != len(b) {
+		return -1
+	}
+	var dot float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+	}
+	return dot / (anorm * bnorm)
+}
@@ -0,0 +1,209 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestFileStore(t *testing.T, dir string) *fileStore {
+	t.Helper()
+	fs, err := openFileStore(dir, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func searchIDs(t *testing.T, fs *fileStore, class string, vector []float32) string {
+	t.Helper()
+	docs, err := fs.search(context.Background(), class, vector, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, d := range docs {
+		ids = append(ids, d.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir)
+
+	if _, ok, err := fs.active(ctx); err != nil || ok {
+		t.Fatalf("active() = %v, %v on an empty store", ok, err)
+	}
+	coll := collection{Class: "Document", Model: "m", Dimensions: 2}
+	if err := fs.create(ctx, coll); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.setActive(ctx, coll); err != nil {
+		t.Fatal(err)
+	}
+	err := fs.store(ctx, "Document", []storedDoc{
+		{ID: "a", Text: "east", Vector: []float32{1, 0}},
+		{ID: "b", Text: "north", Vector: []float32{0, 1}},
+		{ID: "c", Text: "northeast", Vector: []float32{1, 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIDs(t, fs, "Document", []float32{1, 0.1}); got != "a,c" {
+		t.Errorf("search = %s, want a,c", got)
+	}
+
+	check := func(fs *fileStore) {
+		t.Helper()
+		got, ok, err := fs.active(ctx)
+		if err != nil || !ok || got != coll {
+			t.Errorf("active() = %v, %v, %v; want %v", got, ok, err, coll)
+		}
+		if n, err := fs.count(ctx, "Document"); err != nil || n != 3 {
+			t.Errorf("count = %d, %v; want 3", n, err)
+		}
+		if got := searchIDs(t, fs, "Document", []float32{0.1, 1}); got != "b,c" {
+			t.Errorf("search = %s, want b,c", got)
+		}
+		docs, err := fs.scan(ctx, "Document", "a", 10)
+		if err != nil || len(docs) != 2 || docs[0].ID != "b" || docs[1].Text != "northeast" {
+			t.Errorf("scan = %v, %v", docs, err)
+		}
+	}
+
+	// Reload from the log alone.
+	fs.logFile.Close()
+	fs2 := openTestFileStore(t, dir)
+	check(fs2)
+
+	// Reload from a snapshot.
+	if err := fs2.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs2.close(); err != nil {
+		t.Errorf("closing again: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, fileStoreLog)); err != nil || fi.Size() != 0 {
+		t.Errorf("log not truncated after compaction: %v, %v", fi, err)
+	}
+	fs3 := openTestFileStore(t, dir)
+	defer fs3.close()
+	check(fs3)
+}
+
+func TestFileStoreTornWrite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir)
+	coll := collection{Class: "Document", Model: "m", Dimensions: 1}
+	if err := fs.create(ctx, coll); err != nil {
+		t.Fatal(err)
+	}
+	fs.logFile.WriteString(`{"op":"put","class":"Document","docs":[{"id":"x"`)
+	fs.logFile.Close()
+
+	fs = openTestFileStore(t, dir)
+	if n, err := fs.count(ctx, "Document"); err != nil || n != 0 {
+		t.Errorf("count = %d, %v; want 0", n, err)
+	}
+	// The partial record is gone, so new writes are readable.
+	if err := fs.store(ctx, "Document", []storedDoc{{ID: "y", Text: "y", Vector: []float32{1}}}); err != nil {
+		t.Fatal(err)
+	}
+	fs.logFile.Close()
+	fs = openTestFileStore(t, dir)
+	if n, err := fs.count(ctx, "Document"); err != nil || n != 1 {
+		t.Errorf("count after reopen = %d, %v; want 1", n, err)
+	}
+	fs.close()
+}
+
+func TestFileStoreFailedWrite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir)
+	coll := collection{Class: "Document", Model: "m", Dimensions: 1}
+	if err := fs.create(ctx, coll); err != nil {
+		t.Fatal(err)
+	}
+	// An append that failed part way leaves part of a record behind, which
+	// write cuts off again.
+	fs.logMu.Lock()
+	fs.logFile.WriteString(`{"op":"put","class":"Document","docs":[{"id":"x"`)
+	err := fs.truncateLog()
+	fs.logMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fs.logFile.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != fs.logSize {
+		t.Fatalf("log is %d bytes after truncation, want %d", fi.Size(), fs.logSize)
+	}
+	if err := fs.store(ctx, "Document", []storedDoc{{ID: "y", Text: "y", Vector: []float32{1}}}); err != nil {
+		t.Fatal(err)
+	}
+	fs.logFile.Close()
+
+	fs, err = openFileStore(dir, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("reopening after a failed write: %v", err)
+	}
+	defer fs.close()
+	if n, err := fs.count(ctx, "Document"); err != nil || n != 1 {
+		t.Errorf("count after reopen = %d, %v; want 1", n, err)
+	}
+}
+
+func TestFileStoreHNSW(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cfg := defaultHNSWConfig
+	fs, err := openFileStore(dir, time.Hour, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.create(ctx, collection{Class: "Document", Model: "m", Dimensions: 2}); err != nil {
+		t.Fatal(err)
+	}
+	err = fs.store(ctx, "Document", []storedDoc{
+		{ID: "a", Text: "east", Vector: []float32{1, 0}},
+		{ID: "b", Text: "north", Vector: []float32{0, 1}},
+		{ID: "c", Text: "northeast", Vector: []float32{1, 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replacing a document moves it in the index.
+	err = fs.store(ctx, "Document", []storedDoc{{ID: "a", Text: "west", Vector: []float32{-1, 0}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIDs(t, fs, "Document", []float32{1, 0.1}); got != "c,b" {
+		t.Errorf("search = %s, want c,b", got)
+	}
+
+	// The index is rebuilt from the snapshot on reload.
+	if err := fs.close(); err != nil {
+		t.Fatal(err)
+	}
+	fs, err = openFileStore(dir, time.Hour, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.close()
+	if got := searchIDs(t, fs, "Document", []float32{-1, 0.1}); got != "a,b" {
+		t.Errorf("search after reload = %s, want a,b", got)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+)
+
+// geminiGenerator is a generator backed by a Google AI generative model.
+type geminiGenerator struct {
+	model *genai.GenerativeModel
+	label string
+}
+
+func newGeminiGenerator(client *genai.Client, model string) *geminiGenerator {
+	return &geminiGenerator{model: client.GenerativeModel(model), label: "gemini:" + model}
+}
+
+func (g *geminiGenerator) name() string { return g.label }
+
+// chat returns a chat session with the system instructions and history of
+// req.
+func (g *geminiGenerator) chat(req *genRequest) *genai.ChatSession {
+	// The model is shared between requests, so per-request settings go on a
+	// copy.
+	model := *g.model
+	model.Temperature = req.Settings.Temperature
+	model.MaxOutputTokens = req.Settings.MaxOutputTokens
+	model.StopSequences = req.Settings.StopSequences
+	if len(req.System) > 0 {
+		model.SystemInstruction = &genai.Content{}
+		for _, s := range req.System {
+			model.SystemInstruction.Parts = append(model.SystemInstruction.Parts, genai.Text(s))
+		}
+	}
+	cs := model.StartChat()
+	for _, m := range req.History {
+		role := "user"
+		if m.Role == "assistant" {
+			role = "model"
+		}
+		cs.History = append(cs.History, &genai.Content{Role: role, Parts: []genai.Part{genai.Text(m.Text)}})
+	}
+	return cs
+}
+
+func (g *geminiGenerator) generate(ctx context.Context, req *genRequest) (*genResponse, error) {
+	resp, err := g.chat(req).SendMessage(ctx, genai.Text(req.Prompt))
+	if err != nil {
+		return nil, geminiError(err)
+	}
+	if len(resp.Candidates) != 1 {
+		return nil, fmt.Errorf("got %v candidates, expected 1", len(resp.Candidates))
+	}
+
+	gr := &genResponse{FinishReason: "stop"}
+	cand := resp.Candidates[0]
+	gr.addCandidate(cand)
+	if err := gr.checkText(cand.FinishReason); err != nil {
+		return nil, err
+	}
+	if u := resp.UsageMetadata; u != nil {
+		gr.PromptTokens, gr.CompletionTokens = u.PromptTokenCount, u.CandidatesTokenCount
+	}
+	return gr, nil
+}
+
+func (g *geminiGenerator) generateStream(ctx context.Context, req *genRequest, onText func(string)) (*genResponse, error) {
+	iter := g.chat(req).SendMessageStream(ctx, genai.Text(req.Prompt))
+	gr := &genResponse{FinishReason: "stop"}
+	finish := genai.FinishReasonUnspecified
+	for {
+		resp, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, geminiError(err)
+		}
+		if u := resp.UsageMetadata; u != nil {
+			gr.PromptTokens, gr.CompletionTokens = u.PromptTokenCount, u.CandidatesTokenCount
+		}
+		if len(resp.Candidates) == 0 {
+			continue
+		}
+		before := len(gr.Text)
+		cand := resp.Candidates[0]
+		gr.addCandidate(cand)
+		if cand.FinishReason != genai.FinishReasonUnspecified {
+			finish = cand.FinishReason
+		}
+		if text := gr.Text[before:]; text != "" {
+			onText(text)
+		}
+	}
+	if err := gr.checkText(finish); err != nil {
+		return nil, err
+	}
+	return gr, nil
+}
+
+// checkText returns a "no_text" generationError if gr has no text, unless
+// generation stopped for reaching the token limit. finish is the reason it
+// stopped.
+func (gr *genResponse) checkText(finish genai.FinishReason) error {
+	if gr.Text != "" || finish == genai.FinishReasonMaxTokens {
+		return nil
+	}
+	return &generationError{
+		Code:          "no_text",
+		Reason:        trimEnumPrefix(finish, "FinishReason"),
+		SafetyRatings: gr.SafetyRatings,
+		IgnoredParts:  gr.IgnoredParts,
+	}
+}
+
+// addCandidate adds the text, safety ratings and finish reason of cand (or
+// a streamed piece of it) to gr. Text parts are concatenated; other parts
+// are only recorded in gr.IgnoredParts.
+func (gr *genResponse) addCandidate(cand *genai.Candidate) {
+	if cand.Content != nil {
+		for _, part := range cand.Content.Parts {
+			if t, ok := part.(genai.Text); ok {
+				gr.Text += string(t)
+			} else {
+				gr.IgnoredParts = append(gr.IgnoredParts, strings.TrimPrefix(fmt.Sprintf("%T", part), "genai."))
+			}
+		}
+	}
+	if cand.FinishReason != genai.FinishReasonUnspecified {
+		gr.FinishReason = openAIFinishReason(cand.FinishReason)
+	}
+	if len(cand.SafetyRatings) > 0 {
+		gr.SafetyRatings = safetyRatings(cand.SafetyRatings)
+	}
+}
+
+// geminiError converts the genai package's BlockedError into a
+// generationError, and returns other errors unchanged.
+func geminiError(err error) error {
+	var berr *genai.BlockedError
+	if !errors.As(err, &berr) {
+		return err
+	}
+	if pf := berr.PromptFeedback; pf != nil {
+		return &generationError{
+			Code:          "prompt_blocked",
+			Reason:        trimEnumPrefix(pf.BlockReason, "BlockReason"),
+			SafetyRatings: safetyRatings(pf.SafetyRatings),
+		}
+	}
+	return &generationError{
+		Code:          "response_blocked",
+		Reason:        trimEnumPrefix(berr.Candidate.FinishReason, "FinishReason"),
+		SafetyRatings: safetyRatings(berr.Candidate.SafetyRatings),
+	}
+}
+
+func safetyRatings(ratings []*genai.SafetyRating) []safetyRating {
+	var out []safetyRating
+	for _, r := range ratings {
+		out = append(out, safetyRating{
+			Category:    trimEnumPrefix(r.Category, "HarmCategory"),
+			Probability: trimEnumPrefix(r.Probability, "HarmProbability"),
+			Blocked:     r.Blocked,
+		})
+	}
+	return out
+}
+
+// trimEnumPrefix returns the name of a genai enum value without the type
+// name prefix, e.g. "Safety" for genai.FinishReasonSafety.
+func trimEnumPrefix(v fmt.Stringer, prefix string) string {
+	return strings.TrimPrefix(v.String(), prefix)
+}
+
+// openAIFinishReason translates a Gemini finish reason to OpenAI's.
+func openAIFinishReason(fr genai.FinishReason) string {
+	switch fr {
+	case genai.FinishReasonMaxTokens:
+		return "length"
+	case genai.FinishReasonSafety, genai.FinishReasonRecitation:
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestGeminiError(t *testing.T) {
+	ratings := []*genai.SafetyRating{{
+		Category:    genai.HarmCategoryDangerousContent,
+		Probability: genai.HarmProbabilityHigh,
+		Blocked:     true,
+	}}
+	wantRatings := []safetyRating{{Category: "DangerousContent", Probability: "High", Blocked: true}}
+
+	tests := []struct {
+		err        error
+		wantCode   string
+		wantReason string
+	}{
+		{
+			&genai.BlockedError{PromptFeedback: &genai.PromptFeedback{BlockReason: genai.BlockReasonSafety, SafetyRatings: ratings}},
+			"prompt_blocked", "Safety",
+		},
+		{
+			fmt.Errorf("wrapped: %w", &genai.BlockedError{Candidate: &genai.Candidate{FinishReason: genai.FinishReasonSafety, SafetyRatings: ratings}}),
+			"response_blocked", "Safety",
+		},
+	}
+	for _, tt := range tests {
+		var gerr *generationError
+		if !errors.As(geminiError(tt.err), &gerr) {
+			t.Errorf("geminiError(%v) is not a generationError", tt.err)
+			continue
+		}
+		if gerr.Code != tt.wantCode || gerr.Reason != tt.wantReason {
+			t.Errorf("geminiError(%v) = %s/%s, want %s/%s", tt.err, gerr.Code, gerr.Reason, tt.wantCode, tt.wantReason)
+		}
+		if !reflect.DeepEqual(gerr.SafetyRatings, wantRatings) {
+			t.Errorf("geminiError(%v) ratings = %+v, want %+v", tt.err, gerr.SafetyRatings, wantRatings)
+		}
+	}
+
+	other := errors.New("other")
+	if err := geminiError(other); err != other {
+		t.Errorf("geminiError(other) = %v, want unchanged", err)
+	}
+}
+
+func TestAddCandidate(t *testing.T) {
+	gr := &genResponse{FinishReason: "stop"}
+	gr.addCandidate(&genai.Candidate{
+		Content: &genai.Content{Parts: []genai.Part{
+			genai.Text("partial "),
+			genai.FunctionCall{Name: "f"},
+			genai.Text("answer"),
+		}},
+		FinishReason: genai.FinishReasonMaxTokens,
+	})
+	if gr.Text != "partial answer" {
+		t.Errorf("Text = %q, want %q", gr.Text, "partial answer")
+	}
+	if gr.FinishReason != "length" {
+		t.Errorf("FinishReason = %q, want length", gr.FinishReason)
+	}
+	if !reflect.DeepEqual(gr.IgnoredParts, []string{"FunctionCall"}) {
+		t.Errorf("IgnoredParts = %v, want [FunctionCall]", gr.IgnoredParts)
+	}
+}
+
+func TestCheckText(t *testing.T) {
+	tests := []struct {
+		text     string
+		finish   genai.FinishReason
+		wantCode string // "" for no error
+	}{
+		{"answer", genai.FinishReasonStop, ""},
+		{"", genai.FinishReasonMaxTokens, ""},
+		{"", genai.FinishReasonStop, "no_text"},
+		{"", genai.FinishReasonUnspecified, "no_text"},
+	}
+	for _, tt := range tests {
+		gr := &genResponse{Text: tt.text, IgnoredParts: []string{"FunctionCall"}}
+		err := gr.checkText(tt.finish)
+		var gerr *generationError
+		switch {
+		case tt.wantCode == "" && err != nil:
+			t.Errorf("checkText(%q, %v) = %v, want nil", tt.text, tt.finish, err)
+		case tt.wantCode != "" && (!errors.As(err, &gerr) || gerr.Code != tt.wantCode):
+			t.Errorf("checkText(%q, %v) = %v, want %s", tt.text, tt.finish, err, tt.wantCode)
+		case gerr != nil && !reflect.DeepEqual(gerr.IgnoredParts, gr.IgnoredParts):
+			t.Errorf("checkText(%q, %v) ignored parts = %v", tt.text, tt.finish, gerr.IgnoredParts)
+		}
+	}
+}
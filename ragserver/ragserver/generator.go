@@ -0,0 +1,291 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Generative model backends.
+//
+// Answers are produced by a generator. The server is configured with an
+// ordered list of backends (GENERATORS), which are wrapped in a
+// fallbackGenerator: each backend is retried with backoff on transient
+// errors, and when it keeps failing the next one is tried.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// generator produces a response to a prompt using a generative model.
+type generator interface {
+	// name identifies the backend and model, e.g. "gemini:gemini-1.5-flash".
+	name() string
+
+	// generate returns the model's complete response to req.
+	generate(ctx context.Context, req *genRequest) (*genResponse, error)
+
+	// generateStream is like generate, but also calls onText with each piece
+	// of the response text as it arrives.
+	generateStream(ctx context.Context, req *genRequest, onText func(string)) (*genResponse, error)
+}
+
+// genRequest is a request to a generator.
+type genRequest struct {
+	System   []string     // system instructions
+	History  []genMessage // earlier turns of a conversation
+	Prompt   string
+	Settings genSettings
+}
+
+// genSettings are per-request generation settings. Nil fields leave the
+// choice to the backend.
+type genSettings struct {
+	Temperature     *float32 `json:"temperature,omitempty"`
+	MaxOutputTokens *int32   `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+}
+
+// maxStopSequences is the most stop sequences Gemini accepts.
+const maxStopSequences = 5
+
+// check validates s against the server's limits and fills in the server's
+// maximum number of output tokens if s doesn't ask for fewer.
+func (s *genSettings) check(maxOutputTokens int32) error {
+	if t := s.Temperature; t != nil && (*t < 0 || *t > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2, got %v", *t)
+	}
+	if n := s.MaxOutputTokens; n != nil && (*n < 1 || *n > maxOutputTokens) {
+		return fmt.Errorf("maxOutputTokens must be between 1 and %d, got %d", maxOutputTokens, *n)
+	}
+	if s.MaxOutputTokens == nil {
+		s.MaxOutputTokens = &maxOutputTokens
+	}
+	if len(s.StopSequences) > maxStopSequences {
+		return fmt.Errorf("at most %d stop sequences are allowed, got %d", maxStopSequences, len(s.StopSequences))
+	}
+	return nil
+}
+
+// key returns a string identifying s, for use in cache keys.
+func (s genSettings) key() string {
+	js, _ := json.Marshal(s)
+	return string(js)
+}
+
+// genMessage is a conversation turn. Role is "user" or "assistant".
+type genMessage struct {
+	Role string
+	Text string
+}
+
+// genResponse is a generator's response.
+type genResponse struct {
+	Text string
+
+	// FinishReason is why generation stopped, in OpenAI's terms: "stop",
+	// "length" (the response was truncated at the maximum number of output
+	// tokens) or "content_filter".
+	FinishReason string
+
+	// SafetyRatings are the backend's safety ratings of the response, if it
+	// provides them.
+	SafetyRatings []safetyRating
+
+	// IgnoredParts lists the kinds of non-text parts the response contained;
+	// only text is passed on to clients.
+	IgnoredParts []string
+
+	// Generator is the name of the generator that produced the response.
+	Generator string
+
+	PromptTokens, CompletionTokens int32
+}
+
+// safetyRating is the probability that content is harmful in a category.
+type safetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability"`
+	Blocked     bool   `json:"blocked,omitempty"`
+}
+
+// generationError reports that a generator refused to answer or gave no
+// usable answer. It isn't retried, and doesn't fall back to other
+// generators: those would be asked the same thing.
+type generationError struct {
+	// Code is "prompt_blocked" if the request was refused, "response_blocked"
+	// if the response was withheld, or "no_text" if the response had no
+	// text.
+	Code string
+
+	// Reason is the backend's reason, e.g. "Safety".
+	Reason string
+
+	SafetyRatings []safetyRating
+	IgnoredParts  []string
+}
+
+func (e *generationError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Reason)
+	}
+	return e.Code
+}
+
+// parseGenerators parses a comma-separated list of generator specs, each of
+// the form "gemini:MODEL" or "openai:MODEL@BASEURL", into generators.
+// newGemini and newOpenAI construct the backends.
+func parseGenerators(specs string, newGemini func(model string) generator, newOpenAI func(model, baseURL string) generator) ([]generator, error) {
+	var gens []generator
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		kind, model, ok := strings.Cut(spec, ":")
+		if !ok || model == "" {
+			return nil, fmt.Errorf("bad generator %q: want KIND:MODEL", spec)
+		}
+		switch kind {
+		case "gemini":
+			gens = append(gens, newGemini(model))
+		case "openai":
+			model, baseURL, ok := strings.Cut(model, "@")
+			if !ok || model == "" || baseURL == "" {
+				return nil, fmt.Errorf("bad generator %q: want openai:MODEL@BASEURL", spec)
+			}
+			gens = append(gens, newOpenAI(model, baseURL))
+		default:
+			return nil, fmt.Errorf("bad generator %q: unknown kind %q", spec, kind)
+		}
+	}
+	return gens, nil
+}
+
+// Retry parameters for a single backend.
+const (
+	generatorAttempts   = 3
+	generatorBackoff    = 500 * time.Millisecond
+	generatorMaxBackoff = 5 * time.Second
+)
+
+// fallbackGenerator tries a list of generators in order, retrying each on
+// transient errors before moving on to the next.
+type fallbackGenerator struct {
+	gens  []generator
+	sleep func(context.Context, time.Duration) error
+}
+
+func newFallbackGenerator(gens ...generator) *fallbackGenerator {
+	return &fallbackGenerator{gens: gens, sleep: sleepContext}
+}
+
+func (f *fallbackGenerator) name() string {
+	names := make([]string, len(f.gens))
+	for i, g := range f.gens {
+		names[i] = g.name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *fallbackGenerator) generate(ctx context.Context, req *genRequest) (*genResponse, error) {
+	return f.try(ctx, func(g generator) (*genResponse, error) {
+		return g.generate(ctx, req)
+	}, nil)
+}
+
+// generateStream falls back like generate, but only until the first text has
+// been passed to onText: after that, a failure can't be hidden from the
+// client and is returned.
+func (f *fallbackGenerator) generateStream(ctx context.Context, req *genRequest, onText func(string)) (*genResponse, error) {
+	streamed := false
+	return f.try(ctx, func(g generator) (*genResponse, error) {
+		return g.generateStream(ctx, req, func(text string) {
+			streamed = true
+			onText(text)
+		})
+	}, func() bool { return streamed })
+}
+
+// try calls call with each generator in turn until one succeeds. It gives up
+// immediately on a generationError, when ctx is done, or if committed is
+// non-nil and returns true after a failed call.
+func (f *fallbackGenerator) try(ctx context.Context, call func(generator) (*genResponse, error), committed func() bool) (*genResponse, error) {
+	var errs []error
+	for _, g := range f.gens {
+		backoff := generatorBackoff
+		for attempt := 1; ; attempt++ {
+			resp, err := call(g)
+			if err == nil {
+				resp.Generator = g.name()
+				return resp, nil
+			}
+			log.Printf("generator %s, attempt %d: %v", g.name(), attempt, err)
+			var gerr *generationError
+			if errors.As(err, &gerr) || (committed != nil && committed()) {
+				return nil, err
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if attempt == generatorAttempts || !isTransient(err) {
+				errs = append(errs, fmt.Errorf("%s: %w", g.name(), err))
+				break
+			}
+			// Full jitter: sleep a random time up to the backoff.
+			if err := f.sleep(ctx, rand.N(backoff)); err != nil {
+				return nil, err
+			}
+			backoff = min(2*backoff, generatorMaxBackoff)
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// sleepContext sleeps for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// httpStatusError is returned by backends that talk HTTP directly when they
+// get an unsuccessful response.
+type httpStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+// isTransient reports whether err is worth retrying: rate limiting, server
+// errors and network failures.
+func isTransient(err error) bool {
+	code := 0
+	var gerr *googleapi.Error
+	var herr *httpStatusError
+	switch {
+	case errors.As(err, &gerr):
+		code = gerr.Code
+	case errors.As(err, &herr):
+		code = herr.StatusCode
+	}
+	if code != 0 {
+		return code == http.StatusTooManyRequests || code >= 500
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
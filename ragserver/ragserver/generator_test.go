@@ -0,0 +1,163 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var (
+	errUnavailable = &httpStatusError{StatusCode: http.StatusServiceUnavailable}
+	errBadRequest  = &httpStatusError{StatusCode: http.StatusBadRequest}
+)
+
+func TestFallbackGenerator(t *testing.T) {
+	tests := []struct {
+		name          string
+		primaryErrs   []error
+		wantGenerator string
+		wantCalls     int // to primary
+	}{
+		{"ok", nil, "primary", 1},
+		{"retried", []error{errUnavailable}, "primary", 2},
+		{"exhausted", []error{errUnavailable, errUnavailable, errUnavailable}, "secondary", generatorAttempts},
+		{"permanent", []error{errBadRequest}, "secondary", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := &fakeGenerator{label: "primary", errs: tt.primaryErrs}
+			secondary := &fakeGenerator{label: "secondary"}
+			f := newFallbackGenerator(primary, secondary)
+			f.sleep = noSleep
+
+			resp, err := f.generate(context.Background(), &genRequest{Prompt: "q"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Generator != tt.wantGenerator {
+				t.Errorf("Generator = %q, want %q", resp.Generator, tt.wantGenerator)
+			}
+			if len(primary.reqs) != tt.wantCalls {
+				t.Errorf("primary called %d times, want %d", len(primary.reqs), tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestFallbackGeneratorAllFail(t *testing.T) {
+	f := newFallbackGenerator(
+		&fakeGenerator{label: "a", errs: []error{errBadRequest}},
+		&fakeGenerator{label: "b", errs: []error{errBadRequest}})
+	f.sleep = noSleep
+	_, err := f.generate(context.Background(), &genRequest{Prompt: "q"})
+	if err == nil || !strings.Contains(err.Error(), "a: ") || !strings.Contains(err.Error(), "b: ") {
+		t.Errorf("err = %v, want errors from both generators", err)
+	}
+}
+
+func TestFallbackGeneratorCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// The client goes away during the call to primary, which fails.
+	primary := &fakeGenerator{label: "primary", errs: []error{errUnavailable}, hook: cancel}
+	secondary := &fakeGenerator{label: "secondary"}
+	f := newFallbackGenerator(primary, secondary)
+	f.sleep = noSleep
+
+	_, err := f.generate(ctx, &genRequest{Prompt: "q"})
+	if err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+	if len(secondary.reqs) != 0 {
+		t.Errorf("secondary called %d times after the context was canceled, want 0", len(secondary.reqs))
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	if !isTransient(errUnavailable) {
+		t.Error("503 is not transient")
+	}
+	if !isTransient(&httpStatusError{StatusCode: http.StatusTooManyRequests}) {
+		t.Error("429 is not transient")
+	}
+	if isTransient(errBadRequest) {
+		t.Error("400 is transient")
+	}
+	if isTransient(errors.New("bad type of part")) {
+		t.Error("plain error is transient")
+	}
+}
+
+func TestParseGenerators(t *testing.T) {
+	newGemini := func(model string) generator { return &fakeGenerator{label: "gemini:" + model} }
+	newOpenAI := func(model, baseURL string) generator {
+		return &fakeGenerator{label: "openai:" + model + "@" + baseURL}
+	}
+
+	gens, err := parseGenerators("gemini:gemini-1.5-flash, openai:llama3@http://localhost:11434/v1", newGemini, newOpenAI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, g := range gens {
+		names = append(names, g.name())
+	}
+	want := "gemini:gemini-1.5-flash,openai:llama3@http://localhost:11434/v1"
+	if got := strings.Join(names, ","); got != want {
+		t.Errorf("generators = %s, want %s", got, want)
+	}
+
+	for _, bad := range []string{"", "gemini", "gemini:", "openai:llama3", "other:model"} {
+		if _, err := parseGenerators(bad, newGemini, newOpenAI); err == nil {
+			t.Errorf("parseGenerators(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestGenSettingsCheck(t *testing.T) {
+	f32 := func(f float32) *float32 { return &f }
+	i32 := func(i int32) *int32 { return &i }
+	tests := []struct {
+		s       genSettings
+		wantErr bool
+	}{
+		{genSettings{}, false},
+		{genSettings{Temperature: f32(0.5), MaxOutputTokens: i32(100), StopSequences: []string{"END"}}, false},
+		{genSettings{Temperature: f32(-1)}, true},
+		{genSettings{Temperature: f32(2.5)}, true},
+		{genSettings{MaxOutputTokens: i32(0)}, true},
+		{genSettings{MaxOutputTokens: i32(1001)}, true},
+		{genSettings{StopSequences: make([]string, maxStopSequences+1)}, true},
+	}
+	for _, tt := range tests {
+		s := tt.s
+		err := s.check(1000)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("check(%s) = %v, want error %v", tt.s.key(), err, tt.wantErr)
+		}
+		if err == nil && s.MaxOutputTokens == nil {
+			t.Errorf("check(%s) didn't set MaxOutputTokens", tt.s.key())
+		}
+	}
+}
+
+func TestFallbackGeneratorRefusal(t *testing.T) {
+	primary := &fakeGenerator{label: "primary", errs: []error{&generationError{Code: "prompt_blocked"}}}
+	secondary := &fakeGenerator{label: "secondary"}
+	f := newFallbackGenerator(primary, secondary)
+	f.sleep = noSleep
+
+	_, err := f.generate(context.Background(), &genRequest{Prompt: "q"})
+	var gerr *generationError
+	if !errors.As(err, &gerr) || gerr.Code != "prompt_blocked" {
+		t.Fatalf("err = %v, want prompt_blocked", err)
+	}
+	if len(secondary.reqs) != 0 {
+		t.Errorf("secondary called %d times after a refusal, want 0", len(secondary.reqs))
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGenerator is a generator whose calls are scripted. Each call records
+// its request and fails with the next of errs while there are any left.
+// Otherwise it streams chunks, then fails with err if that's set, or
+// answers with the chunks joined together.
+type fakeGenerator struct {
+	label        string // name of the generator; "fake" if empty
+	chunks       []string
+	finishReason string // "stop" if empty
+	errs         []error
+	err          error
+	hook         func() // called at the start of each call, if set
+
+	reqs []*genRequest
+}
+
+func (g *fakeGenerator) name() string { return cmp.Or(g.label, "fake") }
+
+func (g *fakeGenerator) generate(ctx context.Context, req *genRequest) (*genResponse, error) {
+	return g.generateStream(ctx, req, func(string) {})
+}
+
+func (g *fakeGenerator) generateStream(ctx context.Context, req *genRequest, onText func(string)) (*genResponse, error) {
+	g.reqs = append(g.reqs, req)
+	if g.hook != nil {
+		g.hook()
+	}
+	if len(g.errs) > 0 {
+		err := g.errs[0]
+		g.errs = g.errs[1:]
+		return nil, err
+	}
+	for _, c := range g.chunks {
+		onText(c)
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+	return &genResponse{
+		Text:             strings.Join(g.chunks, ""),
+		FinishReason:     cmp.Or(g.finishReason, "stop"),
+		PromptTokens:     10,
+		CompletionTokens: 2,
+	}, nil
+}
+
+func noSleep(context.Context, time.Duration) error { return nil }
+
+// letterEmbedder embeds texts as vectors of letter counts, so texts that
+// differ in a letter or two are very similar.
+type letterEmbedder struct{}
+
+func (letterEmbedder) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		v := make([]float32, 26)
+		for _, r := range strings.ToLower(text) {
+			if r >= 'a' && r <= 'z' {
+				v[r-'a']++
+			}
+		}
+		vectors[i] = v
+	}
+	return vectors, nil
+}
+
+// newFileTestServer returns a server that keeps documents in a file store,
+// embedded with letterEmbedder as the "letters" model, and already has docs.
+// Its answers come from gen, if it isn't nil, retried without waiting, and
+// aren't cached.
+func newFileTestServer(t *testing.T, gen generator, docs ...string) *ragServer {
+	t.Helper()
+	fs, err := openFileStore(t.TempDir(), time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.close() })
+	rs := &ragServer{
+		ctx:             context.Background(),
+		store:           fs,
+		newEmbedder:     func(string) embedder { return letterEmbedder{} },
+		cache:           newLRUCache[queryKey, *queryResult](0, 0),
+		maxOutputTokens: 100,
+	}
+	if gen != nil {
+		rs.gen = newFallbackGenerator(gen)
+		rs.gen.sleep = noSleep
+	}
+	rs.coll, err = activeCollection(rs.ctx, fs, "letters", letterEmbedder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) > 0 {
+		if _, err := rs.ingest(docs, dedupSkip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rs
+}
@@ -0,0 +1,416 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// An approximate nearest neighbour index using Hierarchical Navigable Small
+// World graphs, as described by Malkov and Yashunin in "Efficient and robust
+// approximate nearest neighbor search using Hierarchical Navigable Small
+// World graphs" (https://arxiv.org/abs/1603.09320).
+//
+// Every vector is a node in a graph on layer 0, and on each layer above it
+// with geometrically decreasing probability. A search starts at the single
+// entry point on the top layer, greedily walks towards the query on each
+// layer, and does a wider beam search on layer 0.
+//
+// Vectors are normalized when added, so the distance between two nodes is
+// one minus their cosine similarity.
+
+import (
+	"cmp"
+	"container/heap"
+	"math"
+	"math/rand/v2"
+	"slices"
+)
+
+// hnswConfig holds the parameters of an HNSW index.
+type hnswConfig struct {
+	// M is the number of neighbours a node is linked to on each layer
+	// (twice that on layer 0). Higher values improve recall at the cost of
+	// memory and insertion time.
+	M int
+
+	// EfConstruction is the size of the candidate list used when inserting.
+	// Higher values build a better graph, more slowly.
+	EfConstruction int
+
+	// EfSearch is the size of the candidate list used when searching. It's
+	// the main knob trading recall for query latency.
+	EfSearch int
+}
+
+var defaultHNSWConfig = hnswConfig{M: 16, EfConstruction: 200, EfSearch: 64}
+
+// hnswIndex is an HNSW index of vectors identified by strings. It isn't safe
+// for concurrent use, except that searches may run concurrently with each
+// other.
+type hnswIndex struct {
+	cfg       hnswConfig
+	levelMult float64
+	rng       *rand.Rand
+
+	nodes    []*hnswNode // nil for deleted nodes
+	free     []int32     // indexes of deleted nodes, for reuse
+	ids      map[string]int32
+	entry    int32 // -1 if the index is empty
+	maxLevel int
+}
+
+type hnswNode struct {
+	id     string
+	vector []float32 // normalized
+	links  [][]int32 // neighbours, per layer
+	in     [][]int32 // nodes that have this one as a neighbour, per layer
+}
+
+func newHNSWIndex(cfg hnswConfig) *hnswIndex {
+	return &hnswIndex{
+		cfg:       cfg,
+		levelMult: 1 / math.Log(float64(max(cfg.M, 2))),
+		rng:       rand.New(rand.NewPCG(1, 2)),
+		ids:       make(map[string]int32),
+		entry:     -1,
+	}
+}
+
+// len returns the number of vectors in the index.
+func (h *hnswIndex) len() int { return len(h.ids) }
+
+// maxLinks returns the most neighbours a node may have on the given layer.
+func (h *hnswIndex) maxLinks(level int) int {
+	if level == 0 {
+		return 2 * h.cfg.M
+	}
+	return h.cfg.M
+}
+
+// vector returns the normalized vector stored under id, or nil.
+func (h *hnswIndex) vector(id string) []float32 {
+	n, ok := h.ids[id]
+	if !ok {
+		return nil
+	}
+	return h.nodes[n].vector
+}
+
+// add adds vector to the index under id, replacing any vector already
+// stored under it.
+func (h *hnswIndex) add(id string, vector []float32) {
+	if _, ok := h.ids[id]; ok {
+		h.delete(id)
+	}
+
+	level := int(-math.Log(1-h.rng.Float64()) * h.levelMult)
+	node := &hnswNode{
+		id:     id,
+		vector: normalize(vector),
+		links:  make([][]int32, level+1),
+		in:     make([][]int32, level+1),
+	}
+	var n int32
+	if len(h.free) > 0 {
+		// No links lead to a deleted node, so its slot can be reused.
+		n = h.free[len(h.free)-1]
+		h.free = h.free[:len(h.free)-1]
+		h.nodes[n] = node
+	} else {
+		n = int32(len(h.nodes))
+		h.nodes = append(h.nodes, node)
+	}
+	h.ids[id] = n
+
+	if h.entry < 0 {
+		h.entry, h.maxLevel = n, level
+		return
+	}
+
+	ep := h.entry
+	for l := h.maxLevel; l > level; l-- {
+		ep = h.greedy(node.vector, ep, l)
+	}
+	eps := []hnswCandidate{{ep, h.dist(node.vector, ep)}}
+	for l := min(level, h.maxLevel); l >= 0; l-- {
+		found := h.searchLayer(node.vector, eps, h.cfg.EfConstruction, l)
+		h.setLinks(n, l, h.selectNeighbours(node.vector, found, h.cfg.M))
+		for _, nb := range node.links[l] {
+			h.link(nb, n, l)
+		}
+		eps = found
+	}
+	if level > h.maxLevel {
+		h.entry, h.maxLevel = n, level
+	}
+}
+
+// link adds a link from node from to node to on the given layer, pruning
+// from's links if it has too many.
+func (h *hnswIndex) link(from, to int32, level int) {
+	f := h.nodes[from]
+	links := append(slices.Clone(f.links[level]), to)
+	if len(links) > h.maxLinks(level) {
+		cands := make([]hnswCandidate, len(links))
+		for i, nb := range links {
+			cands[i] = hnswCandidate{nb, h.dist(f.vector, nb)}
+		}
+		links = h.selectNeighbours(f.vector, cands, h.maxLinks(level))
+	}
+	h.setLinks(from, level, links)
+}
+
+// setLinks sets the neighbours of node n on the given layer, keeping track
+// of the links into the nodes it adds and drops.
+func (h *hnswIndex) setLinks(n int32, level int, links []int32) {
+	node := h.nodes[n]
+	for _, old := range node.links[level] {
+		if !slices.Contains(links, old) {
+			in := h.nodes[old].in[level]
+			i := slices.Index(in, n)
+			in[i] = in[len(in)-1]
+			h.nodes[old].in[level] = in[:len(in)-1]
+		}
+	}
+	for _, nb := range links {
+		if !slices.Contains(node.links[level], nb) {
+			h.nodes[nb].in[level] = append(h.nodes[nb].in[level], n)
+		}
+	}
+	node.links[level] = links
+}
+
+// delete removes the vector stored under id, if any. The nodes linked to or
+// from the removed node are relinked among its neighbours, so the graph
+// stays connected and no link leads to the removed node.
+func (h *hnswIndex) delete(id string) {
+	n, ok := h.ids[id]
+	if !ok {
+		return
+	}
+	node := h.nodes[n]
+	delete(h.ids, id)
+	if h.entry == n {
+		h.replaceEntry(n)
+	}
+
+	for l := range node.links {
+		outs := node.links[l]
+		affected := slices.Concat(outs, node.in[l])
+		h.setLinks(n, l, nil)
+		seen := map[int32]bool{n: true}
+		for _, a := range affected {
+			if seen[a] {
+				continue
+			}
+			seen[a] = true
+			// Consider a's remaining links plus the removed node's
+			// neighbours.
+			aNode := h.nodes[a]
+			var cands []hnswCandidate
+			candSeen := map[int32]bool{a: true, n: true}
+			for _, c := range slices.Concat(aNode.links[l], outs) {
+				if candSeen[c] {
+					continue
+				}
+				candSeen[c] = true
+				cands = append(cands, hnswCandidate{c, h.dist(aNode.vector, c)})
+			}
+			h.setLinks(a, l, h.selectNeighbours(aNode.vector, cands, h.maxLinks(l)))
+		}
+	}
+	h.nodes[n] = nil
+	h.free = append(h.free, n)
+}
+
+// replaceEntry picks a new entry point when the current one, n, is about to
+// be deleted: the node on the highest layer among those n is linked with on
+// its highest layer that has any links.
+func (h *hnswIndex) replaceEntry(n int32) {
+	old := h.nodes[n]
+	h.entry, h.maxLevel = -1, 0
+	for l := len(old.links) - 1; l >= 0 && h.entry < 0; l-- {
+		for _, c := range slices.Concat(old.links[l], old.in[l]) {
+			if h.entry < 0 || len(h.nodes[c].links)-1 > h.maxLevel {
+				h.entry, h.maxLevel = c, len(h.nodes[c].links)-1
+			}
+		}
+	}
+	if h.entry >= 0 || len(h.ids) == 0 {
+		return
+	}
+	// The entry point had no links at all, which only happens if it's the
+	// only node or the graph fell apart; look at every node.
+	for i, nd := range h.nodes {
+		if nd != nil && int32(i) != n && (h.entry < 0 || len(nd.links)-1 > h.maxLevel) {
+			h.entry, h.maxLevel = int32(i), len(nd.links)-1
+		}
+	}
+}
+
+// search returns the IDs of the (approximately) k vectors closest to query,
+// closest first, and their distances from it.
+func (h *hnswIndex) search(query []float32, k int) (ids []string, dists []float32) {
+	if h.entry < 0 || k <= 0 {
+		return nil, nil
+	}
+	q := normalize(query)
+	ep := h.entry
+	for l := h.maxLevel; l > 0; l-- {
+		ep = h.greedy(q, ep, l)
+	}
+	found := h.searchLayer(q, []hnswCandidate{{ep, h.dist(q, ep)}}, max(h.cfg.EfSearch, k), 0)
+	found = found[:min(k, len(found))]
+	ids = make([]string, len(found))
+	dists = make([]float32, len(found))
+	for i, c := range found {
+		ids[i], dists[i] = h.nodes[c.node].id, c.dist
+	}
+	return ids, dists
+}
+
+// greedy walks from ep towards q on the given layer until no neighbour is
+// closer, and returns the node it stops at.
+func (h *hnswIndex) greedy(q []float32, ep int32, level int) int32 {
+	best := h.dist(q, ep)
+	for changed := true; changed; {
+		changed = false
+		for _, nb := range h.nodes[ep].links[level] {
+			if h.nodes[nb] == nil {
+				continue
+			}
+			if d := h.dist(q, nb); d < best {
+				ep, best, changed = nb, d, true
+			}
+		}
+	}
+	return ep
+}
+
+// searchLayer does a beam search for q on the given layer starting from
+// eps, and returns up to ef closest nodes found, closest first.
+func (h *hnswIndex) searchLayer(q []float32, eps []hnswCandidate, ef, level int) []hnswCandidate {
+	visited := make(map[int32]bool, ef*4)
+	cands := &candidateHeap{}            // closest first
+	results := &candidateHeap{max: true} // farthest first
+	for _, ep := range eps {
+		visited[ep.node] = true
+		heap.Push(cands, ep)
+		heap.Push(results, ep)
+		if results.Len() > ef {
+			heap.Pop(results)
+		}
+	}
+
+	for cands.Len() > 0 {
+		c := heap.Pop(cands).(hnswCandidate)
+		if results.Len() >= ef && c.dist > results.items[0].dist {
+			break
+		}
+		for _, nb := range h.nodes[c.node].links[level] {
+			if visited[nb] || h.nodes[nb] == nil {
+				continue
+			}
+			visited[nb] = true
+			d := h.dist(q, nb)
+			if results.Len() < ef || d < results.items[0].dist {
+				heap.Push(cands, hnswCandidate{nb, d})
+				heap.Push(results, hnswCandidate{nb, d})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	out := results.items
+	slices.SortFunc(out, func(a, b hnswCandidate) int { return cmp.Compare(a.dist, b.dist) })
+	return out
+}
+
+// selectNeighbours picks up to m of cands to link a node at q to. It uses
+// the paper's heuristic: a candidate is preferred if it's closer to q than
+// to any candidate already picked, which keeps links pointing in diverse
+// directions. Remaining slots are filled with the closest other candidates.
+func (h *hnswIndex) selectNeighbours(q []float32, cands []hnswCandidate, m int) []int32 {
+	cands = slices.Clone(cands)
+	slices.SortFunc(cands, func(a, b hnswCandidate) int { return cmp.Compare(a.dist, b.dist) })
+
+	picked := make([]int32, 0, m)
+	var skipped []int32
+	for _, c := range cands {
+		if len(picked) == m {
+			break
+		}
+		good := true
+		for _, p := range picked {
+			if h.dist(h.nodes[c.node].vector, p) < c.dist {
+				good = false
+				break
+			}
+		}
+		if good {
+			picked = append(picked, c.node)
+		} else {
+			skipped = append(skipped, c.node)
+		}
+	}
+	for _, s := range skipped {
+		if len(picked) == m {
+			break
+		}
+		picked = append(picked, s)
+	}
+	return picked
+}
+
+// dist returns the distance between the normalized vector q and node n.
+func (h *hnswIndex) dist(q []float32, n int32) float32 {
+	v := h.nodes[n].vector
+	if len(v) != len(q) {
+		return 2
+	}
+	var dot float32
+	for i := range q {
+		dot += q[i] * v[i]
+	}
+	return 1 - dot
+}
+
+func normalize(v []float32) []float32 {
+	out := make([]float32, len(v))
+	n := norm(v)
+	if n == 0 {
+		return out
+	}
+	for i, x := range v {
+		out[i] = float32(float64(x) / n)
+	}
+	return out
+}
+
+type hnswCandidate struct {
+	node int32
+	dist float32
+}
+
+// candidateHeap is a heap of candidates, closest first, or farthest first
+// if max is set.
+type candidateHeap struct {
+	items []hnswCandidate
+	max   bool
+}
+
+func (c *candidateHeap) Len() int { return len(c.items) }
+func (c *candidateHeap) Less(i, j int) bool {
+	if c.max {
+		return c.items[i].dist > c.items[j].dist
+	}
+	return c.items[i].dist < c.items[j].dist
+}
+func (c *candidateHeap) Swap(i, j int) { c.items[i], c.items[j] = c.items[j], c.items[i] }
+func (c *candidateHeap) Push(x any)    { c.items = append(c.items, x.(hnswCandidate)) }
+func (c *candidateHeap) Pop() any {
+	x := c.items[len(c.items)-1]
+	c.items = c.items[:len(c.items)-1]
+	return x
+}
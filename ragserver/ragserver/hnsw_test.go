@@ -0,0 +1,217 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// syntheticVectors returns n random vectors with dim dimensions, clustered
+// around a few centres the way real embeddings tend to be.
+func syntheticVectors(rng *rand.Rand, n, dim int) [][]float32 {
+	centres := make([][]float32, 32)
+	for i := range centres {
+		centres[i] = make([]float32, dim)
+		for j := range centres[i] {
+			centres[i][j] = float32(rng.NormFloat64())
+		}
+	}
+	vectors := make([][]float32, n)
+	for i := range vectors {
+		c := centres[rng.IntN(len(centres))]
+		vectors[i] = make([]float32, dim)
+		for j := range vectors[i] {
+			vectors[i][j] = c[j] + 0.5*float32(rng.NormFloat64())
+		}
+	}
+	return vectors
+}
+
+// bruteForce returns the indices of the k vectors with the highest cosine
+// similarity to q.
+func bruteForce(vectors [][]float32, q []float32, k int) []int {
+	type hit struct {
+		i     int
+		score float64
+	}
+	qnorm := norm(q)
+	hits := make([]hit, len(vectors))
+	for i, v := range vectors {
+		hits[i] = hit{i, cosine(q, qnorm, v, norm(v))}
+	}
+	slices.SortFunc(hits, func(a, b hit) int { return cmp.Compare(b.score, a.score) })
+	out := make([]int, k)
+	for i := range out {
+		out[i] = hits[i].i
+	}
+	return out
+}
+
+func buildIndex(cfg hnswConfig, vectors [][]float32) *hnswIndex {
+	h := newHNSWIndex(cfg)
+	for i, v := range vectors {
+		h.add(fmt.Sprint(i), v)
+	}
+	return h
+}
+
+// recall returns the fraction of the true k nearest neighbours of queries
+// that h finds.
+func recall(h *hnswIndex, vectors, queries [][]float32, k int) float64 {
+	found := 0
+	for _, q := range queries {
+		got := make(map[string]bool)
+		ids, _ := h.search(q, k)
+		for _, id := range ids {
+			got[id] = true
+		}
+		for _, i := range bruteForce(vectors, q, k) {
+			if got[fmt.Sprint(i)] {
+				found++
+			}
+		}
+	}
+	return float64(found) / float64(len(queries)*k)
+}
+
+func TestHNSWRecall(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 1))
+	all := syntheticVectors(rng, 2050, 32)
+	vectors, queries := all[:2000], all[2000:]
+	h := buildIndex(defaultHNSWConfig, vectors)
+	if h.len() != len(vectors) {
+		t.Fatalf("len = %d, want %d", h.len(), len(vectors))
+	}
+	if r := recall(h, vectors, queries, 10); r < 0.9 {
+		t.Errorf("recall@10 = %.3f, want at least 0.9", r)
+	}
+}
+
+func TestHNSWDelete(t *testing.T) {
+	rng := rand.New(rand.NewPCG(2, 2))
+	all := syntheticVectors(rng, 1050, 16)
+	vectors, queries := all[:1000], all[1000:]
+	h := buildIndex(defaultHNSWConfig, vectors)
+
+	// Delete half the vectors, including the entry point.
+	h.delete(h.nodes[h.entry].id)
+	for i := 0; i < len(vectors); i += 2 {
+		h.delete(fmt.Sprint(i))
+	}
+	var kept [][]float32
+	keptIDs := make(map[string]int)
+	for i := 1; i < len(vectors); i += 2 {
+		if _, ok := h.ids[fmt.Sprint(i)]; ok {
+			keptIDs[fmt.Sprint(i)] = len(kept)
+			kept = append(kept, vectors[i])
+		}
+	}
+	if h.len() != len(kept) {
+		t.Fatalf("len = %d after deletions, want %d", h.len(), len(kept))
+	}
+	checkGraph(t, h)
+
+	found, total := 0, 0
+	for _, q := range queries {
+		want := make(map[int]bool)
+		for _, i := range bruteForce(kept, q, 10) {
+			want[i] = true
+		}
+		ids, _ := h.search(q, 10)
+		for _, id := range ids {
+			i, ok := keptIDs[id]
+			if !ok {
+				t.Fatalf("search returned deleted vector %s", id)
+			}
+			if want[i] {
+				found++
+			}
+		}
+		total += 10
+	}
+	if r := float64(found) / float64(total); r < 0.9 {
+		t.Errorf("recall@10 after deletions = %.3f, want at least 0.9", r)
+	}
+
+	// Replacing a vector moves it, reusing the slots of deleted nodes.
+	size := len(h.nodes)
+	for i := 0; i < 100; i++ {
+		h.add("1", vectors[i])
+	}
+	h.add("1", vectors[2])
+	if got, _ := h.search(vectors[2], 1); len(got) != 1 || got[0] != "1" {
+		t.Errorf("search for replaced vector = %v, want [1]", got)
+	}
+	if len(h.nodes) != size {
+		t.Errorf("index has %d node slots after replacing a vector, want %d", len(h.nodes), size)
+	}
+	checkGraph(t, h)
+}
+
+// checkGraph checks that h's links only lead to live nodes, that the links
+// into each node are recorded, and that the entry point is on the top layer.
+func checkGraph(t *testing.T, h *hnswIndex) {
+	t.Helper()
+	for i, node := range h.nodes {
+		if node == nil {
+			continue
+		}
+		n := int32(i)
+		for l := range node.links {
+			for _, nb := range node.links[l] {
+				if h.nodes[nb] == nil {
+					t.Fatalf("node %s links to deleted node %d on layer %d", node.id, nb, l)
+				}
+				if !slices.Contains(h.nodes[nb].in[l], n) {
+					t.Fatalf("link from %s to %s on layer %d isn't recorded", node.id, h.nodes[nb].id, l)
+				}
+			}
+			for _, src := range node.in[l] {
+				if h.nodes[src] == nil || !slices.Contains(h.nodes[src].links[l], n) {
+					t.Fatalf("node %s has a stale link into it from %d on layer %d", node.id, src, l)
+				}
+			}
+		}
+	}
+	if h.entry < 0 || h.nodes[h.entry] == nil || len(h.nodes[h.entry].links)-1 != h.maxLevel {
+		t.Fatalf("entry point %d isn't a live node on layer %d", h.entry, h.maxLevel)
+	}
+}
+
+// The benchmarks compare query latency of the index with a brute-force scan,
+// and report the index's recall. Run them with
+//
+//	go test -run=NONE -bench=Search
+func BenchmarkBruteForceSearch(b *testing.B) {
+	rng := rand.New(rand.NewPCG(3, 3))
+	all := syntheticVectors(rng, 20100, 128)
+	vectors, queries := all[:20000], all[20000:]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bruteForce(vectors, queries[i%len(queries)], 10)
+	}
+}
+
+func BenchmarkHNSWSearch(b *testing.B) {
+	rng := rand.New(rand.NewPCG(3, 3))
+	all := syntheticVectors(rng, 20100, 128)
+	vectors, queries := all[:20000], all[20000:]
+	h := buildIndex(defaultHNSWConfig, vectors)
+	b.ResetTimer()
+	for _, ef := range []int{16, 64, 256} {
+		b.Run(fmt.Sprintf("efSearch=%d", ef), func(b *testing.B) {
+			h.cfg.EfSearch = ef
+			for i := 0; i < b.N; i++ {
+				h.search(queries[i%len(queries)], 10)
+			}
+			b.StopTimer()
+			b.ReportMetric(recall(h, vectors, queries, 10), "recall@10")
+		})
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Tests of the HTTP API against a fake Weaviate and a fake generative
+// model, so that they run without Docker or API keys.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeModel is a stand-in for a server implementing the OpenAI chat
+// completions API. It answers with the context it's given, one document
+// per line joined with " | ".
+type fakeModel struct {
+	mu     sync.Mutex
+	status int // if not 0, requests fail with this status
+}
+
+func newFakeModel(t *testing.T) (*fakeModel, string) {
+	fm := &fakeModel{}
+	srv := httptest.NewServer(http.HandlerFunc(fm.chatCompletions))
+	t.Cleanup(srv.Close)
+	return fm, srv.URL + "/v1"
+}
+
+func (fm *fakeModel) setStatus(status int) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.status = status
+}
+
+func (fm *fakeModel) chatCompletions(w http.ResponseWriter, req *http.Request) {
+	var cr chatCompletionRequest
+	if err := json.NewDecoder(req.Body).Decode(&cr); err != nil || len(cr.Messages) == 0 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	prompt := string(cr.Messages[len(cr.Messages)-1].Content)
+	fm.mu.Lock()
+	status := fm.status
+	fm.mu.Unlock()
+	if status != 0 {
+		http.Error(w, "injected failure", status)
+		return
+	}
+
+	_, context, _ := strings.Cut(prompt, "Context:\n")
+	answer := strings.Join(strings.Split(strings.TrimSpace(context), "\n"), " | ")
+	stop := "stop"
+	if !cr.Stream {
+		writeJSON(w, chatCompletion{
+			Object:  "chat.completion",
+			Model:   cr.Model,
+			Choices: []chatChoice{{Message: &chatMessage{Role: "assistant", Content: chatContent(answer)}, FinishReason: &stop}},
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, word := range strings.SplitAfter(answer, " ") {
+		js, _ := json.Marshal(chatCompletion{Object: "chat.completion.chunk", Choices: []chatChoice{{Delta: &chatMessage{Content: chatContent(word)}}}})
+		fmt.Fprintf(w, "data: %s\n\n", js)
+	}
+	js, _ := json.Marshal(chatCompletion{Object: "chat.completion.chunk", Choices: []chatChoice{{Delta: &chatMessage{}, FinishReason: &stop}}})
+	fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", js)
+}
+
+// testServer is a ragserver serving its HTTP API on a test listener.
+type testServer struct {
+	*ragServer
+	url   string
+	fw    *fakeWeaviate
+	model *fakeModel
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	ctx := context.Background()
+	fw := newFakeWeaviate(t)
+	store, err := initWeaviate(ctx, fw.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model, baseURL := newFakeModel(t)
+	rs := &ragServer{
+		ctx:             ctx,
+		store:           store,
+		gen:             newFallbackGenerator(&openAIGenerator{model: "fake", baseURL: baseURL, client: http.DefaultClient}),
+		newEmbedder:     func(string) embedder { return letterEmbedder{} },
+		cache:           newLRUCache[queryKey, *queryResult](100, time.Hour),
+		maxOutputTokens: 1024,
+		dedupPolicy:     dedupSkip,
+	}
+	rs.gen.sleep = noSleep
+	rs.jobs = newJobQueue(rs.ingest, 2, time.Hour)
+	rs.coll, err = activeCollection(ctx, store, "letters", letterEmbedder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(rs.routes())
+	t.Cleanup(srv.Close)
+	return &testServer{ragServer: rs, url: srv.URL, fw: fw, model: model}
+}
+
+// do sends a request with the given JSON body (none if it's "") and returns
+// the response, with its body read.
+func (ts *testServer) do(t *testing.T, method, path, body string) (*http.Response, string) {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, ts.url+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+// mustDo is like do, but fails the test unless the response has status
+// want.
+func (ts *testServer) mustDo(t *testing.T, want int, method, path, body string) (*http.Response, string) {
+	t.Helper()
+	resp, respBody := ts.do(t, method, path, body)
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: status %d, want %d: %s", method, path, resp.StatusCode, want, respBody)
+	}
+	return resp, respBody
+}
+
+func TestServerAddAndQuery(t *testing.T) {
+	ts := newTestServer(t)
+	_, body := ts.mustDo(t, http.StatusOK, "POST", "/add/",
+		`{"documents": [{"text": "aaaa"}, {"text": "bbbb"}, {"text": "cccc"}, {"text": "xyzzy"}]}`)
+	var res ingestResult
+	if err := json.Unmarshal([]byte(body), &res); err != nil || res != (ingestResult{Stored: 4}) {
+		t.Fatalf("add response %s", body)
+	}
+	if n := ts.fw.count(ts.coll.Class); n != 4 {
+		t.Errorf("%d objects in weaviate, want 4", n)
+	}
+
+	// The answer is the retrieved context, closest document first.
+	resp, body := ts.mustDo(t, http.StatusOK, "POST", "/query/", `{"content": "aaab"}`)
+	var answer string
+	if err := json.Unmarshal([]byte(body), &answer); err != nil || !strings.HasPrefix(answer, "aaaa | ") {
+		t.Errorf("answer %s, want the context starting with aaaa", body)
+	}
+	if got := resp.Header.Get("X-Cache"); got != "miss" {
+		t.Errorf("X-Cache = %q, want miss", got)
+	}
+	resp, _ = ts.mustDo(t, http.StatusOK, "POST", "/query/", `{"content": "  AAAB "}`)
+	if got := resp.Header.Get("X-Cache"); got != "hit" {
+		t.Errorf("X-Cache of repeated question = %q, want hit", got)
+	}
+
+	_, body = ts.mustDo(t, http.StatusOK, "POST", "/query/", `{"content": "xyz", "detailed": true}`)
+	var qr queryResponse
+	if err := json.Unmarshal([]byte(body), &qr); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(qr.Answer, "xyzzy") || qr.FinishReason != "stop" || !strings.HasPrefix(qr.Generator, "openai:fake@") {
+		t.Errorf("detailed response = %+v", qr)
+	}
+
+	// Adding a document again skips it, and empties the cache.
+	_, body = ts.mustDo(t, http.StatusOK, "POST", "/add/", `{"documents": [{"text": "aaaa"}, {"text": "dddd"}]}`)
+	if err := json.Unmarshal([]byte(body), &res); err != nil || res != (ingestResult{Stored: 1, Skipped: 1}) {
+		t.Errorf("add response %s, want 1 stored and 1 skipped", body)
+	}
+	resp, _ = ts.mustDo(t, http.StatusOK, "POST", "/query/", `{"content": "aaab"}`)
+	if got := resp.Header.Get("X-Cache"); got != "miss" {
+		t.Errorf("X-Cache after adding documents = %q, want miss", got)
+	}
+
+	// Adding only duplicates stores nothing, and keeps the cache.
+	ts.mustDo(t, http.StatusOK, "POST", "/add/", `{"documents": [{"text": "dddd"}]}`)
+	resp, _ = ts.mustDo(t, http.StatusOK, "POST", "/query/", `{"content": "aaab"}`)
+	if got := resp.Header.Get("X-Cache"); got != "hit" {
+		t.Errorf("X-Cache after adding a duplicate = %q, want hit", got)
+	}
+}
+
+func TestServerChatCompletions(t *testing.T) {
+	ts := newTestServer(t)
+	ts.mustDo(t, http.StatusOK, "POST", "/add/", `{"documents": [{"text": "aaaa"}, {"text": "bbbb"}]}`)
+
+	const req = `{"model": "x", "messages": [{"role": "system", "content": "be brief"}, {"role": "user", "content": "bbbb?"}]`
+	_, body := ts.mustDo(t, http.StatusOK, "POST", "/v1/chat/completions", req+`}`)
+	var completion chatCompletion
+	if err := json.Unmarshal([]byte(body), &completion); err != nil {
+		t.Fatal(err)
+	}
+	if len(completion.Choices) != 1 || !strings.HasPrefix(string(completion.Choices[0].Message.Content), "bbbb | ") {
+		t.Errorf("completion = %s", body)
+	}
+
+	resp, body := ts.mustDo(t, http.StatusOK, "POST", "/v1/chat/completions", req+`, "stream": true}`)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var streamed strings.Builder
+	var done bool
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+		var chunk chatCompletion
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatal(err)
+		}
+		if d := chunk.Choices[0].Delta; d != nil {
+			streamed.WriteString(string(d.Content))
+		}
+	}
+	if !done || streamed.String() != string(completion.Choices[0].Message.Content) {
+		t.Errorf("streamed %q (done: %v), want %q", streamed.String(), done, completion.Choices[0].Message.Content)
+	}
+}
+
+func TestServerAsyncAdd(t *testing.T) {
+	ts := newTestServer(t)
+	resp, body := ts.mustDo(t, http.StatusAccepted, "POST", "/add/",
+		`{"documents": [{"text": "aaaa"}, {"text": "bbbb"}, {"text": "aaaa"}], "async": true}`)
+	loc := resp.Header.Get("Location")
+	if !strings.HasPrefix(loc, "/jobs/") {
+		t.Fatalf("Location = %q; response %s", loc, body)
+	}
+
+	var st jobStatus
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		_, body := ts.mustDo(t, http.StatusOK, "GET", loc, "")
+		if err := json.Unmarshal([]byte(body), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.State == "done" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job not done: %s", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st.Total != 3 || st.Done != 3 || st.Stored != 2 || st.Skipped != 1 || st.Failed != 0 {
+		t.Errorf("job status = %+v", st)
+	}
+
+	ts.mustDo(t, http.StatusNotFound, "GET", "/jobs/nosuchjob", "")
+}
+
+func TestServerErrors(t *testing.T) {
+	ts := newTestServer(t)
+	ts.mustDo(t, http.StatusOK, "POST", "/add/", `{"documents": [{"text": "aaaa"}]}`)
+
+	tests := []struct {
+		name       string
+		setup      func()
+		method     string
+		path, body string
+		want       int
+	}{
+		{name: "bad JSON", method: "POST", path: "/add/", body: `{"documents": [`, want: http.StatusBadRequest},
+		{name: "unknown field", method: "POST", path: "/query/", body: `{"question": "aaaa"}`, want: http.StatusBadRequest},
+		{name: "bad dedup policy", method: "POST", path: "/add/", body: `{"documents": [], "dedup": "merge"}`, want: http.StatusBadRequest},
+		{name: "bad temperature", method: "POST", path: "/query/", body: `{"content": "aaaa", "temperature": 5}`, want: http.StatusBadRequest},
+		{name: "bad rewrite mode", method: "POST", path: "/query/", body: `{"content": "aaaa", "rewrite": "more"}`, want: http.StatusBadRequest},
+		{name: "wrong method", method: "GET", path: "/query/", want: http.StatusMethodNotAllowed},
+		{name: "chat without user message", method: "POST", path: "/v1/chat/completions",
+			body: `{"messages": [{"role": "system", "content": "hi"}]}`, want: http.StatusBadRequest},
+		{
+			name:   "weaviate batch fails",
+			setup:  func() { ts.fw.setFailPath("/v1/batch/") },
+			method: "POST", path: "/add/", body: `{"documents": [{"text": "bbbb"}]}`,
+			want: http.StatusInternalServerError,
+		},
+		{
+			name:   "weaviate search fails",
+			setup:  func() { ts.fw.setFailPath("/v1/graphql") },
+			method: "POST", path: "/query/", body: `{"content": "aaaa?"}`,
+			want: http.StatusInternalServerError,
+		},
+		{
+			name:   "model unavailable",
+			setup:  func() { ts.model.setStatus(http.StatusServiceUnavailable) },
+			method: "POST", path: "/query/", body: `{"content": "aaaa??"}`,
+			want: http.StatusInternalServerError,
+		},
+		{
+			name:   "model rejects request",
+			setup:  func() { ts.model.setStatus(http.StatusBadRequest) },
+			method: "POST", path: "/v1/chat/completions", body: `{"messages": [{"role": "user", "content": "aaaa"}]}`,
+			want: http.StatusInternalServerError,
+		},
+		{
+			// Last, since the class isn't restored.
+			name:   "weaviate rejects objects",
+			setup:  func() { ts.fw.dropClass(ts.coll.Class) },
+			method: "POST", path: "/add/", body: `{"documents": [{"text": "bbbb"}], "dedup": "keep"}`,
+			want: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup()
+				t.Cleanup(func() {
+					ts.fw.setFailPath("")
+					ts.model.setStatus(0)
+				})
+			}
+			resp, body := ts.do(t, tt.method, tt.path, tt.body)
+			if resp.StatusCode != tt.want {
+				t.Errorf("status %d, want %d: %s", resp.StatusCode, tt.want, body)
+			}
+		})
+	}
+}
+
+func TestServerConcurrency(t *testing.T) {
+	ts := newTestServer(t)
+	ts.mustDo(t, http.StatusOK, "POST", "/add/", `{"documents": [{"text": "seed"}]}`)
+
+	const clients, docsPerClient = 8, 5
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*clients*docsPerClient)
+	for c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range docsPerClient {
+				// Distinct letters make distinct documents.
+				text := strings.Repeat(string(rune('a'+c)), i+1) + string(rune('k'+i))
+				for _, r := range []struct{ path, body string }{
+					{"/add/", fmt.Sprintf(`{"documents": [{"text": %q}]}`, text)},
+					{"/query/", fmt.Sprintf(`{"content": %q}`, text)},
+				} {
+					resp, err := http.Post(ts.url+r.path, "application/json", strings.NewReader(r.body))
+					if err != nil {
+						errs <- err
+						continue
+					}
+					b, _ := io.ReadAll(resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						errs <- fmt.Errorf("%s %s: status %d: %s", r.path, r.body, resp.StatusCode, b)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := ts.fw.count(ts.coll.Class); n != 1+clients*docsPerClient {
+		t.Errorf("%d documents stored, want %d", n, 1+clients*docsPerClient)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Asynchronous ingestion.
+//
+// An /add/ request with "async": true is split into batches that are queued
+// for a fixed pool of workers, and answered right away with a job ID. The job
+// can be polled at /jobs/{id} until it finishes, and for a retention period
+// afterwards.
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// ingestBatchSize is the number of documents a worker embeds and stores
+	// at a time.
+	ingestBatchSize = 50
+
+	// ingestQueueSize is the maximum number of batches waiting for a worker.
+	ingestQueueSize = 1000
+)
+
+var errQueueFull = errors.New("ingest queue is full, try again later")
+
+// jobQueue runs ingestion jobs on a bounded pool of workers and remembers
+// them until they've been finished for longer than retention.
+type jobQueue struct {
+	ingest    func(texts []string, policy dedupPolicy) (ingestResult, error)
+	retention time.Duration
+	tasks     chan ingestTask
+	stopping  chan struct{} // closed by stop
+	workers   sync.WaitGroup
+
+	mu   sync.Mutex // protects jobs, and serializes sends on tasks
+	jobs map[string]*ingestJob
+}
+
+// ingestTask is a batch of documents belonging to a job.
+type ingestTask struct {
+	job    *ingestJob
+	start  int // index of texts[0] among the job's documents
+	texts  []string
+	policy dedupPolicy
+}
+
+// newJobQueue returns a jobQueue whose workers store documents with ingest.
+func newJobQueue(ingest func(texts []string, policy dedupPolicy) (ingestResult, error), workers int, retention time.Duration) *jobQueue {
+	q := &jobQueue{
+		ingest:    ingest,
+		retention: retention,
+		tasks:     make(chan ingestTask, ingestQueueSize),
+		stopping:  make(chan struct{}),
+		jobs:      make(map[string]*ingestJob),
+	}
+	q.workers.Add(workers)
+	for range workers {
+		go q.work()
+	}
+	return q
+}
+
+// stop waits for the workers to finish the batches they're ingesting and
+// stops them. Batches still queued are never ingested.
+func (q *jobQueue) stop() {
+	close(q.stopping)
+	q.workers.Wait()
+}
+
+// submit queues texts for ingestion and returns the new job. It returns
+// errQueueFull rather than blocking if the queue can't take all of the job's
+// batches.
+func (q *jobQueue) submit(texts []string, policy dedupPolicy) (*ingestJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
+
+	batches := (len(texts) + ingestBatchSize - 1) / ingestBatchSize
+	if len(q.tasks)+batches > cap(q.tasks) {
+		return nil, errQueueFull
+	}
+
+	job := &ingestJob{
+		id:      uuid.NewString(),
+		total:   len(texts),
+		pending: batches,
+		created: time.Now(),
+	}
+	if batches == 0 {
+		job.finished = job.created
+	}
+	q.jobs[job.id] = job
+	for start := 0; start < len(texts); start += ingestBatchSize {
+		end := min(start+ingestBatchSize, len(texts))
+		q.tasks <- ingestTask{job: job, start: start, texts: texts[start:end], policy: policy}
+	}
+	return job, nil
+}
+
+// get returns the job with the given ID, or nil if there's no such job or it
+// has expired.
+func (q *jobQueue) get(id string) *ingestJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
+	return q.jobs[id]
+}
+
+// prune forgets jobs that finished more than q.retention ago.
+// q.mu must be held.
+func (q *jobQueue) prune() {
+	cutoff := time.Now().Add(-q.retention)
+	for id, job := range q.jobs {
+		if f := job.finishedAt(); !f.IsZero() && f.Before(cutoff) {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+func (q *jobQueue) work() {
+	defer q.workers.Done()
+	for {
+		// Don't start another batch once stopping, even if one is queued.
+		select {
+		case <-q.stopping:
+			return
+		default:
+		}
+		select {
+		case <-q.stopping:
+			return
+		case task := <-q.tasks:
+			q.run(task)
+		}
+	}
+}
+
+// run ingests a batch.
+func (q *jobQueue) run(task ingestTask) {
+	task.job.begin()
+	res, err := q.ingest(task.texts, task.policy)
+	if err != nil && len(task.texts) > 1 {
+		// Retry one document at a time to find out which ones are at
+		// fault. A failed ingest stores nothing, so none of them is
+		// mistaken for a duplicate of itself.
+		for i, text := range task.texts {
+			res, err := q.ingest([]string{text}, task.policy)
+			task.job.record(task.start+i, res, err)
+		}
+	} else {
+		for i := range task.texts {
+			task.job.record(task.start+i, ingestResult{}, err)
+		}
+		task.job.count(res)
+	}
+	task.job.batchDone()
+}
+
+// ingestJob tracks the progress of an asynchronous ingestion.
+type ingestJob struct {
+	id      string
+	total   int
+	created time.Time
+
+	mu       sync.Mutex // protects the fields below
+	pending  int        // batches not processed yet
+	done     int        // documents processed, successfully or not
+	result   ingestResult
+	errors   []documentError
+	started  time.Time
+	finished time.Time
+}
+
+// documentError reports that the document at Index in the request couldn't be
+// ingested.
+type documentError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+func (j *ingestJob) begin() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.started.IsZero() {
+		j.started = time.Now()
+	}
+}
+
+// record records that the document at index has been processed, with the
+// given result.
+func (j *ingestJob) record(index int, res ingestResult, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done++
+	j.result.add(res)
+	if err != nil {
+		j.errors = append(j.errors, documentError{Index: index, Error: err.Error()})
+	}
+}
+
+// count adds res to the job's result.
+func (j *ingestJob) count(res ingestResult) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.result.add(res)
+}
+
+func (j *ingestJob) batchDone() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.pending--
+	if j.pending == 0 {
+		j.finished = time.Now()
+	}
+}
+
+func (j *ingestJob) finishedAt() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.finished
+}
+
+// jobStatus is the JSON representation of an ingestJob.
+type jobStatus struct {
+	ID       string          `json:"id"`
+	State    string          `json:"state"` // "queued", "running" or "done"
+	Total    int             `json:"total"`
+	Done     int             `json:"done"`
+	Failed   int             `json:"failed"`
+	Stored   int             `json:"stored"`
+	Skipped  int             `json:"skipped"`  // duplicates not stored
+	Replaced int             `json:"replaced"` // stored documents that replaced a duplicate
+	Errors   []documentError `json:"errors,omitempty"`
+	Created  time.Time       `json:"created"`
+	Started  *time.Time      `json:"started,omitempty"`
+	Finished *time.Time      `json:"finished,omitempty"`
+}
+
+func (j *ingestJob) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st := jobStatus{
+		ID:       j.id,
+		State:    "queued",
+		Total:    j.total,
+		Done:     j.done,
+		Failed:   len(j.errors),
+		Stored:   j.result.Stored,
+		Skipped:  j.result.Skipped,
+		Replaced: j.result.Replaced,
+		Errors:   append([]documentError(nil), j.errors...),
+		Created:  j.created,
+	}
+	if !j.started.IsZero() {
+		started := j.started
+		st.State, st.Started = "running", &started
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		st.State, st.Finished = "done", &finished
+	}
+	return st
+}
+
+func (rs *ragServer) jobStatusHandler(w http.ResponseWriter, req *http.Request) {
+	job := rs.jobs.get(req.PathValue("id"))
+	if job == nil {
+		http.Error(w, "no such job", http.StatusNotFound)
+		return
+	}
+	renderJSON(w, job.status())
+}
@@ -0,0 +1,157 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJobQueue(t *testing.T) {
+	var mu sync.Mutex
+	var stored []string
+	ingest := func(texts []string, policy dedupPolicy) (ingestResult, error) {
+		for _, text := range texts {
+			if strings.HasPrefix(text, "bad") {
+				return ingestResult{}, errors.New("bad document")
+			}
+		}
+		mu.Lock()
+		stored = append(stored, texts...)
+		mu.Unlock()
+		return ingestResult{Stored: len(texts)}, nil
+	}
+	q := newJobQueue(ingest, 2, time.Hour)
+
+	texts := make([]string, 2*ingestBatchSize+1)
+	for i := range texts {
+		texts[i] = "doc"
+	}
+	texts[3] = "bad one"
+	texts[len(texts)-1] = "bad two"
+
+	job, err := q.submit(texts, dedupKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := q.get(job.id); got != job {
+		t.Fatalf("get(%q) = %v, want the submitted job", job.id, got)
+	}
+
+	st := waitJob(t, job)
+	if st.Total != len(texts) || st.Done != len(texts) || st.Failed != 2 || st.Stored != len(texts)-2 {
+		t.Errorf("status = %+v, want total=done=%d failed=2 stored=%d", st, len(texts), len(texts)-2)
+	}
+	failed := map[int]bool{}
+	for _, e := range st.Errors {
+		failed[e.Index] = true
+	}
+	if !failed[3] || !failed[len(texts)-1] {
+		t.Errorf("errors = %+v, want documents 3 and %d", st.Errors, len(texts)-1)
+	}
+	if len(stored) != len(texts)-2 {
+		t.Errorf("stored %d documents, want %d", len(stored), len(texts)-2)
+	}
+}
+
+func TestJobQueueRetention(t *testing.T) {
+	q := newJobQueue(func([]string, dedupPolicy) (ingestResult, error) { return ingestResult{}, nil }, 1, time.Millisecond)
+	job, err := q.submit([]string{"doc"}, dedupKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, job)
+	time.Sleep(5 * time.Millisecond)
+	if got := q.get(job.id); got != nil {
+		t.Errorf("get(%q) = %v after retention, want nil", job.id, got)
+	}
+}
+
+func TestJobQueueStop(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+	var ingested []string
+	q := newJobQueue(func(texts []string, policy dedupPolicy) (ingestResult, error) {
+		started <- true
+		<-release
+		ingested = append(ingested, texts...)
+		return ingestResult{Stored: len(texts)}, nil
+	}, 1, time.Hour)
+	texts := make([]string, 2*ingestBatchSize)
+	if _, err := q.submit(texts, dedupKeep); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	// stop waits for the batch being ingested, and not for the other one.
+	stopped := make(chan bool)
+	go func() {
+		q.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stop returned while a batch was being ingested")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release <- true
+	<-stopped
+	if len(ingested) != ingestBatchSize {
+		t.Errorf("ingested %d documents, want one batch of %d", len(ingested), ingestBatchSize)
+	}
+}
+
+func waitJob(t *testing.T, job *ingestJob) jobStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if st := job.status(); st.State == "done" {
+			return st
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("job %s didn't finish", job.id)
+	return jobStatus{}
+}
+
+// tornStore is a vectorStore whose first store call only stores the first
+// document, and fails.
+type tornStore struct {
+	vectorStore
+	torn bool
+}
+
+func (s *tornStore) store(ctx context.Context, class string, docs []storedDoc) error {
+	if s.torn {
+		return s.vectorStore.store(ctx, class, docs)
+	}
+	s.torn = true
+	if err := s.vectorStore.store(ctx, class, docs[:1]); err != nil {
+		return err
+	}
+	return errors.New("connection reset")
+}
+
+func TestJobRetryAfterFailedStore(t *testing.T) {
+	rs := newFileTestServer(t, nil)
+	rs.store = &tornStore{vectorStore: rs.store}
+	q := newJobQueue(rs.ingest, 1, time.Hour)
+
+	job, err := q.submit([]string{"aaaa", "bbbb", "cccc"}, dedupSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := waitJob(t, job)
+	if st.Stored != 3 || st.Skipped != 0 || st.Failed != 0 {
+		t.Errorf("status = %+v, want 3 stored", st)
+	}
+	if n, _ := rs.store.count(rs.ctx, rs.coll.Class); n != 3 {
+		t.Errorf("%d documents stored, want 3", n)
+	}
+}
@@ -15,18 +15,36 @@ import (
 // contains a JSON-encoded value complying with the underlying type of target.
 // It populates target, or returns an error.
 func readRequestJSON(req *http.Request, target any) error {
+	dec, err := requestDecoder(req)
+	if err != nil {
+		return err
+	}
+	dec.DisallowUnknownFields()
+	return dec.Decode(target)
+}
+
+// readLenientRequestJSON is like readRequestJSON, but ignores fields in the
+// request that target doesn't have.
+func readLenientRequestJSON(req *http.Request, target any) error {
+	dec, err := requestDecoder(req)
+	if err != nil {
+		return err
+	}
+	return dec.Decode(target)
+}
+
+// requestDecoder checks that req has a JSON content type and returns a
+// decoder for its body.
+func requestDecoder(req *http.Request) (*json.Decoder, error) {
 	contentType := req.Header.Get("Content-Type")
 	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if mediaType != "application/json" {
-		return fmt.Errorf("expect application/json Content-Type, got %s", mediaType)
+		return nil, fmt.Errorf("expect application/json Content-Type, got %s", mediaType)
 	}
-
-	dec := json.NewDecoder(req.Body)
-	dec.DisallowUnknownFields()
-	return dec.Decode(target)
+	return json.NewDecoder(req.Body), nil
 }
 
 // renderJSON renders 'v' as JSON and writes it as a response into w.
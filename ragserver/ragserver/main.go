@@ -8,63 +8,255 @@
 package main
 
 import (
-	"cmp"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/google/generative-ai-go/genai"
-	"github.com/weaviate/weaviate-go-client/v4/weaviate"
-	"github.com/weaviate/weaviate-go-client/v4/weaviate/graphql"
-	"github.com/weaviate/weaviate/entities/models"
 	"google.golang.org/api/option"
 )
 
-const generativeModelName = "gemini-1.5-flash"
-const embeddingModelName = "text-embedding-004"
+const defaultGenerators = "gemini:gemini-1.5-flash"
+const defaultEmbeddingModelName = "text-embedding-004"
+
+var (
+	reindexFlag = flag.Bool("reindex", false,
+		"if the stored documents weren't embedded with EMBEDDING_MODEL, or with vectors of its size, re-embed them in the background instead of refusing to start")
+	configFlag      = flag.String("config", "", "read settings from this JSON `file`; environment variables override it")
+	printConfigFlag = flag.Bool("print-config", false, "print the effective settings, with secrets masked, and exit")
+)
 
 // This is a standard Go HTTP server. Server state is in the ragServer struct.
-// The `main` function connects to the required services (Weaviate and Google
-// AI), initializes the server state and registers HTTP handlers.
+// The `main` function connects to the required services (the vector store and
+// Google AI), initializes the server state and registers HTTP handlers.
 func main() {
+	flag.Parse()
 	ctx := context.Background()
-	wvClient, err := initWeaviate(ctx)
+	cfg, err := loadConfig(*configFlag, os.Getenv)
+	if err == nil && *printConfigFlag {
+		js, err := cfg.masked()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s\n", js)
+	}
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		log.Fatalf("bad configuration:\n%v", err)
+	}
+	if *printConfigFlag {
+		return
+	}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+	case "migrate":
+		migrateCommand(ctx, cfg)
+		return
+	default:
+		log.Fatalf("unknown command %q", cmd)
+	}
+
+	if cfg.GeminiAPIKey == "" {
+		log.Fatalf("%s must be set", describe("geminiApiKey"))
+	}
+	store, err := initStore(ctx, cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	apiKey := os.Getenv("GEMINI_API_KEY")
-	genaiClient, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	genaiClient, err := genai.NewClient(ctx, option.WithAPIKey(cfg.GeminiAPIKey))
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer genaiClient.Close()
 
+	gens, err := parseGenerators(cfg.Generators,
+		func(model string) generator {
+			return newGeminiGenerator(genaiClient, model)
+		},
+		func(model, baseURL string) generator {
+			return &openAIGenerator{
+				model:   model,
+				baseURL: baseURL,
+				apiKey:  cfg.OpenAIAPIKey,
+				client:  http.DefaultClient,
+			}
+		})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	server := &ragServer{
-		ctx:      ctx,
-		wvClient: wvClient,
-		genModel: genaiClient.GenerativeModel(generativeModelName),
-		embModel: genaiClient.EmbeddingModel(embeddingModelName),
+		ctx:   ctx,
+		store: store,
+		gen:   newFallbackGenerator(gens...),
+		newEmbedder: func(model string) embedder {
+			return geminiEmbedder{genaiClient.EmbeddingModel(model)}
+		},
+		cache:           newLRUCache[queryKey, *queryResult](cfg.QueryCacheSize, time.Duration(cfg.QueryCacheTTL)),
+		maxOutputTokens: int32(cfg.MaxOutputTokens),
+		dedupPolicy:     dedupPolicy(cfg.DedupPolicy),
+		dedupSimilarity: cfg.DedupSimilarity,
+	}
+	server.jobs = newJobQueue(server.ingest, cfg.IngestWorkers, time.Duration(cfg.JobRetention))
+	server.auditor, err = newAuditor(cfg)
+	if err != nil {
+		log.Fatalf("opening audit log: %v", err)
+	}
+
+	// Refuse to mix vectors from different embedding models in a collection:
+	// if the configured model changed, the stored documents have to be
+	// re-embedded first.
+	if err := server.initCollection(cfg.EmbeddingModel, *reindexFlag); err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &http.Server{
+		Addr:              cfg.Address,
+		Handler:           server.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	serveErr := make(chan error, 1)
+	if cfg.TLSCertFile != "" {
+		log.Println("listening on", cfg.Address, "with TLS")
+		go func() { serveErr <- srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile) }()
+	} else {
+		if !isLoopback(cfg.Address) {
+			log.Printf("warning: serving plain HTTP on non-loopback address %s; set %s and %s to use TLS",
+				cfg.Address, describe("tlsCertFile"), describe("tlsKeyFile"))
+		}
+		log.Println("listening on", cfg.Address)
+		go func() { serveErr <- srv.ListenAndServe() }()
+	}
+
+	// On SIGINT or SIGTERM, finish the requests in progress and the batches
+	// being ingested, then close the vector store, so that the file store's
+	// log is compacted and closed, and close the audit log.
+	sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-sigCtx.Done():
+	}
+	log.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutting down HTTP server: %v", err)
+	}
+	server.jobs.stop()
+	if err := store.close(); err != nil {
+		log.Printf("closing vector store: %v", err)
+	}
+	if server.auditor != nil && server.auditor.file != nil {
+		if err := server.auditor.file.Close(); err != nil {
+			log.Printf("closing audit log: %v", err)
+		}
 	}
+}
 
+// routes returns a handler serving the server's HTTP API.
+func (rs *ragServer) routes() http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /add/", server.addDocumentsHandler)
-	mux.HandleFunc("POST /query/", server.queryHandler)
+	mux.HandleFunc("POST /add/", rs.addDocumentsHandler)
+	mux.HandleFunc("POST /query/", rs.queryHandler)
+	mux.HandleFunc("POST /reindex/", rs.startReindexHandler)
+	mux.HandleFunc("GET /reindex/", rs.reindexStatusHandler)
+	mux.HandleFunc("GET /jobs/{id}", rs.jobStatusHandler)
+	mux.HandleFunc("POST /feedback/", rs.feedbackHandler)
+	mux.HandleFunc("GET /feedback/", rs.exportFeedbackHandler)
+	mux.HandleFunc("POST /v1/chat/completions", rs.chatCompletionsHandler)
+	mux.HandleFunc("GET /v1/models", rs.modelsHandler)
+	return mux
+}
 
-	port := cmp.Or(os.Getenv("SERVERPORT"), "9020")
-	address := "localhost:" + port
-	log.Println("listening on", address)
-	log.Fatal(http.ListenAndServe(address, mux))
+// migrateCommand implements `ragserver migrate`, which applies additive
+// changes to the Weaviate schema.
+func migrateCommand(ctx context.Context, cfg *config) {
+	if cfg.VectorStore != "weaviate" {
+		log.Fatalf("migrate only applies to the weaviate vector store, not %q", cfg.VectorStore)
+	}
+	ws, err := initWeaviate(ctx, cfg.WeaviateAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	applied, skipped, err := ws.migrate(ctx)
+	for _, c := range applied {
+		log.Printf("applied: %s", c)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range skipped {
+		log.Printf("not applied: %s", c)
+	}
+	if len(applied) == 0 {
+		log.Printf("no additive schema changes to apply")
+	}
 }
 
 type ragServer struct {
-	ctx      context.Context
-	wvClient *weaviate.Client
-	genModel *genai.GenerativeModel
-	embModel *genai.EmbeddingModel
+	// ctx is for work that outlives a request, such as ingest jobs and
+	// re-indexing. Handlers use their request's context.
+	ctx         context.Context
+	store       vectorStore
+	gen         *fallbackGenerator
+	newEmbedder func(model string) embedder
+	jobs        *jobQueue
+	cache       *lruCache[queryKey, *queryResult]
+	auditor     *auditor // nil if there's no audit log
+
+	// dedupPolicy is the policy for /add/ requests that don't set one, and
+	// dedupSimilarity the cosine similarity above which documents are near
+	// duplicates (0 to only look for exact duplicates).
+	dedupPolicy     dedupPolicy
+	dedupSimilarity float64
+
+	// maxOutputTokens is the most tokens a request may ask a generator for,
+	// and the limit for requests that don't ask.
+	maxOutputTokens int32
+
+	// corpus is incremented whenever documents are added or removed, or the
+	// active collection changes.
+	corpus atomic.Uint64
+
+	// ingestMu is held for reading while documents are being stored, and for
+	// writing while a re-index starts, copies a batch or is swapped in, so
+	// that no document is written only to a collection that's about to be
+	// replaced, and no deleted one is copied back.
+	ingestMu sync.RWMutex
+
+	mu      sync.RWMutex // protects the fields below
+	coll    collection   // active collection
+	reindex *reindexJob  // most recent re-index job, or nil
+}
+
+// corpusChanged records that the documents queries are answered from have
+// changed, invalidating cached answers.
+func (rs *ragServer) corpusChanged() {
+	rs.corpus.Add(1)
+	rs.cache.clear()
+}
+
+// collection returns the active collection.
+func (rs *ragServer) collection() collection {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return rs.coll
 }
 
 func (rs *ragServer) addDocumentsHandler(w http.ResponseWriter, req *http.Request) {
@@ -74,6 +266,8 @@ func (rs *ragServer) addDocumentsHandler(w http.ResponseWriter, req *http.Reques
 	}
 	type addRequest struct {
 		Documents []document
+		Async     bool
+		Dedup     string
 	}
 	ar := &addRequest{}
 
@@ -83,112 +277,293 @@ func (rs *ragServer) addDocumentsHandler(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	// Use the batch embedding API to embed all documents at once.
-	batch := rs.embModel.NewBatch()
-	for _, doc := range ar.Documents {
-		batch.AddContent(genai.Text(doc.Text))
+	policy := rs.dedupPolicy
+	if ar.Dedup != "" {
+		policy, err = parseDedupPolicy(ar.Dedup)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	texts := make([]string, len(ar.Documents))
+	for i, doc := range ar.Documents {
+		texts[i] = doc.Text
+	}
+
+	// In async mode, hand the documents to the ingest workers and return a
+	// job the client can poll.
+	if ar.Async {
+		job, err := rs.jobs.submit(texts, policy)
+		if errors.Is(err, errQueueFull) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/jobs/"+job.id)
+		w.WriteHeader(http.StatusAccepted)
+		renderJSON(w, job.status())
+		return
 	}
-	log.Printf("invoking embedding model with %v documents", len(ar.Documents))
-	rsp, err := rs.embModel.BatchEmbedContents(rs.ctx, batch)
+
+	res, err := rs.ingest(texts, policy)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if len(rsp.Embeddings) != len(ar.Documents) {
-		http.Error(w, "embedded batch size mismatch", http.StatusInternalServerError)
-		return
+	renderJSON(w, res)
+}
+
+// ingest embeds texts and stores them in the active collection, dealing
+// with duplicates of stored documents as policy says. It stores either all
+// of the documents or, if it fails, none of them.
+func (rs *ragServer) ingest(texts []string, policy dedupPolicy) (ingestResult, error) {
+	rs.ingestMu.RLock()
+	defer rs.ingestMu.RUnlock()
+
+	// While a re-index is running, documents go to both the active collection
+	// and the one being built, each embedded with its own model. They get
+	// the same IDs in both, so the re-index job copying them again is
+	// harmless.
+	colls := []collection{rs.collection()}
+	if target, ok := rs.reindexTarget(); ok && target.Class != colls[0].Class {
+		colls = append(colls, target)
 	}
 
-	// Convert our documents - along with their embedding vectors - into types
-	// used by the Weaviate client library.
-	objects := make([]*models.Object, len(ar.Documents))
-	for i, doc := range ar.Documents {
-		objects[i] = &models.Object{
-			Class: "Document",
-			Properties: map[string]any{
-				"text": doc.Text,
-			},
-			Vector: rsp.Embeddings[i].Values,
+	// Duplicates are looked for in the active collection only.
+	docs, res, existing, err := rs.exactDuplicates(colls[0], texts, policy)
+	if err != nil {
+		return ingestResult{}, err
+	}
+
+	// Embed the documents for every collection before writing any of them,
+	// so that a failure to embed leaves the store as it was.
+	batches := make([][]storedDoc, len(colls)) // documents to store in each collection
+	var replaced []string                      // IDs of near duplicates being replaced
+	for i, coll := range colls {
+		if len(docs) == 0 {
+			break
+		}
+		texts := make([]string, len(docs))
+		for j, doc := range docs {
+			texts[j] = doc.Text
 		}
+		log.Printf("invoking embedding model %s with %v documents", coll.Model, len(texts))
+		vectors, err := rs.newEmbedder(coll.Model).embed(rs.ctx, texts)
+		if err == nil {
+			err = checkDimensions(coll, vectors)
+		}
+		if err != nil {
+			return ingestResult{}, err
+		}
+		batch := make([]storedDoc, len(docs))
+		for j, doc := range docs {
+			doc.Vector = vectors[j]
+			batch[j] = doc
+		}
+
+		if i == 0 && policy != dedupKeep && rs.dedupSimilarity > 0 {
+			var skipped int
+			batch, replaced, skipped, err = rs.nearDuplicates(coll, batch, policy)
+			if err != nil {
+				return ingestResult{}, err
+			}
+			res.Skipped += skipped
+			res.Replaced += len(replaced)
+			docs = batch
+		}
+		batches[i] = batch
 	}
 
-	// Store documents with embeddings in the Weaviate DB.
-	log.Printf("storing %v objects in weaviate", len(objects))
-	_, err = rs.wvClient.Batch().ObjectsBatcher().WithObjects(objects...).Do(rs.ctx)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if err := rs.storeBatches(colls, batches, replaced, existing); err != nil {
+		return ingestResult{}, err
 	}
+	res.Stored = len(docs)
+	if res.Stored > 0 {
+		rs.corpusChanged()
+	}
+	return res, nil
+}
+
+// storeBatches stores batches[i] in colls[i], and then deletes the replaced
+// documents from all of them. If that fails, it deletes the documents it
+// stored again, except those that took the place of a document with the same
+// ID (which existing reports), so that the ingest can be retried.
+func (rs *ragServer) storeBatches(colls []collection, batches [][]storedDoc, replaced []string, existing map[string]bool) error {
+	var err error
+	for i, coll := range colls {
+		if len(batches[i]) == 0 {
+			continue
+		}
+		log.Printf("storing %v documents in collection %s", len(batches[i]), coll.Class)
+		if err = rs.store.store(rs.ctx, coll.Class, batches[i]); err != nil {
+			break
+		}
+	}
+	for _, coll := range colls {
+		if err != nil || len(replaced) == 0 {
+			break
+		}
+		err = rs.store.delete(rs.ctx, coll.Class, replaced)
+	}
+	if err == nil {
+		return nil
+	}
+
+	var added []string
+	for _, doc := range batches[0] {
+		if !existing[doc.ID] {
+			added = append(added, doc.ID)
+		}
+	}
+	for _, coll := range colls {
+		if derr := rs.store.delete(rs.ctx, coll.Class, added); derr != nil {
+			log.Printf("removing documents of failed ingest from %s: %v", coll.Class, derr)
+		}
+	}
+	// Queries may have been answered from the documents in the meantime.
+	rs.corpusChanged()
+	return err
 }
 
 func (rs *ragServer) queryHandler(w http.ResponseWriter, req *http.Request) {
 	// Parse HTTP request from JSON.
 	type queryRequest struct {
 		Content string
+		genSettings
+
+		// Rewrite asks for the question to be rewritten before retrieval;
+		// see rewriteMode.
+		Rewrite string
+
+		// Detailed asks for a queryResponse rather than just the answer.
+		Detailed bool
 	}
 	qr := &queryRequest{}
 	err := readRequestJSON(req, qr)
+	if err == nil {
+		err = qr.genSettings.check(rs.maxOutputTokens)
+	}
+	var mode rewriteMode
+	if err == nil {
+		mode, err = parseRewriteMode(qr.Rewrite)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	audit := rs.startAudit(w, req, "/query/", qr.Content)
+	defer rs.finishAudit(audit)
 
-	// Embed the query contents.
-	rsp, err := rs.embModel.EmbedContent(rs.ctx, genai.Text(qr.Content))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Answer repeated questions from the cache. The key includes the corpus
+	// version, so answers retrieved before documents changed are never used.
+	key := queryKey{
+		question: normalizeQuestion(qr.Content),
+		options:  qr.genSettings.key() + " rewrite=" + string(mode),
+		corpus:   rs.corpus.Load(),
 	}
-
-	// Search weaviate to find the most relevant (closest in vector space)
-	// documents to the query.
-	gql := rs.wvClient.GraphQL()
-	result, err := gql.Get().
-		WithNearVector(
-			gql.NearVectorArgBuilder().WithVector(rsp.Embedding.Values)).
-		WithClassName("Document").
-		WithFields(graphql.Field{Name: "text"}).
-		WithLimit(3).
-		Do(rs.ctx)
-	if werr := combinedWeaviateError(result, err); werr != nil {
-		http.Error(w, werr.Error(), http.StatusInternalServerError)
+	if res, ok := rs.cache.get(key); ok {
+		w.Header().Set("X-Cache", "hit")
+		audit.Cached = true
+		audit.recordResult(res)
+		renderQueryResponse(w, res, qr.Detailed)
 		return
 	}
+	w.Header().Set("X-Cache", "miss")
 
-	contents, err := decodeGetResults(result)
+	docs, rewrites, err := rs.retrieveRewritten(req.Context(), qr.Content, mode)
+	audit.Rewrites, audit.DocIDs = rewrites, docIDs(docs)
 	if err != nil {
-		http.Error(w, fmt.Errorf("reading weaviate response: %w", err).Error(), http.StatusInternalServerError)
+		audit.Error = err.Error()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Create a RAG query for the LLM with the most relevant documents as
 	// context.
-	ragQuery := fmt.Sprintf(ragTemplateStr, qr.Content, strings.Join(contents, "\n"))
-	resp, err := rs.genModel.GenerateContent(rs.ctx, genai.Text(ragQuery))
+	ragQuery := fmt.Sprintf(ragTemplateStr, qr.Content, strings.Join(docTexts(docs), "\n"))
+	resp, err := rs.gen.generate(req.Context(), &genRequest{Prompt: ragQuery, Settings: qr.genSettings})
+	if err != nil {
+		audit.Error = err.Error()
+	}
+	var gerr *generationError
+	if errors.As(err, &gerr) {
+		log.Printf("generative model refused: %v", err)
+		renderGenerationError(w, gerr)
+		return
+	}
 	if err != nil {
 		log.Printf("calling generative model: %v", err.Error())
 		http.Error(w, "generative model error", http.StatusInternalServerError)
 		return
 	}
 
-	if len(resp.Candidates) != 1 {
-		log.Printf("got %v candidates, expected 1", len(resp.Candidates))
-		http.Error(w, "generative model error", http.StatusInternalServerError)
+	res := &queryResult{resp: resp, rewrites: rewrites, docIDs: audit.DocIDs}
+	audit.recordResult(res)
+	rs.cache.put(key, res)
+	renderQueryResponse(w, res, qr.Detailed)
+}
+
+// queryResult is the outcome of a /query/ request, as cached.
+type queryResult struct {
+	resp     *genResponse
+	rewrites []string
+	docIDs   []string // documents retrieved as context
+}
+
+// queryResponse is the response to a /query/ request with "detailed": true.
+type queryResponse struct {
+	Answer string `json:"answer"`
+
+	// FinishReason is "stop", "length" or "content_filter"; Truncated is
+	// true for "length".
+	FinishReason  string         `json:"finishReason"`
+	Truncated     bool           `json:"truncated"`
+	SafetyRatings []safetyRating `json:"safetyRatings,omitempty"`
+	IgnoredParts  []string       `json:"ignoredParts,omitempty"`
+	Generator     string         `json:"generator"`
+
+	// Rewrites are the rewritten questions used for retrieval, if the
+	// request asked for rewriting.
+	Rewrites []string `json:"rewrites,omitempty"`
+}
+
+// renderQueryResponse writes the response to a /query/ request: just the
+// answer as a JSON string, or a queryResponse if detailed is set. The
+// generator and finish reason are also reported in headers.
+func renderQueryResponse(w http.ResponseWriter, res *queryResult, detailed bool) {
+	resp := res.resp
+	w.Header().Set("X-Generator", resp.Generator)
+	w.Header().Set("X-Finish-Reason", resp.FinishReason)
+	if !detailed {
+		renderJSON(w, resp.Text)
 		return
 	}
+	renderJSON(w, queryResponse{
+		Answer:        resp.Text,
+		FinishReason:  resp.FinishReason,
+		Truncated:     resp.FinishReason == "length",
+		SafetyRatings: resp.SafetyRatings,
+		IgnoredParts:  resp.IgnoredParts,
+		Generator:     resp.Generator,
+		Rewrites:      res.rewrites,
+	})
+}
 
-	var respTexts []string
-	for _, part := range resp.Candidates[0].Content.Parts {
-		if pt, ok := part.(genai.Text); ok {
-			respTexts = append(respTexts, string(pt))
-		} else {
-			log.Printf("bad type of part: %v", pt)
-			http.Error(w, "generative model error", http.StatusInternalServerError)
-			return
-		}
+// renderGenerationError writes a 422 response describing why the generator
+// didn't answer, as {"error": {"code": ..., ...}}.
+func renderGenerationError(w http.ResponseWriter, gerr *generationError) {
+	type errorDetail struct {
+		Code          string         `json:"code"`
+		Reason        string         `json:"reason,omitempty"`
+		SafetyRatings []safetyRating `json:"safetyRatings,omitempty"`
+		IgnoredParts  []string       `json:"ignoredParts,omitempty"`
 	}
-
-	renderJSON(w, strings.Join(respTexts, "\n"))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	renderJSON(w, map[string]errorDetail{
+		"error": {gerr.Code, gerr.Reason, gerr.SafetyRatings, gerr.IgnoredParts},
+	})
 }
 
 const ragTemplateStr = `
@@ -211,36 +586,3 @@ Question:
 Context:
 %s
 `
-
-// decodeGetResults decodes the result returned by Weaviate's GraphQL Get
-// query; these are returned as a nested map[string]any (just like JSON
-// unmarshaled into a map[string]any). We have to extract all document contents
-// as a list of strings.
-func decodeGetResults(result *models.GraphQLResponse) ([]string, error) {
-	data, ok := result.Data["Get"]
-	if !ok {
-		return nil, fmt.Errorf("Get key not found in result")
-	}
-	doc, ok := data.(map[string]any)
-	if !ok {
-		return nil, fmt.Errorf("Get key unexpected type")
-	}
-	slc, ok := doc["Document"].([]any)
-	if !ok {
-		return nil, fmt.Errorf("Document is not a list of results")
-	}
-
-	var out []string
-	for _, s := range slc {
-		smap, ok := s.(map[string]any)
-		if !ok {
-			return nil, fmt.Errorf("invalid element in list of documents")
-		}
-		s, ok := smap["text"].(string)
-		if !ok {
-			return nil, fmt.Errorf("expected string in list of documents")
-		}
-		out = append(out, s)
-	}
-	return out, nil
-}
@@ -0,0 +1,320 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// An OpenAI-compatible chat completions endpoint, so that clients written for
+// the OpenAI API can use ragserver unchanged.
+//
+// The last user message of the conversation is used for retrieval and is
+// replaced by a RAG query built from it, just like in queryHandler; earlier
+// messages are passed to the model as chat history. See
+// https://platform.openai.com/docs/api-reference/chat for the wire format.
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type chatMessage struct {
+	Role    string      `json:"role,omitempty"`
+	Content chatContent `json:"content"`
+}
+
+// chatContent is the content of a chat message. On the wire it's either a
+// string or a list of typed parts, of which we only support text.
+type chatContent string
+
+func (c *chatContent) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*c = chatContent(s)
+		return nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("message content must be a string or a list of parts")
+	}
+	var texts []string
+	for _, p := range parts {
+		if p.Type != "text" {
+			return fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+		texts = append(texts, p.Text)
+	}
+	*c = chatContent(strings.Join(texts, "\n"))
+	return nil
+}
+
+type chatCompletionRequest struct {
+	Model               string        `json:"model"`
+	Messages            []chatMessage `json:"messages"`
+	Stream              bool          `json:"stream"`
+	Temperature         *float32      `json:"temperature,omitempty"`
+	MaxTokens           *int32        `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int32        `json:"max_completion_tokens,omitempty"`
+	Stop                stopSequences `json:"stop,omitempty"`
+}
+
+// stopSequences is the "stop" field of a chat completion request, which is
+// either a string or a list of strings on the wire.
+type stopSequences []string
+
+func (s *stopSequences) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = stopSequences{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(s))
+}
+
+type chatCompletion struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []chatChoice `json:"choices"`
+	Usage   *chatUsage   `json:"usage,omitempty"`
+}
+
+type chatChoice struct {
+	Index        int          `json:"index"`
+	Message      *chatMessage `json:"message,omitempty"` // in completions
+	Delta        *chatMessage `json:"delta,omitempty"`   // in streamed chunks
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type chatUsage struct {
+	PromptTokens     int32 `json:"prompt_tokens"`
+	CompletionTokens int32 `json:"completion_tokens"`
+	TotalTokens      int32 `json:"total_tokens"`
+}
+
+func (rs *ragServer) chatCompletionsHandler(w http.ResponseWriter, req *http.Request) {
+	// OpenAI clients send many optional fields we don't use, so unknown
+	// fields are allowed here.
+	cr := &chatCompletionRequest{}
+	err := readLenientRequestJSON(req, cr)
+	if err != nil {
+		renderOpenAIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Split the conversation into system instructions, the history, and the
+	// last user message that drives retrieval.
+	last := len(cr.Messages) - 1
+	if last < 0 || cr.Messages[last].Role != "user" {
+		renderOpenAIError(w, http.StatusBadRequest, "the last message must have role \"user\"")
+		return
+	}
+	gr := &genRequest{
+		Settings: genSettings{
+			Temperature:     cr.Temperature,
+			MaxOutputTokens: cmp.Or(cr.MaxCompletionTokens, cr.MaxTokens),
+			StopSequences:   cr.Stop,
+		},
+	}
+	if err := gr.Settings.check(rs.maxOutputTokens); err != nil {
+		renderOpenAIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, m := range cr.Messages[:last] {
+		switch m.Role {
+		case "system", "developer":
+			gr.System = append(gr.System, string(m.Content))
+		case "user", "assistant":
+			gr.History = append(gr.History, genMessage{Role: m.Role, Text: string(m.Content)})
+		default:
+			renderOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("unsupported message role %q", m.Role))
+			return
+		}
+	}
+	question := string(cr.Messages[last].Content)
+	audit := rs.startAudit(w, req, "/v1/chat/completions", question)
+	defer rs.finishAudit(audit)
+
+	docs, err := rs.retrieve(req.Context(), question)
+	audit.DocIDs = docIDs(docs)
+	if err != nil {
+		audit.Error = err.Error()
+		renderOpenAIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	gr.Prompt = fmt.Sprintf(ragTemplateStr, question, strings.Join(docTexts(docs), "\n"))
+
+	completion := chatCompletion{
+		ID:      "chatcmpl-" + uuid.NewString(),
+		Created: time.Now().Unix(),
+	}
+
+	if cr.Stream {
+		rs.streamChatCompletion(req.Context(), w, gr, completion, audit)
+		return
+	}
+
+	resp, err := rs.gen.generate(req.Context(), gr)
+	var gerr *generationError
+	if errors.As(err, &gerr) && gerr.Code == "response_blocked" {
+		// OpenAI reports withheld responses as empty content with a
+		// content_filter finish reason rather than as an error.
+		audit.Error = gerr.Code
+		resp, err = &genResponse{FinishReason: "content_filter"}, nil
+	}
+	if err != nil {
+		audit.Error = err.Error()
+		log.Printf("calling generative model: %v", err.Error())
+		renderOpenAIGenerationError(w, err)
+		return
+	}
+	audit.Answer, audit.Model = resp.Text, resp.Generator
+	completion.Object = "chat.completion"
+	completion.Model = resp.Generator
+	completion.Choices = []chatChoice{{
+		Message:      &chatMessage{Role: "assistant", Content: chatContent(resp.Text)},
+		FinishReason: &resp.FinishReason,
+	}}
+	completion.Usage = &chatUsage{
+		PromptTokens:     resp.PromptTokens,
+		CompletionTokens: resp.CompletionTokens,
+		TotalTokens:      resp.PromptTokens + resp.CompletionTokens,
+	}
+	renderJSON(w, completion)
+}
+
+// streamChatCompletion generates a response to gr and sends it to w as a
+// stream of server-sent events carrying chat.completion.chunk objects,
+// terminated by "data: [DONE]". What was sent is recorded in audit.
+func (rs *ragServer) streamChatCompletion(ctx context.Context, w http.ResponseWriter, gr *genRequest, chunk chatCompletion, audit *pendingAudit) {
+	chunk.Object = "chat.completion.chunk"
+	flusher, _ := w.(http.Flusher)
+	started := false
+	sendData := func(data string) {
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			started = true
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	send := func(v any) {
+		js, err := json.Marshal(v)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		sendData(string(js))
+	}
+
+	// Which backend answers is only known at the end, so the chunks carry
+	// the configured generators' names until then.
+	chunk.Model = rs.gen.name()
+	role := "assistant"
+	var answer strings.Builder
+	defer func() { audit.Answer = answer.String() }()
+	resp, err := rs.gen.generateStream(ctx, gr, func(text string) {
+		answer.WriteString(text)
+		chunk.Choices = []chatChoice{{Delta: &chatMessage{Role: role, Content: chatContent(text)}}}
+		send(chunk)
+		role = "" // only the first delta carries the role
+	})
+	var gerr *generationError
+	if errors.As(err, &gerr) && gerr.Code == "response_blocked" {
+		audit.Error = gerr.Code
+		resp, err = &genResponse{FinishReason: "content_filter", Generator: chunk.Model}, nil
+	}
+	if err != nil {
+		audit.Error = err.Error()
+		log.Printf("calling generative model: %v", err.Error())
+		if !started {
+			renderOpenAIGenerationError(w, err)
+			return
+		}
+		// The status line is already sent; report the error in the stream
+		// the way OpenAI does.
+		send(openAIError{Error: openAIErrorDetail{Message: "generative model error", Type: "server_error"}})
+		return
+	}
+
+	// The final chunk has an empty delta and the finish reason.
+	chunk.Model = resp.Generator
+	audit.Model = resp.Generator
+	chunk.Choices = []chatChoice{{Delta: &chatMessage{}, FinishReason: &resp.FinishReason}}
+	send(chunk)
+	sendData("[DONE]")
+}
+
+type openAIError struct {
+	Error openAIErrorDetail `json:"error"`
+}
+
+type openAIErrorDetail struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+}
+
+// renderOpenAIError writes an error response in the format OpenAI clients
+// expect.
+func renderOpenAIError(w http.ResponseWriter, code int, msg string) {
+	typ := "invalid_request_error"
+	if code >= 500 {
+		typ = "server_error"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	renderJSON(w, openAIError{Error: openAIErrorDetail{Message: msg, Type: typ}})
+}
+
+// renderOpenAIGenerationError writes an error response for an error returned
+// by a generator. Refusals get their generationError code; anything else is
+// reported as a server error.
+func renderOpenAIGenerationError(w http.ResponseWriter, err error) {
+	var gerr *generationError
+	if !errors.As(err, &gerr) {
+		renderOpenAIError(w, http.StatusInternalServerError, "generative model error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	renderJSON(w, openAIError{Error: openAIErrorDetail{
+		Message: gerr.Error(),
+		Type:    "invalid_request_error",
+		Code:    gerr.Code,
+	}})
+}
+
+// modelsHandler lists the configured generators; some clients check the
+// model list before sending completions. The model in a request is ignored,
+// generators are always tried in order.
+func (rs *ragServer) modelsHandler(w http.ResponseWriter, req *http.Request) {
+	type model struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		OwnedBy string `json:"owned_by"`
+	}
+	var models []model
+	for _, g := range rs.gen.gens {
+		models = append(models, model{ID: g.name(), Object: "model", OwnedBy: "ragserver"})
+	}
+	renderJSON(w, map[string]any{
+		"object": "list",
+		"data":   models,
+	})
+}
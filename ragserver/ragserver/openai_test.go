@@ -0,0 +1,185 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// postChat sends body to rs's chat completions handler.
+func postChat(rs *ragServer, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	rs.chatCompletionsHandler(w, req)
+	return w
+}
+
+// sseData returns the data of the server-sent events in body.
+func sseData(body string) []string {
+	var data []string
+	for _, line := range strings.Split(body, "\n") {
+		if d, ok := strings.CutPrefix(line, "data: "); ok {
+			data = append(data, d)
+		}
+	}
+	return data
+}
+
+const chatRequest = `{
+	"model": "anything",
+	"messages": [
+		{"role": "system", "content": "be brief"},
+		{"role": "user", "content": "hello"},
+		{"role": "assistant", "content": [{"type": "text", "text": "hi"}]},
+		{"role": "user", "content": "bbbb?"}
+	],
+	"max_tokens": 20,
+	"stop": "END",
+	"unknown": true`
+
+func TestChatCompletions(t *testing.T) {
+	gen := &fakeGenerator{chunks: []string{"It's ", "bbbb."}, finishReason: "length"}
+	rs := newFileTestServer(t, gen, "aaaa", "bbbb")
+
+	w := postChat(rs, chatRequest+`}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var completion chatCompletion
+	if err := json.Unmarshal(w.Body.Bytes(), &completion); err != nil {
+		t.Fatal(err)
+	}
+	if completion.Object != "chat.completion" || completion.Model != "fake" || !strings.HasPrefix(completion.ID, "chatcmpl-") {
+		t.Errorf("completion = %+v", completion)
+	}
+	if len(completion.Choices) != 1 {
+		t.Fatalf("%d choices, want 1", len(completion.Choices))
+	}
+	c := completion.Choices[0]
+	if c.Message.Role != "assistant" || c.Message.Content != "It's bbbb." || *c.FinishReason != "length" {
+		t.Errorf("choice = %+v, message %+v", c, c.Message)
+	}
+	if u := completion.Usage; u == nil || *u != (chatUsage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12}) {
+		t.Errorf("usage = %+v", u)
+	}
+
+	// The last message drives retrieval; the others are passed on.
+	req := gen.reqs[0]
+	if !strings.Contains(req.Prompt, "bbbb?") || !strings.Contains(req.Prompt, "\nbbbb\n") {
+		t.Errorf("prompt doesn't have the question and the retrieved document:\n%s", req.Prompt)
+	}
+	wantHistory := []genMessage{{Role: "user", Text: "hello"}, {Role: "assistant", Text: "hi"}}
+	if !slices.Equal(req.System, []string{"be brief"}) || !slices.Equal(req.History, wantHistory) {
+		t.Errorf("system %q, history %+v", req.System, req.History)
+	}
+	if s := req.Settings; *s.MaxOutputTokens != 20 || !slices.Equal(s.StopSequences, []string{"END"}) {
+		t.Errorf("settings = %+v", s)
+	}
+}
+
+func TestChatCompletionsStream(t *testing.T) {
+	rs := newFileTestServer(t, &fakeGenerator{chunks: []string{"It's ", "bbbb."}, finishReason: "length"}, "aaaa", "bbbb")
+
+	w := postChat(rs, chatRequest+`, "stream": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	data := sseData(w.Body.String())
+	if len(data) != 4 || data[3] != "[DONE]" {
+		t.Fatalf("events = %q, want 2 deltas, the final chunk and [DONE]", data)
+	}
+	var chunks []chatCompletion
+	for _, d := range data[:3] {
+		var chunk chatCompletion
+		if err := json.Unmarshal([]byte(d), &chunk); err != nil {
+			t.Fatal(err)
+		}
+		if chunk.Object != "chat.completion.chunk" || len(chunk.Choices) != 1 || chunk.Choices[0].Delta == nil {
+			t.Fatalf("chunk = %s", d)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if d := chunks[0].Choices[0].Delta; d.Role != "assistant" || d.Content != "It's " {
+		t.Errorf("first delta = %+v", d)
+	}
+	if d := chunks[1].Choices[0].Delta; d.Role != "" || d.Content != "bbbb." {
+		t.Errorf("second delta = %+v", d)
+	}
+	if c := chunks[2].Choices[0]; c.Delta.Content != "" || c.FinishReason == nil || *c.FinishReason != "length" {
+		t.Errorf("final chunk = %s", data[2])
+	}
+	if chunks[0].ID != chunks[2].ID {
+		t.Errorf("chunks have IDs %q and %q, want the same", chunks[0].ID, chunks[2].ID)
+	}
+}
+
+func TestChatCompletionsStreamErrors(t *testing.T) {
+	// A refusal before anything is streamed is an ordinary error response.
+	rs := newFileTestServer(t, &fakeGenerator{err: &generationError{Code: "prompt_blocked"}}, "aaaa", "bbbb")
+	w := postChat(rs, chatRequest+`, "stream": true}`)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), `"code":"prompt_blocked"`) {
+		t.Errorf("refused prompt: status %d, %s", w.Code, w.Body)
+	}
+
+	// A withheld response ends the stream with a content_filter finish.
+	rs = newFileTestServer(t, &fakeGenerator{chunks: []string{"It's "}, err: &generationError{Code: "response_blocked"}}, "aaaa", "bbbb")
+	w = postChat(rs, chatRequest+`, "stream": true}`)
+	data := sseData(w.Body.String())
+	if len(data) != 3 || !strings.Contains(data[1], `"finish_reason":"content_filter"`) || data[2] != "[DONE]" {
+		t.Errorf("blocked response: events %q", data)
+	}
+
+	// Other errors after the stream started are reported in it.
+	rs = newFileTestServer(t, &fakeGenerator{chunks: []string{"It's "}, err: errBadRequest}, "aaaa", "bbbb")
+	w = postChat(rs, chatRequest+`, "stream": true}`)
+	data = sseData(w.Body.String())
+	if w.Code != http.StatusOK || len(data) != 2 || !strings.Contains(data[1], `"type":"server_error"`) {
+		t.Errorf("failed stream: status %d, events %q", w.Code, data)
+	}
+}
+
+func TestChatCompletionsBadRequests(t *testing.T) {
+	rs := newFileTestServer(t, &fakeGenerator{chunks: []string{"ok"}}, "aaaa", "bbbb")
+	for _, body := range []string{
+		`{"messages": []}`,
+		`{"messages": [{"role": "user", "content": "hi"}, {"role": "assistant", "content": "hello"}]}`,
+		`{"messages": [{"role": "tool", "content": "x"}, {"role": "user", "content": "hi"}]}`,
+		`{"messages": [{"role": "user", "content": [{"type": "image_url"}]}]}`,
+		`{"messages": [{"role": "user", "content": "hi"}], "max_tokens": 1000}`,
+	} {
+		w := postChat(rs, body)
+		var e openAIError
+		if w.Code != http.StatusBadRequest || json.Unmarshal(w.Body.Bytes(), &e) != nil || e.Error.Type != "invalid_request_error" {
+			t.Errorf("%s: status %d, %s; want 400 with an invalid_request_error", body, w.Code, w.Body)
+		}
+	}
+}
+
+func TestChatCompletionsStreamCanceled(t *testing.T) {
+	// The client goes away while the generator is failing, so it isn't
+	// tried again.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gen := &fakeGenerator{chunks: []string{"It's ", "bbbb."}, errs: []error{errUnavailable}, hook: cancel}
+	rs := newFileTestServer(t, gen, "aaaa", "bbbb")
+
+	req := httptest.NewRequestWithContext(ctx, "POST", "/v1/chat/completions", strings.NewReader(chatRequest+`, "stream": true}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	rs.chatCompletionsHandler(w, req)
+	if len(gen.reqs) != 1 || strings.Contains(w.Body.String(), "bbbb.") {
+		t.Errorf("generator called %d times after the client went away, sent %q", len(gen.reqs), w.Body)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxChunkSize limits the size of an event in a streamed chat completion.
+const maxChunkSize = 1 << 20
+
+// openAIGenerator is a generator backed by a server implementing the OpenAI
+// chat completions API, such as a locally run model.
+type openAIGenerator struct {
+	model   string
+	baseURL string // e.g. "http://localhost:11434/v1"
+	apiKey  string // optional
+	client  *http.Client
+}
+
+func (g *openAIGenerator) name() string { return "openai:" + g.model + "@" + g.baseURL }
+
+func (g *openAIGenerator) generate(ctx context.Context, req *genRequest) (*genResponse, error) {
+	body, err := g.post(ctx, req, false)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var completion chatCompletion
+	if err := json.NewDecoder(body).Decode(&completion); err != nil {
+		return nil, fmt.Errorf("decoding chat completion: %w", err)
+	}
+	if len(completion.Choices) != 1 || completion.Choices[0].Message == nil {
+		return nil, fmt.Errorf("got %v choices, expected 1", len(completion.Choices))
+	}
+	choice := completion.Choices[0]
+	gr := &genResponse{Text: string(choice.Message.Content), FinishReason: "stop"}
+	if choice.FinishReason != nil {
+		gr.FinishReason = *choice.FinishReason
+	}
+	if u := completion.Usage; u != nil {
+		gr.PromptTokens, gr.CompletionTokens = u.PromptTokens, u.CompletionTokens
+	}
+	if err := gr.checkFiltered(); err != nil {
+		return nil, err
+	}
+	return gr, nil
+}
+
+// checkFiltered returns a "response_blocked" generationError if the server's
+// content filter withheld the whole of gr.
+func (gr *genResponse) checkFiltered() error {
+	if gr.FinishReason == "content_filter" && gr.Text == "" {
+		return &generationError{Code: "response_blocked", Reason: "content_filter"}
+	}
+	return nil
+}
+
+func (g *openAIGenerator) generateStream(ctx context.Context, req *genRequest, onText func(string)) (*genResponse, error) {
+	body, err := g.post(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	gr := &genResponse{FinishReason: "stop"}
+	var sb strings.Builder
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, maxChunkSize)
+	done := false
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue // blank separator lines and comments
+		}
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+		var chunk chatCompletion
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("decoding chat completion chunk: %w", err)
+		}
+		if u := chunk.Usage; u != nil {
+			gr.PromptTokens, gr.CompletionTokens = u.PromptTokens, u.CompletionTokens
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		choice := chunk.Choices[0]
+		if choice.FinishReason != nil {
+			gr.FinishReason = *choice.FinishReason
+		}
+		if choice.Delta != nil && choice.Delta.Content != "" {
+			sb.WriteString(string(choice.Delta.Content))
+			onText(string(choice.Delta.Content))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !done {
+		return nil, fmt.Errorf("chat completion stream ended without [DONE]: %w", io.ErrUnexpectedEOF)
+	}
+	gr.Text = sb.String()
+	if err := gr.checkFiltered(); err != nil {
+		return nil, err
+	}
+	return gr, nil
+}
+
+// post sends req to the chat completions endpoint and returns the response
+// body, or an error if the response isn't successful.
+func (g *openAIGenerator) post(ctx context.Context, req *genRequest, stream bool) (io.ReadCloser, error) {
+	cr := chatCompletionRequest{
+		Model:       g.model,
+		Stream:      stream,
+		Temperature: req.Settings.Temperature,
+		MaxTokens:   req.Settings.MaxOutputTokens,
+		Stop:        req.Settings.StopSequences,
+	}
+	for _, s := range req.System {
+		cr.Messages = append(cr.Messages, chatMessage{Role: "system", Content: chatContent(s)})
+	}
+	for _, m := range req.History {
+		cr.Messages = append(cr.Messages, chatMessage{Role: m.Role, Content: chatContent(m.Text)})
+	}
+	cr.Messages = append(cr.Messages, chatMessage{Role: "user", Content: chatContent(req.Prompt)})
+	js, err := json.Marshal(cr)
+	if err != nil {
+		return nil, err
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(g.baseURL, "/")+"/chat/completions", bytes.NewReader(js))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if g.apiKey != "" {
+		hreq.Header.Set("Authorization", "Bearer "+g.apiKey)
+	}
+	resp, err := g.client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &httpStatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(msg))}
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// chunk returns a streamed chat completion event with the given text and,
+// unless it's empty, finish reason.
+func chunk(text, finish string) string {
+	fr := "null"
+	if finish != "" {
+		fr = fmt.Sprintf("%q", finish)
+	}
+	return fmt.Sprintf(`data: {"object": "chat.completion.chunk", "choices": [{"delta": {"content": %q}, "finish_reason": %s}]}`+"\n\n", text, fr)
+}
+
+func TestOpenAIGenerateStream(t *testing.T) {
+	long := strings.Repeat("x", 100_000)
+	tests := []struct {
+		name     string
+		stream   string
+		wantText string
+		wantErr  string // "" for success
+	}{
+		{"ok", chunk("Hello, ", "") + chunk("world.", "stop") + "data: [DONE]\n\n", "Hello, world.", ""},
+		{"long chunk", chunk(long, "stop") + "data: [DONE]\n\n", long, ""},
+		{"filtered", chunk("", "content_filter") + "data: [DONE]\n\n", "", "response_blocked"},
+		{"cut short", chunk("Hello, ", ""), "", "without [DONE]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				io.WriteString(w, tt.stream)
+			}))
+			defer srv.Close()
+			g := &openAIGenerator{model: "m", baseURL: srv.URL, client: srv.Client()}
+
+			resp, err := g.generateStream(context.Background(), &genRequest{Prompt: "hi"}, func(string) {})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				var gerr *generationError
+				if tt.wantErr == "response_blocked" && !errors.As(err, &gerr) {
+					t.Errorf("err = %T, want a generationError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Text != tt.wantText || resp.FinishReason != "stop" {
+				t.Errorf("response = %.40q, finish %q; want %.40q, stop", resp.Text, resp.FinishReason, tt.wantText)
+			}
+		})
+	}
+}
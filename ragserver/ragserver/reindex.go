@@ -0,0 +1,315 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Re-indexing: moving all documents to a new collection embedded with a
+// different model.
+//
+// A re-index job creates a fresh collection for the target model, walks
+// the active collection with a cursor and re-embeds every document into the
+// new one, keeping document IDs. While the job runs, queries keep using the old
+// collection and /add/ writes new documents to both, so nothing added in the
+// meantime is lost. When the copy is done the new collection is made
+// active in the store and the server switches over. The old collection is
+// left in place so it can be inspected or deleted manually.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// reindexBatchSize is the number of documents embedded and stored at a time
+// while re-indexing.
+const reindexBatchSize = 100
+
+var errReindexRunning = errors.New("a re-index job is already running")
+
+// reindexJob tracks a re-index from one collection to another.
+type reindexJob struct {
+	from, to collection
+
+	mu       sync.Mutex // protects the fields below
+	state    string     // "running", "done" or "failed"
+	total    int
+	done     int
+	err      error
+	started  time.Time
+	finished time.Time
+}
+
+// reindexStatus is the JSON representation of a reindexJob's progress.
+type reindexStatus struct {
+	From     collection `json:"from"`
+	To       collection `json:"to"`
+	State    string     `json:"state"`
+	Total    int        `json:"total"`
+	Done     int        `json:"done"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+func (j *reindexJob) status() reindexStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st := reindexStatus{
+		From:    j.from,
+		To:      j.to,
+		State:   j.state,
+		Total:   j.total,
+		Done:    j.done,
+		Started: j.started,
+	}
+	if j.err != nil {
+		st.Error = j.err.Error()
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		st.Finished = &finished
+	}
+	return st
+}
+
+func (j *reindexJob) running() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state == "running"
+}
+
+// initCollection sets the active collection, creating one for model if the
+// store has none. It refuses to serve a collection embedded with another
+// model, or with vectors of another size, since its vectors can't be
+// compared with the model's: unless reindex is set, in which case it starts
+// re-indexing the collection for model.
+func (rs *ragServer) initCollection(model string, reindex bool) error {
+	emb := rs.newEmbedder(model)
+	coll, err := activeCollection(rs.ctx, rs.store, model, emb)
+	if err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	rs.coll = coll
+	rs.mu.Unlock()
+
+	var mismatch string
+	if coll.Model != model {
+		mismatch = fmt.Sprintf("was embedded with %q, but the embedding model is %q", coll.Model, model)
+	} else if coll.Dimensions != 0 {
+		dims, err := probeDimensions(rs.ctx, model, emb)
+		if err != nil {
+			return err
+		}
+		if dims != coll.Dimensions {
+			mismatch = fmt.Sprintf("has %d dimensions, but %q now produces %d", coll.Dimensions, model, dims)
+		}
+	}
+	if mismatch == "" {
+		return nil
+	}
+	if !reindex {
+		return fmt.Errorf("collection %s %s; run with -reindex to migrate", coll.Class, mismatch)
+	}
+	_, err = rs.startReindex(model)
+	return err
+}
+
+// startReindex creates a collection for model and starts a background job
+// that re-embeds every document of the active collection into it.
+func (rs *ragServer) startReindex(model string) (*reindexJob, error) {
+	// Find out the model's dimensions before locking: it's a call to the
+	// model, and queries and ingestion wait while the locks are held.
+	dims, err := probeDimensions(rs.ctx, model, rs.newEmbedder(model))
+	if err != nil {
+		return nil, err
+	}
+
+	rs.ingestMu.Lock()
+	defer rs.ingestMu.Unlock()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.reindex != nil && rs.reindex.running() {
+		return nil, errReindexRunning
+	}
+	to := collection{Class: newClassName(), Model: model, Dimensions: dims}
+	if err := rs.store.create(rs.ctx, to); err != nil {
+		return nil, err
+	}
+	job := &reindexJob{
+		from:    rs.coll,
+		to:      to,
+		state:   "running",
+		started: time.Now(),
+	}
+	rs.reindex = job
+	log.Printf("re-indexing %s (%s) into %s (%s)", job.from.Class, job.from.Model, job.to.Class, job.to.Model)
+	go rs.runReindex(job)
+	return job, nil
+}
+
+// runReindex copies the documents for job and then swaps the new collection
+// in.
+func (rs *ragServer) runReindex(job *reindexJob) {
+	err := rs.copyCollection(job)
+	if err == nil {
+		err = rs.swapCollection(job.to)
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.finished = time.Now()
+	if err != nil {
+		log.Printf("re-index into %s failed: %v", job.to.Class, err)
+		job.state, job.err = "failed", err
+		return
+	}
+	log.Printf("re-index done; now serving from %s, %s can be deleted", job.to.Class, job.from.Class)
+	job.state = "done"
+}
+
+func (rs *ragServer) copyCollection(job *reindexJob) error {
+	total, err := rs.store.count(rs.ctx, job.from.Class)
+	if err != nil {
+		return err
+	}
+	job.mu.Lock()
+	job.total = total
+	job.mu.Unlock()
+
+	emb := rs.newEmbedder(job.to.Model)
+	after := ""
+	for {
+		docs, err := rs.store.scan(rs.ctx, job.from.Class, after, reindexBatchSize)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", job.from.Class, err)
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+
+		texts := make([]string, len(docs))
+		for i, doc := range docs {
+			texts[i] = doc.Text
+		}
+		vectors, err := emb.embed(rs.ctx, texts)
+		if err != nil {
+			return fmt.Errorf("embedding with %q: %w", job.to.Model, err)
+		}
+		if err := checkDimensions(job.to, vectors); err != nil {
+			return err
+		}
+		for i := range docs {
+			docs[i].Vector = vectors[i]
+		}
+		if err := rs.copyBatch(job, docs); err != nil {
+			return err
+		}
+
+		job.mu.Lock()
+		job.done += len(docs)
+		job.mu.Unlock()
+		after = docs[len(docs)-1].ID
+	}
+}
+
+// copyBatch stores the documents of a batch that are still in the source
+// collection in the new one. Ingests are held off meanwhile: one deleting a
+// document from both collections after it was read, but before it was
+// stored, would otherwise have it brought back.
+func (rs *ragServer) copyBatch(job *reindexJob, docs []storedDoc) error {
+	rs.ingestMu.Lock()
+	defer rs.ingestMu.Unlock()
+	ids := make([]string, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.ID
+	}
+	exists, err := rs.store.existing(rs.ctx, job.from.Class, ids)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", job.from.Class, err)
+	}
+	var keep []storedDoc
+	for _, doc := range docs {
+		if exists[doc.ID] {
+			keep = append(keep, doc)
+		}
+	}
+	if len(keep) == 0 {
+		return nil
+	}
+	if err := rs.store.store(rs.ctx, job.to.Class, keep); err != nil {
+		return fmt.Errorf("writing %s: %w", job.to.Class, err)
+	}
+	return nil
+}
+
+// swapCollection makes coll the active collection, both in the vector store
+// and for this server.
+func (rs *ragServer) swapCollection(coll collection) error {
+	rs.ingestMu.Lock()
+	defer rs.ingestMu.Unlock()
+	if err := rs.store.setActive(rs.ctx, coll); err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	rs.coll = coll
+	rs.mu.Unlock()
+	rs.corpusChanged()
+	return nil
+}
+
+// reindexTarget returns the collection being re-indexed into, or false if
+// no re-index is running.
+func (rs *ragServer) reindexTarget() (collection, bool) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	if rs.reindex == nil || !rs.reindex.running() {
+		return collection{}, false
+	}
+	return rs.reindex.to, true
+}
+
+func (rs *ragServer) startReindexHandler(w http.ResponseWriter, req *http.Request) {
+	type reindexRequest struct {
+		EmbeddingModel string
+	}
+	rr := &reindexRequest{}
+	err := readRequestJSON(req, rr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rr.EmbeddingModel == "" {
+		http.Error(w, "embeddingModel is required", http.StatusBadRequest)
+		return
+	}
+
+	job, err := rs.startReindex(rr.EmbeddingModel)
+	if errors.Is(err, errReindexRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	renderJSON(w, job.status())
+}
+
+func (rs *ragServer) reindexStatusHandler(w http.ResponseWriter, req *http.Request) {
+	rs.mu.RLock()
+	job := rs.reindex
+	rs.mu.RUnlock()
+	if job == nil {
+		http.Error(w, "no re-index job has been started", http.StatusNotFound)
+		return
+	}
+	renderJSON(w, job.status())
+}
@@ -0,0 +1,208 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// vowelEmbedder embeds texts as vectors of vowel counts. Its vectors are
+// smaller than letterEmbedder's.
+type vowelEmbedder struct{}
+
+func (vowelEmbedder) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		v := make([]float32, 5)
+		for _, r := range strings.ToLower(text) {
+			if j := strings.IndexRune("aeiou", r); j >= 0 {
+				v[j]++
+			}
+		}
+		vectors[i] = v
+	}
+	return vectors, nil
+}
+
+// byModel returns a function that looks up a model's embedder in embedders,
+// for a server's newEmbedder.
+func byModel(embedders map[string]embedder) func(string) embedder {
+	return func(model string) embedder { return embedders[model] }
+}
+
+// waitReindex waits until job is no longer running and returns its status.
+func waitReindex(t *testing.T, job *reindexJob) reindexStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for job.running() {
+		if time.Now().After(deadline) {
+			t.Fatal("re-index didn't finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return job.status()
+}
+
+func TestReindex(t *testing.T) {
+	rs := newFileTestServer(t, nil, "aaaa", "eeee", "bcd")
+	rs.newEmbedder = byModel(map[string]embedder{"letters": letterEmbedder{}, "vowels": vowelEmbedder{}})
+	from := rs.collection()
+	corpus := rs.corpus.Load()
+
+	job, err := rs.startReindex("vowels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := waitReindex(t, job)
+	if st.State != "done" || st.Total != 3 || st.Done != 3 || st.Error != "" {
+		t.Fatalf("status = %+v, want 3 of 3 documents done", st)
+	}
+	if st.From != from || st.To.Model != "vowels" || st.To.Dimensions != 5 {
+		t.Errorf("re-indexed %+v into %+v, want from %+v into vowels with 5 dimensions", st.From, st.To, from)
+	}
+
+	if coll := rs.collection(); coll != st.To {
+		t.Errorf("active collection = %+v, want %+v", coll, st.To)
+	}
+	if coll, _, err := rs.store.active(rs.ctx); err != nil || coll != st.To {
+		t.Errorf("store's active collection = %+v, %v; want %+v", coll, err, st.To)
+	}
+	if rs.corpus.Load() == corpus {
+		t.Error("switching collections didn't invalidate cached answers")
+	}
+	docs, err := rs.store.search(rs.ctx, st.To.Class, []float32{0, 4, 0, 0, 0}, 1)
+	if err != nil || len(docs) != 1 || docs[0].Text != "eeee" {
+		t.Errorf("search in new collection = %v, %v; want eeee", docs, err)
+	}
+	if _, err := rs.ingest([]string{"oooo"}, dedupKeep); err != nil {
+		t.Errorf("ingest after re-index: %v", err)
+	}
+}
+
+// gatedEmbedder is a vowelEmbedder whose second call, the first after
+// startReindex probes its dimensions, reports that it's been made on called
+// and then waits for gate to be closed.
+type gatedEmbedder struct {
+	calls  atomic.Int32
+	called chan bool
+	gate   chan bool
+}
+
+func (e *gatedEmbedder) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if e.calls.Add(1) == 2 {
+		e.called <- true
+		<-e.gate
+	}
+	return vowelEmbedder{}.embed(ctx, texts)
+}
+
+func TestReindexConcurrentReplace(t *testing.T) {
+	emb := &gatedEmbedder{called: make(chan bool), gate: make(chan bool)}
+	rs := newFileTestServer(t, nil, "aaaa", "eeee", "bcd")
+	rs.newEmbedder = byModel(map[string]embedder{"letters": letterEmbedder{}, "vowels": emb})
+	rs.dedupSimilarity = 0.95
+	job, err := rs.startReindex("vowels")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// While the re-index is embedding the documents it read, one of them is
+	// replaced by a near duplicate.
+	<-emb.called
+	if res, err := rs.ingest([]string{"aaaab"}, dedupReplace); err != nil || res.Replaced != 1 {
+		t.Fatalf("ingest = %+v, %v; want 1 replaced", res, err)
+	}
+	close(emb.gate)
+	if st := waitReindex(t, job); st.State != "done" {
+		t.Fatalf("status = %+v", st)
+	}
+
+	docs, err := rs.store.scan(rs.ctx, job.to.Class, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, d := range docs {
+		texts = append(texts, d.Text)
+	}
+	slices.Sort(texts)
+	if want := []string{"aaaab", "bcd", "eeee"}; !slices.Equal(texts, want) {
+		t.Errorf("re-indexed collection has %q, want %q", texts, want)
+	}
+}
+
+func TestReindexRunning(t *testing.T) {
+	rs := newFileTestServer(t, nil, "aaaa", "eeee", "bcd")
+	rs.newEmbedder = byModel(map[string]embedder{"vowels": vowelEmbedder{}})
+	rs.reindex = &reindexJob{state: "running"}
+	if _, err := rs.startReindex("vowels"); err != errReindexRunning {
+		t.Errorf("startReindex with a job running: %v, want %v", err, errReindexRunning)
+	}
+}
+
+func TestInitCollection(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     string
+		embedder  embedder
+		reindex   bool
+		wantErr   string // "" for success
+		wantModel string // model of the active collection when done
+	}{
+		{"same model", "letters", letterEmbedder{}, false, "", "letters"},
+		{"other model", "vowels", vowelEmbedder{}, false, `was embedded with "letters"`, "letters"},
+		{"other dimensions", "letters", vowelEmbedder{}, false, "has 26 dimensions", "letters"},
+		{"other model, re-index", "vowels", vowelEmbedder{}, true, "", "vowels"},
+		{"other dimensions, re-index", "letters", vowelEmbedder{}, true, "", "letters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := newFileTestServer(t, nil, "aaaa", "eeee", "bcd")
+			rs.newEmbedder = byModel(map[string]embedder{tt.model: tt.embedder})
+			rs.coll = collection{}
+			err := rs.initCollection(tt.model, tt.reindex)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("initCollection: %v", err)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("initCollection: %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if rs.reindex != nil {
+				if st := waitReindex(t, rs.reindex); st.State != "done" {
+					t.Fatalf("re-index status = %+v", st)
+				}
+			} else if tt.reindex {
+				t.Fatal("no re-index started")
+			}
+			coll := rs.collection()
+			dims, _ := probeDimensions(rs.ctx, tt.model, tt.embedder)
+			if coll.Model != tt.wantModel || coll.Dimensions != dims {
+				t.Errorf("active collection = %+v, want model %q with %d dimensions", coll, tt.wantModel, dims)
+			}
+		})
+	}
+}
+
+func TestCheckDimensions(t *testing.T) {
+	coll := collection{Class: "Document", Model: "m", Dimensions: 3}
+	if err := checkDimensions(coll, [][]float32{{1, 2, 3}, {4, 5, 6}}); err != nil {
+		t.Errorf("matching vectors: %v", err)
+	}
+	if err := checkDimensions(coll, [][]float32{{1, 2, 3}, {4, 5}}); err == nil {
+		t.Error("a vector of the wrong size was accepted")
+	}
+	legacy := collection{Class: "Document", Model: legacyEmbeddingModel}
+	if err := checkDimensions(legacy, [][]float32{{1, 2}, {3}}); err != nil {
+		t.Errorf("collection without recorded dimensions: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Query rewriting: short or vague questions often retrieve poorly, so a
+// /query/ request can ask for the generator to rewrite the question first.
+// Retrieval then runs for the question and each rewrite, and the results
+// are merged.
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// rewriteMode says how a question is rewritten before retrieval.
+type rewriteMode string
+
+const (
+	rewriteNone  rewriteMode = ""
+	rewriteMulti rewriteMode = "multi" // several reformulations of the question
+	rewriteHyDE  rewriteMode = "hyde"  // a hypothetical answer, to embed like a document
+)
+
+func parseRewriteMode(s string) (rewriteMode, error) {
+	switch m := rewriteMode(s); m {
+	case rewriteNone, rewriteMulti, rewriteHyDE:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown rewrite mode %q; want multi or hyde", s)
+}
+
+const (
+	// numRewrites is the number of reformulations asked for in multi mode.
+	numRewrites = 3
+
+	// retrieveLimit is the number of documents retrieved as context.
+	retrieveLimit = 3
+)
+
+const multiRewriteTemplateStr = `
+Rewrite the following question as %d different search queries that could
+find documents relevant to it. Use different wording and, where the question
+is vague, different interpretations. Write one query per line, without
+numbering or any other text.
+
+Question:
+%s
+`
+
+const hydeTemplateStr = `
+Write a short passage, a few sentences long, that answers the following
+question as if it were taken from internal documentation. If you don't know
+the answer, write a plausible one.
+
+Question:
+%s
+`
+
+// rewriteQuestion asks the generator to rewrite question according to mode,
+// and returns the rewrites.
+func (rs *ragServer) rewriteQuestion(ctx context.Context, question string, mode rewriteMode) ([]string, error) {
+	var prompt string
+	switch mode {
+	case rewriteNone:
+		return nil, nil
+	case rewriteMulti:
+		prompt = fmt.Sprintf(multiRewriteTemplateStr, numRewrites, question)
+	case rewriteHyDE:
+		prompt = fmt.Sprintf(hydeTemplateStr, question)
+	}
+	resp, err := rs.gen.generate(ctx, &genRequest{
+		Prompt: prompt,
+		Settings: genSettings{
+			Temperature:     ptr(float32(0.7)),
+			MaxOutputTokens: ptr(min(int32(512), rs.maxOutputTokens)),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == rewriteHyDE {
+		return []string{strings.TrimSpace(resp.Text)}, nil
+	}
+	var rewrites []string
+	for _, line := range strings.Split(resp.Text, "\n") {
+		// Models number their lines regardless of instructions.
+		line = strings.TrimLeft(line, "0123456789.-*) \t")
+		line = strings.TrimSpace(line)
+		if line != "" && len(rewrites) < numRewrites {
+			rewrites = append(rewrites, line)
+		}
+	}
+	return rewrites, nil
+}
+
+// retrieveRewritten retrieves documents for question, rewritten according to
+// mode. It returns the documents and the rewrites. If rewriting fails, it
+// retrieves documents for the question alone.
+func (rs *ragServer) retrieveRewritten(ctx context.Context, question string, mode rewriteMode) ([]storedDoc, []string, error) {
+	rewrites, err := rs.rewriteQuestion(ctx, question, mode)
+	if err != nil {
+		log.Printf("rewriting question: %v", err)
+		rewrites = nil
+	}
+	if len(rewrites) > 0 {
+		log.Printf("rewrote %q (%s) as %q", question, mode, rewrites)
+	}
+	docs, err := rs.retrieve(ctx, append([]string{question}, rewrites...)...)
+	return docs, rewrites, err
+}
+
+// retrieve returns the documents most relevant to any of queries. Documents
+// found by several queries are only returned once, and documents are ranked
+// by their best similarity to any query.
+func (rs *ragServer) retrieve(ctx context.Context, queries ...string) ([]storedDoc, error) {
+	// Embed the queries with the model the active collection was embedded
+	// with.
+	coll := rs.collection()
+	vectors, err := rs.newEmbedder(coll.Model).embed(ctx, queries)
+	if err == nil {
+		err = checkDimensions(coll, vectors)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Search the vector store to find the most relevant (closest in vector
+	// space) documents to each query.
+	best := make(map[string]storedDoc)
+	for _, v := range vectors {
+		docs, err := rs.store.search(ctx, coll.Class, v, retrieveLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			if b, ok := best[doc.ID]; !ok || doc.Score > b.Score {
+				best[doc.ID] = doc
+			}
+		}
+	}
+	merged := make([]storedDoc, 0, len(best))
+	for _, doc := range best {
+		merged = append(merged, doc)
+	}
+	slices.SortFunc(merged, func(a, b storedDoc) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), cmp.Compare(a.ID, b.ID))
+	})
+	return merged[:min(retrieveLimit, len(merged))], nil
+}
+
+// docTexts returns the texts of docs.
+func docTexts(docs []storedDoc) []string {
+	texts := make([]string, len(docs))
+	for i, doc := range docs {
+		texts[i] = doc.Text
+	}
+	return texts
+}
+
+// docIDs returns the IDs of docs.
+func docIDs(docs []storedDoc) []string {
+	ids := make([]string, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.ID
+	}
+	return ids
+}
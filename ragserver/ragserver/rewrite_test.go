@@ -0,0 +1,50 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestRetrieveRewritten(t *testing.T) {
+	gen := &fakeGenerator{chunks: []string{"1. aaaa\n2) bbbb\n\n- aaab\n4. cccc\n"}}
+	rs := newFileTestServer(t, gen, "aaaa", "bbbb", "cccc", "dddd", "xyz")
+
+	docs, rewrites, err := rs.retrieveRewritten(context.Background(), "dddd", rewriteMulti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := docTexts(docs)
+	if want := []string{"aaaa", "bbbb", "aaab"}; !slices.Equal(rewrites, want) {
+		t.Errorf("rewrites = %q, want %q", rewrites, want)
+	}
+	// Each query's best match is an exact one; "aaab" finds "aaaa" again.
+	slices.Sort(contents)
+	if want := []string{"aaaa", "bbbb", "dddd"}; !slices.Equal(contents, want) {
+		t.Errorf("retrieved %q, want %q", contents, want)
+	}
+
+	// Without rewriting the generator isn't asked.
+	gen.reqs = nil
+	docs, rewrites, err = rs.retrieveRewritten(context.Background(), "dddd", rewriteNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents = docTexts(docs)
+	if len(rewrites) != 0 || len(gen.reqs) != 0 || contents[0] != "dddd" {
+		t.Errorf("without rewriting: contents %q, rewrites %q, %d prompts", contents, rewrites, len(gen.reqs))
+	}
+
+	gen.chunks = []string{"  A passage about dddd.\n"}
+	_, rewrites, err = rs.retrieveRewritten(context.Background(), "dddd", rewriteHyDE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"A passage about dddd."}; !slices.Equal(rewrites, want) {
+		t.Errorf("hyde rewrites = %q, want %q", rewrites, want)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// The Weaviate schema ragserver expects, and reconciling it with the schema
+// of a running Weaviate instance.
+//
+// On startup the live classes are compared to the declared ones and any
+// differences are logged. Additive changes - a missing class or property -
+// can be applied in place with `ragserver migrate`. Other changes, such as
+// a different tokenization or distance metric, can't be made to an existing
+// class; they take effect for classes created by a re-index.
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/weaviate/weaviate-go-client/v4/weaviate"
+	"github.com/weaviate/weaviate/entities/models"
+)
+
+// documentClass returns the declared schema of the class holding coll.
+func documentClass(coll collection) *models.Class {
+	return &models.Class{
+		Class:       coll.Class,
+		Description: fmt.Sprintf(descriptionFormat, coll.Model, coll.Dimensions),
+		Vectorizer:  "none",
+		Properties: []*models.Property{
+			{
+				Name:            "text",
+				Description:     "document contents",
+				DataType:        []string{"text"},
+				Tokenization:    "word",
+				IndexFilterable: ptr(true),
+				IndexSearchable: ptr(true),
+			},
+		},
+		VectorIndexType:   "hnsw",
+		VectorIndexConfig: map[string]any{"distance": "cosine"},
+		InvertedIndexConfig: &models.InvertedIndexConfig{
+			Bm25:      &models.BM25Config{K1: 1.2, B: 0.75},
+			Stopwords: &models.StopwordConfig{Preset: "en"},
+		},
+	}
+}
+
+// metaClass returns the declared schema of the bookkeeping class.
+func metaClass() *models.Class {
+	return &models.Class{
+		Class:       metaClassName,
+		Description: "ragserver bookkeeping",
+		Vectorizer:  "none",
+		Properties: []*models.Property{
+			{
+				Name:            "activeClass",
+				Description:     "name of the class queries and new documents go to",
+				DataType:        []string{"text"},
+				Tokenization:    "word",
+				IndexFilterable: ptr(true),
+				IndexSearchable: ptr(true),
+			},
+		},
+	}
+}
+
+// isDocumentClass reports whether name is a class created for documents:
+// the default class or one created by a re-index.
+func isDocumentClass(name string) bool {
+	return name == defaultClassName || strings.HasPrefix(name, defaultClassName+"_")
+}
+
+// schemaChange is a difference between the declared and the live schema.
+type schemaChange struct {
+	class string
+	desc  string
+
+	// apply makes the change. It's nil for changes that can't be made to an
+	// existing class.
+	apply func(ctx context.Context, client *weaviate.Client) error
+}
+
+func (c schemaChange) String() string {
+	s := c.class + ": " + c.desc
+	if c.apply == nil {
+		s += " (needs a re-index)"
+	}
+	return s
+}
+
+// schemaDiff compares the live schema of ragserver's classes to the declared
+// one.
+func (ws *weaviateStore) schemaDiff(ctx context.Context) ([]schemaChange, error) {
+	dump, err := ws.client.Schema().Getter().Do(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("weaviate error: %w", err)
+	}
+
+	var changes []schemaChange
+	hasMeta := false
+	for _, live := range dump.Classes {
+		switch {
+		case live.Class == metaClassName:
+			hasMeta = true
+			changes = append(changes, diffClass(metaClass(), live)...)
+		case isDocumentClass(live.Class):
+			changes = append(changes, diffClass(documentClass(collection{Class: live.Class}), live)...)
+		}
+	}
+	if !hasMeta {
+		cls := metaClass()
+		changes = append(changes, schemaChange{
+			class: cls.Class,
+			desc:  "missing class",
+			apply: func(ctx context.Context, client *weaviate.Client) error {
+				return client.Schema().ClassCreator().WithClass(cls).Do(ctx)
+			},
+		})
+	}
+	return changes, nil
+}
+
+// migrate applies the additive changes in the schema diff. It returns the
+// changes it applied and those it couldn't.
+func (ws *weaviateStore) migrate(ctx context.Context) (applied, skipped []schemaChange, err error) {
+	changes, err := ws.schemaDiff(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, c := range changes {
+		if c.apply == nil {
+			skipped = append(skipped, c)
+			continue
+		}
+		if err := c.apply(ctx, ws.client); err != nil {
+			return applied, skipped, fmt.Errorf("%s: weaviate error: %w", c, err)
+		}
+		applied = append(applied, c)
+	}
+	return applied, skipped, nil
+}
+
+// diffClass returns the changes needed to turn the live class into the
+// declared one. Descriptions and settings the declared class leaves unset
+// aren't compared.
+func diffClass(want, live *models.Class) []schemaChange {
+	var changes []schemaChange
+	change := func(format string, args ...any) {
+		changes = append(changes, schemaChange{class: want.Class, desc: fmt.Sprintf(format, args...)})
+	}
+
+	for _, wp := range want.Properties {
+		i := slices.IndexFunc(live.Properties, func(p *models.Property) bool { return p.Name == wp.Name })
+		if i < 0 {
+			changes = append(changes, schemaChange{
+				class: want.Class,
+				desc:  fmt.Sprintf("missing property %q", wp.Name),
+				apply: func(ctx context.Context, client *weaviate.Client) error {
+					return client.Schema().PropertyCreator().WithClassName(want.Class).WithProperty(wp).Do(ctx)
+				},
+			})
+			continue
+		}
+		lp := live.Properties[i]
+		if !slices.Equal(lp.DataType, wp.DataType) {
+			change("property %q has data type %v, want %v", wp.Name, lp.DataType, wp.DataType)
+		}
+		if wp.Tokenization != "" && lp.Tokenization != wp.Tokenization {
+			change("property %q has tokenization %q, want %q", wp.Name, lp.Tokenization, wp.Tokenization)
+		}
+		if wp.IndexFilterable != nil && boolOr(lp.IndexFilterable, true) != *wp.IndexFilterable {
+			change("property %q has indexFilterable %v, want %v", wp.Name, !*wp.IndexFilterable, *wp.IndexFilterable)
+		}
+		if wp.IndexSearchable != nil && boolOr(lp.IndexSearchable, true) != *wp.IndexSearchable {
+			change("property %q has indexSearchable %v, want %v", wp.Name, !*wp.IndexSearchable, *wp.IndexSearchable)
+		}
+	}
+
+	if want.Vectorizer != "" && live.Vectorizer != want.Vectorizer {
+		change("vectorizer is %q, want %q", live.Vectorizer, want.Vectorizer)
+	}
+	if want.VectorIndexType != "" && live.VectorIndexType != want.VectorIndexType {
+		change("vector index type is %q, want %q", live.VectorIndexType, want.VectorIndexType)
+	}
+	if wantDist := distance(want); wantDist != "" {
+		if liveDist := distance(live); liveDist != wantDist {
+			change("distance metric is %q, want %q", liveDist, wantDist)
+		}
+	}
+
+	if w := want.InvertedIndexConfig; w != nil {
+		l := live.InvertedIndexConfig
+		if l == nil {
+			l = &models.InvertedIndexConfig{}
+		}
+		if w.Bm25 != nil && (l.Bm25 == nil || *l.Bm25 != *w.Bm25) {
+			var have models.BM25Config
+			if l.Bm25 != nil {
+				have = *l.Bm25
+			}
+			change("bm25 is k1=%v b=%v, want k1=%v b=%v", have.K1, have.B, w.Bm25.K1, w.Bm25.B)
+		}
+		if w.Stopwords != nil && w.Stopwords.Preset != "" && (l.Stopwords == nil || l.Stopwords.Preset != w.Stopwords.Preset) {
+			preset := ""
+			if l.Stopwords != nil {
+				preset = l.Stopwords.Preset
+			}
+			change("stopword preset is %q, want %q", preset, w.Stopwords.Preset)
+		}
+		if l.IndexTimestamps != w.IndexTimestamps {
+			change("indexTimestamps is %v, want %v", l.IndexTimestamps, w.IndexTimestamps)
+		}
+		if l.IndexNullState != w.IndexNullState {
+			change("indexNullState is %v, want %v", l.IndexNullState, w.IndexNullState)
+		}
+		if l.IndexPropertyLength != w.IndexPropertyLength {
+			change("indexPropertyLength is %v, want %v", l.IndexPropertyLength, w.IndexPropertyLength)
+		}
+	}
+	return changes
+}
+
+// distance returns the distance metric in the vector index config of cls.
+func distance(cls *models.Class) string {
+	cfg, _ := cls.VectorIndexConfig.(map[string]any)
+	d, _ := cfg["distance"].(string)
+	return d
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func boolOr(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
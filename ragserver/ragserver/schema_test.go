@@ -0,0 +1,72 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/weaviate/weaviate/entities/models"
+)
+
+func TestDiffClass(t *testing.T) {
+	want := documentClass(collection{Class: "Document", Model: "m", Dimensions: 768})
+
+	// A class as Weaviate reports it after creating it from the declared
+	// schema, with defaults filled in.
+	live := func() *models.Class {
+		return &models.Class{
+			Class:      "Document",
+			Vectorizer: "none",
+			Properties: []*models.Property{
+				{Name: "text", DataType: []string{"text"}, Tokenization: "word", IndexFilterable: ptr(true), IndexSearchable: ptr(true)},
+			},
+			VectorIndexType:   "hnsw",
+			VectorIndexConfig: map[string]any{"distance": "cosine", "ef": -1.0},
+			InvertedIndexConfig: &models.InvertedIndexConfig{
+				Bm25:                   &models.BM25Config{K1: 1.2, B: 0.75},
+				Stopwords:              &models.StopwordConfig{Preset: "en"},
+				CleanupIntervalSeconds: 60,
+			},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		modify     func(*models.Class)
+		wantChange string // substring; "" for no changes
+		additive   bool
+	}{
+		{"same", func(*models.Class) {}, "", false},
+		{"bare", func(c *models.Class) { c.Properties = nil }, `missing property "text"`, true},
+		{"tokenization", func(c *models.Class) { c.Properties[0].Tokenization = "field" }, "tokenization", false},
+		{"data type", func(c *models.Class) { c.Properties[0].DataType = []string{"string"} }, "data type", false},
+		{"distance", func(c *models.Class) { c.VectorIndexConfig = map[string]any{"distance": "dot"} }, "distance metric", false},
+		{"bm25", func(c *models.Class) { c.InvertedIndexConfig.Bm25.B = 0.5 }, "bm25", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cls := live()
+			tt.modify(cls)
+			changes := diffClass(want, cls)
+			if tt.wantChange == "" {
+				if len(changes) != 0 {
+					t.Errorf("changes = %v, want none", changes)
+				}
+				return
+			}
+			if len(changes) != 1 {
+				t.Fatalf("changes = %v, want one", changes)
+			}
+			c := changes[0]
+			if !strings.Contains(c.String(), tt.wantChange) {
+				t.Errorf("change = %q, want it to mention %q", c, tt.wantChange)
+			}
+			if (c.apply != nil) != tt.additive {
+				t.Errorf("change %q: additive = %v, want %v", c, c.apply != nil, tt.additive)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// vectorStore stores documents with their embedding vectors in collections,
+// and finds the documents closest to a vector. One collection is active:
+// it's the one queries and new documents go to.
+//
+// There are two implementations: weaviateStore, and fileStore for
+// deployments that don't want to run Weaviate. VECTOR_STORE selects one.
+type vectorStore interface {
+	// active returns the active collection, or false if there is none yet.
+	active(ctx context.Context) (collection, bool, error)
+
+	// setActive makes coll the active collection. Readers see either the old
+	// or the new collection, never a mix.
+	setActive(ctx context.Context, coll collection) error
+
+	// create creates an empty collection.
+	create(ctx context.Context, coll collection) error
+
+	// count returns the number of documents in the named collection.
+	count(ctx context.Context, class string) (int, error)
+
+	// store stores docs in the named collection, replacing documents with
+	// the same IDs.
+	store(ctx context.Context, class string, docs []storedDoc) error
+
+	// scan returns up to limit documents of the named collection whose IDs
+	// sort after the given one (or from the start if after is ""), in ID
+	// order. Their vectors aren't filled in.
+	scan(ctx context.Context, class string, after string, limit int) ([]storedDoc, error)
+
+	// search returns up to limit documents of the named collection closest
+	// to vector, closest first, with their Score set.
+	search(ctx context.Context, class string, vector []float32, limit int) ([]storedDoc, error)
+
+	// fetch returns the stored documents of the named collection with the
+	// given IDs, in no particular order. Their vectors aren't filled in, and
+	// IDs that aren't stored are ignored.
+	fetch(ctx context.Context, class string, ids []string) ([]storedDoc, error)
+
+	// existing returns which of ids are stored in the named collection.
+	existing(ctx context.Context, class string, ids []string) (map[string]bool, error)
+
+	// delete removes the documents with the given IDs from the named
+	// collection. IDs that aren't stored are ignored.
+	delete(ctx context.Context, class string, ids []string) error
+
+	// close flushes the store and releases its resources. The store can't
+	// be used afterwards.
+	close() error
+}
+
+// storedDoc is a document in a vectorStore.
+type storedDoc struct {
+	ID     string    `json:"id"`
+	Text   string    `json:"text"`
+	Vector []float32 `json:"vector,omitempty"`
+
+	// Score is the cosine similarity to the query vector, for documents
+	// returned by search.
+	Score float64 `json:"-"`
+}
+
+// collection is a set of documents in a vectorStore, along with the
+// embedding model that computed their vectors and the number of dimensions
+// it produces.
+type collection struct {
+	Class      string `json:"class"`
+	Model      string `json:"model"`
+	Dimensions int    `json:"dimensions"`
+}
+
+const (
+	// defaultClassName is the collection documents are stored in until the
+	// first re-index creates a new one.
+	defaultClassName = "Document"
+
+	// legacyEmbeddingModel is the model used by ragserver versions that
+	// didn't record one with the collection.
+	legacyEmbeddingModel = "text-embedding-004"
+)
+
+// initStore initializes the vector store selected by cfg.
+func initStore(ctx context.Context, cfg *config) (vectorStore, error) {
+	switch cfg.VectorStore {
+	case "weaviate":
+		return initWeaviate(ctx, cfg.WeaviateAddress)
+	case "file":
+		return openFileStore(cfg.DataDir, 10*time.Minute, cfg.hnsw())
+	default:
+		return nil, fmt.Errorf("unknown vector store %q", cfg.VectorStore)
+	}
+}
+
+// activeCollection returns the active collection of store. If there is none
+// yet, it creates one for model, using emb to find out how many dimensions
+// the model's vectors have.
+func activeCollection(ctx context.Context, store vectorStore, model string, emb embedder) (collection, error) {
+	coll, ok, err := store.active(ctx)
+	if err != nil || ok {
+		return coll, err
+	}
+	coll, err = createCollection(ctx, store, defaultClassName, model, emb)
+	if err != nil {
+		return collection{}, err
+	}
+	return coll, store.setActive(ctx, coll)
+}
+
+// createCollection creates a new collection for documents embedded with
+// model.
+func createCollection(ctx context.Context, store vectorStore, className, model string, emb embedder) (collection, error) {
+	dims, err := probeDimensions(ctx, model, emb)
+	if err != nil {
+		return collection{}, err
+	}
+	coll := collection{Class: className, Model: model, Dimensions: dims}
+	if err := store.create(ctx, coll); err != nil {
+		return collection{}, err
+	}
+	return coll, nil
+}
+
+// probeDimensions returns the number of dimensions of the vectors emb
+// computes, by embedding a short text.
+func probeDimensions(ctx context.Context, model string, emb embedder) (int, error) {
+	probe, err := emb.embed(ctx, []string{"dimension probe"})
+	if err != nil {
+		return 0, fmt.Errorf("embedding with %q: %w", model, err)
+	}
+	return len(probe[0]), nil
+}
+
+// newClassName returns a fresh collection name for a re-index.
+func newClassName() string {
+	return fmt.Sprintf("%s_%d", defaultClassName, time.Now().Unix())
+}
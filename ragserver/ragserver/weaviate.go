@@ -7,30 +7,47 @@ package main
 // Utilities for working with Weaviate.
 
 import (
-	"cmp"
 	"context"
 	"fmt"
-	"os"
+	"log"
 
+	"github.com/go-openapi/strfmt"
 	"github.com/weaviate/weaviate-go-client/v4/weaviate"
+	"github.com/weaviate/weaviate-go-client/v4/weaviate/filters"
+	"github.com/weaviate/weaviate-go-client/v4/weaviate/graphql"
 	"github.com/weaviate/weaviate/entities/models"
 )
 
-// initWeaviate initializes a weaviate client for our application.
-func initWeaviate(ctx context.Context) (*weaviate.Client, error) {
+const (
+	// metaClassName is a class holding ragserver's own bookkeeping: a single
+	// object with ID metaObjectID that names the active document class.
+	// Pointing it at a different class is how a re-index is swapped in.
+	metaClassName = "RagserverMeta"
+	metaObjectID  = "0b6e3f4a-5d1c-4c8e-9f2a-7e4d8c1b6a30"
+)
+
+// Each collection is a Weaviate class. Its embedding model and dimensions
+// are recorded in the class description.
+const descriptionFormat = "ragserver documents; embedding model %q, %d dimensions"
+
+// weaviateStore is a vectorStore backed by Weaviate.
+type weaviateStore struct {
+	client *weaviate.Client
+}
+
+// initWeaviate initializes a weaviate client for our application, for the
+// Weaviate server at address.
+func initWeaviate(ctx context.Context, address string) (*weaviateStore, error) {
 	client, err := weaviate.NewClient(weaviate.Config{
-		Host:   "localhost:" + cmp.Or(os.Getenv("WVPORT"), "9035"),
+		Host:   address,
 		Scheme: "http",
 	})
 	if err != nil {
 		return nil, fmt.Errorf("initializing weaviate: %w", err)
 	}
 
-	// Create a new class (collection) in weaviate if it doesn't exist yet.
-	cls := &models.Class{
-		Class:      "Document",
-		Vectorizer: "none",
-	}
+	// Create the bookkeeping class if it doesn't exist yet.
+	cls := metaClass()
 	exists, err := client.Schema().ClassExistenceChecker().WithClassName(cls.Class).Do(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("weaviate error: %w", err)
@@ -42,7 +59,291 @@ func initWeaviate(ctx context.Context) (*weaviate.Client, error) {
 		}
 	}
 
-	return client, nil
+	// Report differences from the declared schema; they're applied by
+	// `ragserver migrate`, or by a re-index.
+	ws := &weaviateStore{client: client}
+	changes, err := ws.schemaDiff(ctx)
+	if err != nil {
+		return nil, err
+	}
+	migratable := false
+	for _, c := range changes {
+		log.Printf("schema differs: %s", c)
+		migratable = migratable || c.apply != nil
+	}
+	if migratable {
+		log.Printf("run `ragserver migrate` to apply additive schema changes")
+	}
+	return ws, nil
+}
+
+func (ws *weaviateStore) active(ctx context.Context) (collection, bool, error) {
+	hasMeta, err := ws.client.Data().Checker().WithClassName(metaClassName).WithID(metaObjectID).Do(ctx)
+	if err != nil {
+		return collection{}, false, fmt.Errorf("weaviate error: %w", err)
+	}
+
+	// Without the bookkeeping object, documents are in the default class, if
+	// anywhere.
+	className := defaultClassName
+	if hasMeta {
+		objs, err := ws.client.Data().ObjectsGetter().WithClassName(metaClassName).WithID(metaObjectID).Do(ctx)
+		if err != nil {
+			return collection{}, false, fmt.Errorf("weaviate error: %w", err)
+		}
+		props, _ := objs[0].Properties.(map[string]any)
+		if s, ok := props["activeClass"].(string); ok {
+			className = s
+		}
+	}
+
+	exists, err := ws.client.Schema().ClassExistenceChecker().WithClassName(className).Do(ctx)
+	if err != nil {
+		return collection{}, false, fmt.Errorf("weaviate error: %w", err)
+	}
+	if !exists {
+		return collection{}, false, nil
+	}
+	cls, err := ws.client.Schema().ClassGetter().WithClassName(className).Do(ctx)
+	if err != nil {
+		return collection{}, false, fmt.Errorf("weaviate error: %w", err)
+	}
+
+	// Classes created before ragserver recorded embedding models are assumed
+	// to use legacyEmbeddingModel.
+	coll := collection{Class: className}
+	_, err = fmt.Sscanf(cls.Description, descriptionFormat, &coll.Model, &coll.Dimensions)
+	if err != nil {
+		coll.Model, coll.Dimensions = legacyEmbeddingModel, 0
+	}
+	return coll, true, nil
+}
+
+func (ws *weaviateStore) create(ctx context.Context, coll collection) error {
+	err := ws.client.Schema().ClassCreator().WithClass(documentClass(coll)).Do(ctx)
+	if err != nil {
+		return fmt.Errorf("weaviate error: %w", err)
+	}
+	return nil
+}
+
+// setActive points the bookkeeping object at coll's class. This is a single
+// object write, so readers see either the old or the new class.
+func (ws *weaviateStore) setActive(ctx context.Context, coll collection) error {
+	props := map[string]any{"activeClass": coll.Class}
+	exists, err := ws.client.Data().Checker().WithClassName(metaClassName).WithID(metaObjectID).Do(ctx)
+	if err != nil {
+		return fmt.Errorf("weaviate error: %w", err)
+	}
+	if exists {
+		err = ws.client.Data().Updater().WithClassName(metaClassName).WithID(metaObjectID).
+			WithProperties(props).WithMerge().Do(ctx)
+	} else {
+		_, err = ws.client.Data().Creator().WithClassName(metaClassName).WithID(metaObjectID).
+			WithProperties(props).Do(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("weaviate error: %w", err)
+	}
+	return nil
+}
+
+func (ws *weaviateStore) count(ctx context.Context, className string) (int, error) {
+	result, err := ws.client.GraphQL().Aggregate().
+		WithClassName(className).
+		WithFields(graphql.Field{Name: "meta", Fields: []graphql.Field{{Name: "count"}}}).
+		Do(ctx)
+	if werr := combinedWeaviateError(result, err); werr != nil {
+		return 0, werr
+	}
+
+	// The result looks like {"Aggregate": {className: [{"meta": {"count": N}}]}}.
+	agg, _ := result.Data["Aggregate"].(map[string]any)
+	list, _ := agg[className].([]any)
+	if len(list) != 1 {
+		return 0, fmt.Errorf("unexpected aggregate result for %s", className)
+	}
+	item, _ := list[0].(map[string]any)
+	meta, _ := item["meta"].(map[string]any)
+	count, ok := meta["count"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected aggregate result for %s", className)
+	}
+	return int(count), nil
+}
+
+func (ws *weaviateStore) store(ctx context.Context, className string, docs []storedDoc) error {
+	// Convert our documents - along with their embedding vectors - into types
+	// used by the Weaviate client library.
+	objects := make([]*models.Object, len(docs))
+	for i, doc := range docs {
+		objects[i] = &models.Object{
+			Class: className,
+			ID:    strfmt.UUID(doc.ID),
+			Properties: map[string]any{
+				"text": doc.Text,
+			},
+			Vector: doc.Vector,
+		}
+	}
+	resp, err := ws.client.Batch().ObjectsBatcher().WithObjects(objects...).Do(ctx)
+	if err != nil {
+		return fmt.Errorf("weaviate error: %w", err)
+	}
+
+	// Objects can fail individually; report the first failure.
+	for _, r := range resp {
+		if r.Result != nil && r.Result.Errors != nil && len(r.Result.Errors.Error) > 0 {
+			return fmt.Errorf("weaviate error storing %s: %s", r.ID, r.Result.Errors.Error[0].Message)
+		}
+	}
+	return nil
+}
+
+func (ws *weaviateStore) scan(ctx context.Context, className, after string, limit int) ([]storedDoc, error) {
+	getter := ws.client.Data().ObjectsGetter().
+		WithClassName(className).
+		WithLimit(limit)
+	if after != "" {
+		getter = getter.WithAfter(after)
+	}
+	objs, err := getter.Do(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("weaviate error: %w", err)
+	}
+	docs := make([]storedDoc, len(objs))
+	for i, obj := range objs {
+		props, _ := obj.Properties.(map[string]any)
+		docs[i].ID = obj.ID.String()
+		docs[i].Text, _ = props["text"].(string)
+	}
+	return docs, nil
+}
+
+func (ws *weaviateStore) search(ctx context.Context, className string, vector []float32, limit int) ([]storedDoc, error) {
+	gql := ws.client.GraphQL()
+	result, err := gql.Get().
+		WithNearVector(
+			gql.NearVectorArgBuilder().WithVector(vector)).
+		WithClassName(className).
+		WithFields(
+			graphql.Field{Name: "text"},
+			graphql.Field{Name: "_additional", Fields: []graphql.Field{{Name: "id"}, {Name: "distance"}}}).
+		WithLimit(limit).
+		Do(ctx)
+	if werr := combinedWeaviateError(result, err); werr != nil {
+		return nil, werr
+	}
+
+	docs, err := decodeGetResults(result, className)
+	if err != nil {
+		return nil, fmt.Errorf("reading weaviate response: %w", err)
+	}
+	return docs, nil
+}
+
+func (ws *weaviateStore) fetch(ctx context.Context, className string, ids []string) ([]storedDoc, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	result, err := ws.client.GraphQL().Get().
+		WithClassName(className).
+		WithWhere(idFilter(ids)).
+		WithFields(
+			graphql.Field{Name: "text"},
+			graphql.Field{Name: "_additional", Fields: []graphql.Field{{Name: "id"}}}).
+		WithLimit(len(ids)).
+		Do(ctx)
+	if werr := combinedWeaviateError(result, err); werr != nil {
+		return nil, werr
+	}
+	docs, err := decodeGetResults(result, className)
+	if err != nil {
+		return nil, fmt.Errorf("reading weaviate response: %w", err)
+	}
+	return docs, nil
+}
+
+func (ws *weaviateStore) existing(ctx context.Context, className string, ids []string) (map[string]bool, error) {
+	docs, err := ws.fetch(ctx, className, ids)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	for _, doc := range docs {
+		found[doc.ID] = true
+	}
+	return found, nil
+}
+
+func (ws *weaviateStore) delete(ctx context.Context, className string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	resp, err := ws.client.Batch().ObjectsBatchDeleter().
+		WithClassName(className).
+		WithWhere(idFilter(ids)).
+		WithOutput("minimal").
+		Do(ctx)
+	if err != nil {
+		return fmt.Errorf("weaviate error: %w", err)
+	}
+	if r := resp.Results; r != nil && r.Failed > 0 {
+		return fmt.Errorf("weaviate error: failed to delete %d objects from %s", r.Failed, className)
+	}
+	return nil
+}
+
+// close does nothing: the Weaviate client holds no resources that need
+// releasing.
+func (ws *weaviateStore) close() error { return nil }
+
+// idFilter returns a filter matching objects with any of the given IDs.
+func idFilter(ids []string) *filters.WhereBuilder {
+	return filters.Where().
+		WithPath([]string{"id"}).
+		WithOperator(filters.ContainsAny).
+		WithValueText(ids...)
+}
+
+// decodeGetResults decodes the result returned by Weaviate's GraphQL Get
+// query; these are returned as a nested map[string]any (just like JSON
+// unmarshaled into a map[string]any). We have to extract the IDs, contents
+// and, if requested, distances of all documents.
+func decodeGetResults(result *models.GraphQLResponse, className string) ([]storedDoc, error) {
+	data, ok := result.Data["Get"]
+	if !ok {
+		return nil, fmt.Errorf("Get key not found in result")
+	}
+	doc, ok := data.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("Get key unexpected type")
+	}
+	slc, ok := doc[className].([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a list of results", className)
+	}
+
+	var out []storedDoc
+	for _, s := range slc {
+		smap, ok := s.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid element in list of documents")
+		}
+		s, ok := smap["text"].(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string in list of documents")
+		}
+		additional, _ := smap["_additional"].(map[string]any)
+		id, _ := additional["id"].(string)
+		doc := storedDoc{ID: id, Text: s}
+		// With the cosine metric, distance is 1 - similarity.
+		if d, ok := additional["distance"].(float64); ok {
+			doc.Score = 1 - d
+		}
+		out = append(out, doc)
+	}
+	return out, nil
 }
 
 // combinedWeaviateError generates an error if err is non-nil or result has